@@ -0,0 +1,462 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/prometheus/storage/remote"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the max num of fingerprints in one 'IN' list of a mutation, about 22 bytes each, so a mutation is far below
+// the default max_query_size (256KiB) of clickhouse
+const deleteFingerprintsPerMutation = 4000
+
+// the mutations of delete_series are checked every interval till they are done or timeout, to invalidate the caches of reader again
+const (
+	mutationsCheckInterval = time.Second * 5
+	mutationsCheckTimeout  = time.Hour * 24
+)
+
+type mutationStatus struct {
+	Database         string    `json:"database"`
+	Table            string    `json:"table"`
+	MutationId       string    `json:"mutation_id"`
+	Command          string    `json:"command"`
+	CreateTime       time.Time `json:"create_time"`
+	PartsToDo        int64     `json:"parts_to_do"`
+	IsDone           bool      `json:"is_done"`
+	LatestFailReason string    `json:"latest_fail_reason"`
+}
+
+type deleteSeriesResult struct {
+	Db        string            `json:"db"`
+	Table     string            `json:"table"`
+	Start     string            `json:"start"`
+	End       string            `json:"end"`
+	Series    int               `json:"series"`
+	Commands  []string          `json:"commands"`
+	Mutations []*mutationStatus `json:"mutations"`
+}
+
+// seriesDeleter purges series from the tables of mode 3 by 'ALTER TABLE ... DELETE' mutations,
+// the fingerprints are resolved by the same wheres as the reader, so what you can read is what you delete
+type seriesDeleter struct {
+	tag    string
+	click  *click
+	utc    bool
+}
+
+func (d *seriesDeleter) init() {
+	d.tag   = "admin"
+	d.utc   = Cfg.Reader.Utc
+	d.click = Engine.clicks.GetServer(Cfg.Writer.Clickhouse)
+
+	if d.click == nil {
+		slog.Fatalf("%s: clickhouse '%s' set in writer can not be found", d.tag, Cfg.Writer.Clickhouse)
+	}
+}
+
+func (d *seriesDeleter) getDbTable(r *http.Request) (string, string, error) {
+	dbName := d.click.cfg.Database
+	tbName := d.click.cfg.Table
+
+	if db := r.Form.Get("db"); db != "" {
+		dbName = db
+	}
+	if table := r.Form.Get("table"); table != "" {
+		tbName = table
+	}
+	// they are passed to the mutations too, so only the plain names are accepted
+	if err := checkDbTable(dbName, tbName); err != nil {
+		return "", "", err
+	}
+
+	return dbName, tbName, nil
+}
+
+// tables returns the tables of mode 3 the series are deleted from
+func (d *seriesDeleter) tables(table string) []string {
+	out := []string{table + "_metrics", table + "_samples"}
+	if Cfg.Writer.LabelIndex {
+		out = append(out, table + "_labels")
+	}
+
+	return out
+}
+
+func (d *seriesDeleter) resolveFingerprints(ctx context.Context, db string, table string, selector string, start time.Time, end time.Time) ([]uint64, error) {
+
+	matchers, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	query := newSqlQuery(&remote.Query{
+		StartTimestampMs: start.Unix() * 1000,
+		EndTimestampMs  : end.Unix() * 1000,
+		Matchers        : matchers,
+	})
+
+	_, query.sStartDate = formatTime(start, d.utc)
+	_, query.sEndDate   = formatTime(end  , d.utc)
+
+	query.rows   = append(query.rows, "fingerprint")
+	query.from   = sqlTable(db, table + "_metrics")
+	query.wheres = append(query.wheres, fmt.Sprintf("date >= '%s' AND date <= '%s'", query.sStartDate, query.sEndDate))
+	query.wheres = append(query.wheres, compileMatchers(query.query.Matchers)...)
+	query.groupBy = "fingerprint"
+	query.genSql()
+
+	slog.Debugf("%s: resolve fingerprints: running sql: %s", d.tag, query.sql)
+
+	rows, err := d.click.Query(ctx, query.sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []uint64
+	for rows.Next() {
+		var fingerprint uint64
+		if err = rows.Scan(&fingerprint); err != nil {
+			return nil, err
+		}
+		out = append(out, fingerprint)
+	}
+
+	return out, rows.Err()
+}
+
+// mutationsSql returns the sql of the last 100 mutations of delete_series on the tables, the other mutations are skipped,
+// if fingerprints is set, only the ones created since the time and deleting one of the fingerprints are returned,
+// clickhouse formats the commands, so they are matched by the fingerprints (the first of every IN list is enough)
+func mutationsSql(db string, tables []string, since time.Time, fingerprints []uint64) string {
+
+	wheres := []string{
+		fmt.Sprintf("database = %s", sqlString(db)),
+		fmt.Sprintf("table IN (%s)", sqlStrings(tables)),
+		"startsWith(command, 'DELETE WHERE')",
+		"position(command, 'fingerprint IN') > 0",
+	}
+	if len(fingerprints) > 0 {
+		wheres = append(wheres, fmt.Sprintf("create_time >= toDateTime(%d)", since.Unix()))
+
+		var found []string
+		for _, fp := range fingerprints {
+			found = append(found, fmt.Sprintf("match(command, '[^0-9]%d[^0-9]')", fp))
+		}
+		wheres = append(wheres, "(" + strings.Join(found, " OR ") + ")")
+	}
+
+	return fmt.Sprintf(`SELECT database, table, mutation_id, command, create_time, parts_to_do, is_done, latest_fail_reason
+		FROM system.mutations WHERE %s ORDER BY create_time DESC LIMIT 100`, strings.Join(wheres, " AND "))
+}
+
+// getMutations returns the mutations of delete_series on the tables, see mutationsSql
+func (d *seriesDeleter) getMutations(ctx context.Context, db string, tables []string, since time.Time, fingerprints []uint64) ([]*mutationStatus, error) {
+
+	sql := mutationsSql(db, tables, since, fingerprints)
+
+	rows, err := d.click.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []*mutationStatus{}
+	for rows.Next() {
+		var (
+			ms     mutationStatus
+			isDone uint8
+		)
+		if err = rows.Scan(&ms.Database, &ms.Table, &ms.MutationId, &ms.Command, &ms.CreateTime, &ms.PartsToDo, &isDone, &ms.LatestFailReason); err != nil {
+			return nil, err
+		}
+		ms.IsDone = isDone == 1
+		out = append(out, &ms)
+	}
+
+	return out, rows.Err()
+}
+
+// invalidateCaches drops the fingerprints and results cached by reader of db.table
+func (d *seriesDeleter) invalidateCaches(db string, table string) {
+	resolveCache.invalidateTable(db, table)
+	resultsCache.invalidateTable(db, table)
+}
+
+// invalidateCachesWhenDone waits for the mutations of db.table done, and then invalidates the caches of reader again
+func (d *seriesDeleter) invalidateCachesWhenDone(db string, table string) {
+
+	ticker := time.NewTicker(mutationsCheckInterval)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(mutationsCheckTimeout)
+	for range ticker.C {
+		running, err := d.countRunningMutations(context.Background(), db, d.tables(table))
+		if err != nil {
+			slog.Warnf("%s: check mutations of %s.%s failed: %s", d.tag, db, table, err)
+		}
+		if (err != nil || running > 0) && time.Now().Before(deadline) {
+			continue
+		}
+
+		d.invalidateCaches(db, table)
+		if err != nil || running > 0 {
+			slog.Warnf("%s: mutations of %s.%s not done in %s, caches of reader invalidated", d.tag, db, table, mutationsCheckTimeout)
+		} else {
+			slog.Infof("%s: mutations of %s.%s done, caches of reader invalidated", d.tag, db, table)
+		}
+		return
+	}
+}
+
+// countRunningMutations returns the num of mutations not done of the tables
+func (d *seriesDeleter) countRunningMutations(ctx context.Context, db string, tables []string) (uint64, error) {
+
+	sql := fmt.Sprintf("SELECT count() FROM system.mutations WHERE database = %s AND table IN (%s) AND is_done = 0",
+		sqlString(db), sqlStrings(tables))
+
+	rows, err := d.click.Query(ctx, sql)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n uint64
+	for rows.Next() {
+		if err = rows.Scan(&n); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, rows.Err()
+}
+
+// inZone returns t in the zone of reader, the dates of tables are in it
+func (d *seriesDeleter) inZone(t time.Time) time.Time {
+	if d.utc {
+		return t.UTC()
+	}
+
+	return t.Local()
+}
+
+// deleteCommands returns the mutations to delete the fingerprints in [start, end], the IN lists are split by
+// deleteFingerprintsPerMutation, fullDays reports whether any date is fully covered, then the rows of <table>_metrics
+// (and <table>_labels) of these dates are deleted too, heads are the first fingerprints of the IN lists
+func (d *seriesDeleter) deleteCommands(db string, table string, fingerprints []uint64, start time.Time, end time.Time) (cmds []string, fullDays bool, heads []uint64) {
+
+	sStart, _ := formatTime(start, d.utc)
+	sEnd  , _ := formatTime(end  , d.utc)
+
+	// the first and last date fully covered, in the zone of reader
+	firstDay := d.inZone(start)
+	lastDay  := d.inZone(end)
+	if firstDay.Hour() != 0 || firstDay.Minute() != 0 || firstDay.Second() != 0 {
+		firstDay = firstDay.AddDate(0, 0, 1)
+	}
+	if lastDay.Hour() != 23 || lastDay.Minute() != 59 || lastDay.Second() != 59 {
+		lastDay = lastDay.AddDate(0, 0, -1)
+	}
+	_, sFirstDay := formatTime(firstDay, d.utc)
+	_, sLastDay  := formatTime(lastDay , d.utc)
+
+	fullDays = sFirstDay <= sLastDay
+
+	for i := 0; i < len(fingerprints); i += deleteFingerprintsPerMutation {
+		chunk := fingerprints[i:]
+		if len(chunk) > deleteFingerprintsPerMutation {
+			chunk = chunk[:deleteFingerprintsPerMutation]
+		}
+		heads = append(heads, chunk[0])
+
+		list := make([]string, 0, len(chunk))
+		for _, fp := range chunk {
+			list = append(list, strconv.FormatUint(fp, 10))
+		}
+		inSQL := fmt.Sprintf("fingerprint IN (%s)", strings.Join(list, ", "))
+
+		cmds = append(cmds, fmt.Sprintf("ALTER TABLE %s DELETE WHERE ts >= '%s' AND ts <= '%s' AND %s", sqlTable(db, table + "_samples"), sStart, sEnd, inSQL))
+		if fullDays {
+			cmds = append(cmds, fmt.Sprintf("ALTER TABLE %s DELETE WHERE date >= '%s' AND date <= '%s' AND %s", sqlTable(db, table + "_metrics"), sFirstDay, sLastDay, inSQL))
+			if Cfg.Writer.LabelIndex {
+				cmds = append(cmds, fmt.Sprintf("ALTER TABLE %s DELETE WHERE date >= '%s' AND date <= '%s' AND %s", sqlTable(db, table + "_labels"), sFirstDay, sLastDay, inSQL))
+			}
+		}
+	}
+
+	return cmds, fullDays, heads
+}
+
+// DeleteSeries deletes the samples of the matched series in [start, end],
+// the rows in <table>_metrics are deleted only for the dates fully covered by [start, end],
+// because the samples out of the range in the same date still need them to be read
+func (d *seriesDeleter) DeleteSeries(ctx context.Context, db string, table string, selectors []string, start time.Time, end time.Time) (*deleteSeriesResult, error) {
+
+	res := new(deleteSeriesResult)
+	res.Db    = db
+	res.Table = table
+	res.Start, _ = formatTime(start, d.utc)
+	res.End  , _ = formatTime(end  , d.utc)
+
+	found := map[uint64]bool{}
+	for _, selector := range selectors {
+		fps, err := d.resolveFingerprints(ctx, db, table, selector, start, end)
+		if err != nil {
+			return nil, fmt.Errorf("resolve fingerprints for '%s' failed: %s", selector, err)
+		}
+		for _, fp := range fps {
+			found[fp] = true
+		}
+	}
+	fingerprints := make([]uint64, 0, len(found))
+	for fp := range found {
+		fingerprints = append(fingerprints, fp)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool { return fingerprints[i] < fingerprints[j] })
+
+	res.Series   = len(fingerprints)
+	res.Commands = []string{}
+
+	// the mutations run in background, the rows not deleted yet may be read and cached again, so the caches of reader
+	// are invalidated when the mutations are created (even if some of them failed), and again when they are done
+	defer func() {
+		if len(res.Commands) > 0 {
+			d.invalidateCaches(db, table)
+			go d.invalidateCachesWhenDone(db, table)
+		}
+	}()
+
+	cmds, fullDays, heads := d.deleteCommands(db, table, fingerprints, start, end)
+
+	// a minute earlier, for the clock of clickhouse may differ a little
+	since := time.Now().Add(-time.Minute)
+	for _, cmd := range cmds {
+		slog.Debugf("%s: delete series: running sql: %s", d.tag, cmd)
+
+		// not canceled with the request, or the series may be partly deleted
+		if _, err := d.click.Exec(context.Background(), cmd); err != nil {
+			return nil, err
+		}
+		res.Commands = append(res.Commands, cmd)
+	}
+
+	// the deleted fingerprints need to be written again if they are still alive
+	if fullDays {
+		if w, ok := Engine.writer.(*clickWriter3); ok {
+			w.forgetFingerprints(db, table, fingerprints)
+		}
+	}
+
+	slog.Infof("%s: delete %d series from %s.[%s_metrics,%s_samples] in [%s, %s], %d mutations created", d.tag, res.Series, db, table, table, res.Start, res.End, len(res.Commands))
+
+	res.Mutations = []*mutationStatus{}
+	if len(heads) > 0 {
+		mutations, err := d.getMutations(ctx, db, d.tables(table), since, heads)
+		if err != nil {
+			return nil, err
+		}
+		res.Mutations = mutations
+	}
+
+	return res, nil
+}
+
+// parseTimeRange parses the start and end of form, unix seconds or rfc3339, default the whole time till now
+func parseTimeRange(form url.Values, now time.Time) (time.Time, time.Time, error) {
+
+	var err error
+
+	start := time.Unix(0, 0)
+	end   := now
+	if arg := form.Get("start"); arg != "" {
+		if start, err = parseTime(arg); err != nil {
+			return start, end, err
+		}
+	}
+	if arg := form.Get("end"); arg != "" {
+		if end, err = parseTime(arg); err != nil {
+			return start, end, err
+		}
+	}
+	if end.Before(start) {
+		return start, end, fmt.Errorf("end is before start")
+	}
+
+	return start, end, nil
+}
+
+// handlerForDeleteSeries handles /api/v1/admin/delete_series, the args are the same as prometheus:
+//   match[]   : series selectors, at least one is required
+//   start, end: unix seconds or rfc3339, default the whole time
+//   db, table : default from the clickhouse server set in writer
+func (d *seriesDeleter) handlerForDeleteSeries(w http.ResponseWriter, r *http.Request) {
+
+	slog.Infof("%s: %s from %s @ %s", d.tag, r.RequestURI, r.Header.Get("User-Agent"), r.RemoteAddr)
+
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		respondError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+
+	db, table, err := d.getDbTable(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	start, end, err := parseTimeRange(r.Form, time.Now())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := d.DeleteSeries(r.Context(), db, table, selectors, start, end)
+	if err != nil {
+		slog.Errorf("%s: delete series failed: %s", d.tag, err)
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, res)
+}
+
+// handlerForMutations handles /api/v1/admin/mutations, to report the progress of the mutations created by delete_series
+func (d *seriesDeleter) handlerForMutations(w http.ResponseWriter, r *http.Request) {
+
+	if err := r.ParseForm(); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	db, table, err := d.getDbTable(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	mutations, err := d.getMutations(r.Context(), db, d.tables(table), time.Time{}, nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, mutations)
+}
@@ -0,0 +1,174 @@
+package modules
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeRange(t *testing.T) {
+
+	now := time.Unix(1588334400, 0)
+
+	cases := []struct {
+		start string
+		end   string
+		want  [2]int64
+		err   bool
+	}{
+		{"", "", [2]int64{0, 1588334400}, false},
+		{"1588291200", "", [2]int64{1588291200, 1588334400}, false},
+		{"1588291200.5", "1588291300", [2]int64{1588291200, 1588291300}, false},
+		{"2020-05-01T00:00:00+02:00", "2020-05-01T01:00:00Z", [2]int64{1588284000, 1588294800}, false},
+		{"1588291300", "1588291200", [2]int64{}, true},
+		{"yesterday", "", [2]int64{}, true},
+		{"", "2020-05-01", [2]int64{}, true},
+	}
+
+	for _, c := range cases {
+		form := url.Values{}
+		if c.start != "" {
+			form.Set("start", c.start)
+		}
+		if c.end != "" {
+			form.Set("end", c.end)
+		}
+
+		start, end, err := parseTimeRange(form, now)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseTimeRange(%q, %q) got no error", c.start, c.end)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTimeRange(%q, %q) failed: %s", c.start, c.end, err)
+			continue
+		}
+		if start.Unix() != c.want[0] || end.Unix() != c.want[1] {
+			t.Errorf("parseTimeRange(%q, %q) = [%d, %d], want %v", c.start, c.end, start.Unix(), end.Unix(), c.want)
+		}
+	}
+}
+
+func TestDeleteCommands(t *testing.T) {
+
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("UTC+8", 8 * 3600)
+
+	labelIndex := Cfg.Writer.LabelIndex
+	defer func() { Cfg.Writer.LabelIndex = labelIndex }()
+	Cfg.Writer.LabelIndex = false
+
+	mustParse := func(s string) time.Time {
+		tm, err := parseTime(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	cases := []struct {
+		utc      bool
+		start    string
+		end      string
+		samples  string
+		days     string // the dates of <table>_metrics, empty if no date is fully covered
+	}{
+		// the day boundaries are in the zone of reader, not the one of args
+		{true , "2020-05-01T00:00:00+02:00", "2020-05-02T23:59:59+02:00", "ts >= '2020-04-30 22:00:00' AND ts <= '2020-05-02 21:59:59'", "date >= '2020-05-01' AND date <= '2020-05-01'"},
+		{true , "2020-05-01T00:00:00Z"     , "2020-05-02T23:59:59Z"     , "ts >= '2020-05-01 00:00:00' AND ts <= '2020-05-02 23:59:59'", "date >= '2020-05-01' AND date <= '2020-05-02'"},
+		{false, "2020-05-01T00:00:00Z"     , "2020-05-02T23:59:59Z"     , "ts >= '2020-05-01 08:00:00' AND ts <= '2020-05-03 07:59:59'", "date >= '2020-05-02' AND date <= '2020-05-02'"},
+		{false, "2020-04-30T16:00:00Z"     , "2020-05-01T15:59:59Z"     , "ts >= '2020-05-01 00:00:00' AND ts <= '2020-05-01 23:59:59'", "date >= '2020-05-01' AND date <= '2020-05-01'"},
+		{true , "2020-05-01T00:00:01Z"     , "2020-05-01T23:59:59Z"     , "ts >= '2020-05-01 00:00:01' AND ts <= '2020-05-01 23:59:59'", ""},
+	}
+
+	for _, c := range cases {
+		d := &seriesDeleter{utc: c.utc}
+
+		cmds, fullDays, heads := d.deleteCommands("prometheus", "metrics", []uint64{1, 2}, mustParse(c.start), mustParse(c.end))
+
+		want := []string{"ALTER TABLE `prometheus`.`metrics_samples` DELETE WHERE " + c.samples + " AND fingerprint IN (1, 2)"}
+		if c.days != "" {
+			want = append(want, "ALTER TABLE `prometheus`.`metrics_metrics` DELETE WHERE " + c.days + " AND fingerprint IN (1, 2)")
+		}
+		if strings.Join(cmds, "\n") != strings.Join(want, "\n") {
+			t.Errorf("deleteCommands(utc: %v, %s, %s) =\n%s\nwant\n%s", c.utc, c.start, c.end, strings.Join(cmds, "\n"), strings.Join(want, "\n"))
+		}
+		if fullDays != (c.days != "") {
+			t.Errorf("deleteCommands(utc: %v, %s, %s) fullDays = %v", c.utc, c.start, c.end, fullDays)
+		}
+		if len(heads) != 1 || heads[0] != 1 {
+			t.Errorf("deleteCommands(utc: %v, %s, %s) heads = %v, want [1]", c.utc, c.start, c.end, heads)
+		}
+	}
+}
+
+func TestDeleteCommandsChunks(t *testing.T) {
+
+	labelIndex := Cfg.Writer.LabelIndex
+	defer func() { Cfg.Writer.LabelIndex = labelIndex }()
+	Cfg.Writer.LabelIndex = true
+
+	var fingerprints []uint64
+	for i := 0; i < deleteFingerprintsPerMutation * 2 + 1; i++ {
+		fingerprints = append(fingerprints, uint64(i + 100))
+	}
+
+	d := &seriesDeleter{utc: true}
+	cmds, fullDays, heads := d.deleteCommands("prometheus", "metrics", fingerprints, time.Unix(0, 0), time.Unix(86400 * 3 - 1, 0))
+
+	if !fullDays {
+		t.Fatalf("fullDays = false, want true")
+	}
+	if len(cmds) != 9 {
+		t.Fatalf("got %d commands, want 9 (3 lists for samples, metrics and labels)", len(cmds))
+	}
+	wantHeads := []uint64{100, 100 + deleteFingerprintsPerMutation, 100 + deleteFingerprintsPerMutation * 2}
+	if len(heads) != 3 || heads[0] != wantHeads[0] || heads[1] != wantHeads[1] || heads[2] != wantHeads[2] {
+		t.Errorf("heads = %v, want %v", heads, wantHeads)
+	}
+
+	for i, table := range []string{"samples", "metrics", "labels", "samples", "metrics", "labels", "samples", "metrics", "labels"} {
+		if !strings.HasPrefix(cmds[i], "ALTER TABLE `prometheus`.`metrics_" + table + "` DELETE WHERE ") {
+			t.Errorf("command %d is not on %s: %.80s", i, table, cmds[i])
+		}
+		if n := strings.Count(cmds[i], ","); i < 6 && n != deleteFingerprintsPerMutation - 1 || i >= 6 && n != 0 {
+			t.Errorf("command %d has %d fingerprints", i, n + 1)
+		}
+	}
+	if !strings.HasSuffix(cmds[8], fmt.Sprintf("fingerprint IN (%d)", 100 + deleteFingerprintsPerMutation * 2)) {
+		t.Errorf("the last command is %s", cmds[8])
+	}
+}
+
+func TestMutationsSql(t *testing.T) {
+
+	all := mutationsSql("prometheus", []string{"metrics_samples", "metrics_metrics"}, time.Time{}, nil)
+	for _, want := range []string{
+		"database = 'prometheus'",
+		"table IN ('metrics_samples', 'metrics_metrics')",
+		"startsWith(command, 'DELETE WHERE')",
+		"LIMIT 100",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("mutationsSql() = %s, want it contains %s", all, want)
+		}
+	}
+	if strings.Contains(all, "create_time >=") || strings.Contains(all, "match(") {
+		t.Errorf("mutationsSql() without fingerprints = %s, want no filter of them", all)
+	}
+
+	created := mutationsSql("prometheus", []string{"metrics_samples"}, time.Unix(1588291200, 0), []uint64{12, 4012})
+	for _, want := range []string{
+		"create_time >= toDateTime(1588291200)",
+		"(match(command, '[^0-9]12[^0-9]') OR match(command, '[^0-9]4012[^0-9]'))",
+	} {
+		if !strings.Contains(created, want) {
+			t.Errorf("mutationsSql() = %s, want it contains %s", created, want)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cardinalityStat is one row of a top-n list, the same shape as the tsdb status api of prometheus
+type cardinalityStat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+type cardinalityStatus struct {
+	Db                         string            `json:"db"`
+	Table                      string            `json:"table"`
+	Start                      string            `json:"start"`
+	End                        string            `json:"end"`
+	Label                      string            `json:"label,omitempty"`
+	SeriesCount                uint64            `json:"seriesCount"`
+	SeriesCountByMetricName    []cardinalityStat `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName []cardinalityStat `json:"labelValueCountByLabelName"`
+	SeriesCountByLabelPair     []cardinalityStat `json:"seriesCountByLabelValuePair"`
+	SeriesCountByLabelValue    []cardinalityStat `json:"seriesCountByLabelValue,omitempty"`
+	NewSeriesByDate            []cardinalityStat `json:"newSeriesByDate"`
+	Cost                       string            `json:"cost"`
+}
+
+// cardinalityExplorer answers cardinality questions from the <table>_metrics table of mode 3,
+// every fingerprint is stored at least once a day in it, so all the stats are limited by date
+type cardinalityExplorer struct {
+	tag    string
+	click  *click
+	cfg    *ReaderCfg
+	limits *queryLimits			// the limits of reader, the settings are sent with every sql
+	page   *template.Template
+}
+
+func (ce *cardinalityExplorer) init() {
+	ce.tag   = "cardinality"
+	ce.cfg   = &Cfg.Reader
+	ce.click = Engine.clicks.GetServer(ce.cfg.Clickhouse)
+
+	if ce.cfg.CardinalityLookback <= 0 {
+		ce.cfg.CardinalityLookback = 30
+	}
+	ce.limits = newQueryLimits(ce.cfg)
+
+	if ce.click == nil {
+		slog.Fatalf("%s: the clickhouse '%s' set in reader can not be found", ce.tag, ce.cfg.Clickhouse)
+	}
+
+	ce.page = template.Must(template.New("cardinality").Parse(cardinalityPage))
+}
+
+// parse the args of request, all of them are optional:
+//   db, table : default from the clickhouse server set in reader
+//   start, end: date in format 2006-01-02, default today
+//   limit     : n items to list for each top-n stats, default 10
+//   label     : a label name, if set, list the top values of this label too
+func (ce *cardinalityExplorer) parseArgs(r *http.Request) (*cardinalityStatus, int, error) {
+
+	err := r.ParseForm()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	out   := new(cardinalityStatus)
+	limit := 10
+
+	out.Db    = ce.click.cfg.Database
+	out.Table = ce.click.cfg.Table
+	out.Start = r.Form.Get("start")
+	out.End   = r.Form.Get("end")
+	out.Label = r.Form.Get("label")
+
+	if db := r.Form.Get("db"); db != "" {
+		out.Db = db
+	}
+	if table := r.Form.Get("table"); table != "" {
+		out.Table = table
+	}
+	if err = checkDbTable(out.Db, out.Table + "_metrics"); err != nil {
+		return nil, 0, err
+	}
+
+	today := time.Now()
+	if ce.cfg.Utc {
+		today = today.UTC()
+	}
+	if out.Start == "" {
+		out.Start = today.Format("2006-01-02")
+	}
+	if out.End == "" {
+		out.End = today.Format("2006-01-02")
+	}
+
+	start, err := time.Parse("2006-01-02", out.Start)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid start '%s': %s", out.Start, err)
+	}
+	end, err := time.Parse("2006-01-02", out.End)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid end '%s': %s", out.End, err)
+	}
+	if end.Before(start) {
+		return nil, 0, fmt.Errorf("end '%s' is before start '%s'", out.End, out.Start)
+	}
+
+	if arg := r.Form.Get("limit"); arg != "" {
+		limit, err = strconv.Atoi(arg)
+		if err != nil || limit < 1 {
+			return nil, 0, fmt.Errorf("invalid limit '%s'", arg)
+		}
+	}
+
+	return out, limit, nil
+}
+
+// cardinalitySqls are the sqls of the stats of a status
+type cardinalitySqls struct {
+	seriesCount  string
+	byMetricName string
+	labelValues  string
+	byLabelPair  string
+	byLabelValue string		// empty if no label set
+	newSeries    string
+}
+
+// buildSqls builds the sqls of the stats, with the settings of reader limits, the scans of a wide date range
+// can be as heavy as the wild queries
+func (ce *cardinalityExplorer) buildSqls(status *cardinalityStatus, limit int) *cardinalitySqls {
+
+	from  := sqlTable(status.Db, status.Table + "_metrics")
+	where := fmt.Sprintf("date >= '%s' AND date <= '%s'", status.Start, status.End)
+
+	// the tags are stored in <key>=<value> format, the key is the part before the first '='
+	pairs := fmt.Sprintf("SELECT DISTINCT fingerprint, arrayJoin(tags) AS tag FROM %s WHERE %s", from, where)
+
+	out := new(cardinalitySqls)
+
+	out.seriesCount  = fmt.Sprintf("SELECT uniqExact(fingerprint) FROM %s WHERE %s", from, where)
+	out.byMetricName = fmt.Sprintf("SELECT name, uniqExact(fingerprint) AS cnt FROM %s WHERE %s GROUP BY name ORDER BY cnt DESC LIMIT %d",
+		from, where, limit)
+	out.labelValues  = fmt.Sprintf("SELECT substring(tag, 1, position(tag, '=') - 1) AS label, uniqExact(tag) AS cnt FROM (%s) GROUP BY label ORDER BY cnt DESC LIMIT %d",
+		pairs, limit)
+	out.byLabelPair  = fmt.Sprintf("SELECT tag, count() AS cnt FROM (%s) GROUP BY tag ORDER BY cnt DESC LIMIT %d",
+		pairs, limit)
+	if status.Label != "" {
+		out.byLabelValue = fmt.Sprintf("SELECT substring(tag, %d) AS value, count() AS cnt FROM (%s) WHERE startsWith(tag, %s) GROUP BY value ORDER BY cnt DESC LIMIT %d",
+			len(status.Label) + 2, pairs, sqlString(status.Label + "="), limit)
+	}
+
+	// a series is new on the first date it can be found, the dates before start are checked back to
+	// reader.cardinality_lookback days, so the series not seen in them are new too
+	out.newSeries = fmt.Sprintf("SELECT toString(first) AS d, count() AS cnt FROM (SELECT fingerprint, min(date) AS first FROM %s WHERE date >= toDate('%s') - %d AND date <= '%s' GROUP BY fingerprint) WHERE first >= '%s' GROUP BY d ORDER BY d",
+		from, status.Start, ce.cfg.CardinalityLookback, status.End, status.Start)
+
+	if len(ce.limits.settings) > 0 {
+		settings := " SETTINGS " + strings.Join(ce.limits.settings, ", ")
+		for _, q := range []*string{&out.seriesCount, &out.byMetricName, &out.labelValues, &out.byLabelPair, &out.byLabelValue, &out.newSeries} {
+			if *q != "" {
+				*q += settings
+			}
+		}
+	}
+
+	return out
+}
+
+func (ce *cardinalityExplorer) query(ctx context.Context, q string) (*sql.Rows, error) {
+
+	slog.Debugf("%s: running sql: %s", ce.tag, q)
+
+	rows, err := ce.click.Query(ctx, q)
+
+	return rows, limitErrorOf(err)
+}
+
+func (ce *cardinalityExplorer) queryStats(ctx context.Context, sql string) ([]cardinalityStat, error) {
+
+	rows, err := ce.query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []cardinalityStat{}
+	for rows.Next() {
+		var stat cardinalityStat
+		if err = rows.Scan(&stat.Name, &stat.Value); err != nil {
+			return nil, err
+		}
+		out = append(out, stat)
+	}
+
+	return out, limitErrorOf(rows.Err())
+}
+
+func (ce *cardinalityExplorer) Explore(ctx context.Context, status *cardinalityStatus, limit int) error {
+
+	tStart := time.Now()
+	sqls   := ce.buildSqls(status, limit)
+
+	{
+		rows, err := ce.query(ctx, sqls.seriesCount)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			if err = rows.Scan(&status.SeriesCount); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		err = limitErrorOf(rows.Err())
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+
+	if status.SeriesCountByMetricName, err = ce.queryStats(ctx, sqls.byMetricName); err != nil {
+		return err
+	}
+	if status.LabelValueCountByLabelName, err = ce.queryStats(ctx, sqls.labelValues); err != nil {
+		return err
+	}
+	if status.SeriesCountByLabelPair, err = ce.queryStats(ctx, sqls.byLabelPair); err != nil {
+		return err
+	}
+	if sqls.byLabelValue != "" {
+		if status.SeriesCountByLabelValue, err = ce.queryStats(ctx, sqls.byLabelValue); err != nil {
+			return err
+		}
+	}
+	if status.NewSeriesByDate, err = ce.queryStats(ctx, sqls.newSeries); err != nil {
+		return err
+	}
+
+	status.Cost = time.Now().Sub(tStart).String()
+
+	slog.Infof("%s: explored %s.%s_metrics from %s to %s, %d series, cost: %s", ce.tag, status.Db, status.Table, status.Start, status.End, status.SeriesCount, status.Cost)
+
+	return nil
+}
+
+func (ce *cardinalityExplorer) handlerForApi(w http.ResponseWriter, r *http.Request) {
+
+	slog.Debugf("%s: %s from %s @ %s", ce.tag, r.RequestURI, r.Header.Get("User-Agent"), r.RemoteAddr)
+
+	status, limit, err := ce.parseArgs(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err = ce.Explore(r.Context(), status, limit); err != nil {
+		slog.Errorf("%s: explore failed: %s", ce.tag, err)
+		if _, ok := err.(*queryLimitError); ok {
+			respondError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, status)
+}
+
+func (ce *cardinalityExplorer) handlerForPage(w http.ResponseWriter, r *http.Request) {
+
+	slog.Debugf("%s: %s from %s @ %s", ce.tag, r.RequestURI, r.Header.Get("User-Agent"), r.RemoteAddr)
+
+	data := struct {
+		Status *cardinalityStatus
+		Limit  int
+		Error  string
+	}{}
+
+	status, limit, err := ce.parseArgs(r)
+	if err == nil {
+		err = ce.Explore(r.Context(), status, limit)
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	data.Status = status
+	data.Limit  = limit
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = ce.page.Execute(w, data); err != nil {
+		slog.Errorf("%s: render page failed: %s", ce.tag, err)
+	}
+}
+
+const cardinalityPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>prom_to_click - cardinality</title>
+<style>
+	body  { font-family: sans-serif; margin: 20px; }
+	table { border-collapse: collapse; margin-bottom: 20px; }
+	th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+	td.num { text-align: right; }
+	.error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Cardinality</h1>
+<form method="get">
+	db <input name="db" value="{{with .Status}}{{.Db}}{{end}}">
+	table <input name="table" value="{{with .Status}}{{.Table}}{{end}}">
+	start <input name="start" value="{{with .Status}}{{.Start}}{{end}}" placeholder="2006-01-02">
+	end <input name="end" value="{{with .Status}}{{.End}}{{end}}" placeholder="2006-01-02">
+	limit <input name="limit" value="{{if .Limit}}{{.Limit}}{{else}}10{{end}}" size="4">
+	label <input name="label" value="{{with .Status}}{{.Label}}{{end}}">
+	<input type="submit" value="explore">
+</form>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{with .Status}}{{if not $.Error}}
+<p>{{.SeriesCount}} series in {{.Db}}.{{.Table}}_metrics from {{.Start}} to {{.End}}, cost: {{.Cost}}</p>
+<h2>Top metric names by series count</h2>
+<table><tr><th>name</th><th>series</th></tr>
+{{range .SeriesCountByMetricName}}<tr><td>{{.Name}}</td><td class="num">{{.Value}}</td></tr>{{end}}
+</table>
+<h2>Top label names by value count</h2>
+<table><tr><th>label</th><th>values</th></tr>
+{{range .LabelValueCountByLabelName}}<tr><td>{{.Name}}</td><td class="num">{{.Value}}</td></tr>{{end}}
+</table>
+<h2>Top label pairs by series count</h2>
+<table><tr><th>pair</th><th>series</th></tr>
+{{range .SeriesCountByLabelPair}}<tr><td>{{.Name}}</td><td class="num">{{.Value}}</td></tr>{{end}}
+</table>
+{{if .Label}}
+<h2>Top values of label '{{.Label}}' by series count</h2>
+<table><tr><th>value</th><th>series</th></tr>
+{{range .SeriesCountByLabelValue}}<tr><td>{{.Name}}</td><td class="num">{{.Value}}</td></tr>{{end}}
+</table>
+{{end}}
+<h2>New series by date</h2>
+<table><tr><th>date</th><th>series</th></tr>
+{{range .NewSeriesByDate}}<tr><td>{{.Name}}</td><td class="num">{{.Value}}</td></tr>{{end}}
+</table>
+{{end}}{{end}}
+</body>
+</html>
+`
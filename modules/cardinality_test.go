@@ -0,0 +1,113 @@
+package modules
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestExplorer() *cardinalityExplorer {
+
+	cfg := &ReaderCfg{MaxExecutionTime: 30, MaxRowsToRead: 1000000, CardinalityLookback: 7}
+
+	return &cardinalityExplorer{
+		tag   : "cardinality",
+		click : &click{tag: "test", cfg: &ClickCfg{Database: "prometheus", Table: "samples"}},
+		cfg   : cfg,
+		limits: newQueryLimits(cfg),
+	}
+}
+
+func TestCardinalityParseArgs(t *testing.T) {
+
+	today := time.Now().Format("2006-01-02")
+
+	cases := []struct {
+		query string
+		ok    bool
+		db    string
+		table string
+		start string
+		end   string
+		limit int
+	}{
+		{""                                              , true , "prometheus", "samples", today       , today       , 10},
+		{"db=metrics&table=prom_qos"                     , true , "metrics"   , "prom_qos", today      , today       , 10},
+		{"start=2020-05-01&end=2020-05-07&limit=20"      , true , "prometheus", "samples", "2020-05-01", "2020-05-07", 20},
+		{"db=prometheus%60%3B+DROP+TABLE+x"              , false, "", "", "", "", 0},
+		{"table=samples_metrics+WHERE+1"                 , false, "", "", "", "", 0},
+		{"table=1samples"                                , false, "", "", "", "", 0},
+		{"start=2020-05-01'"                             , false, "", "", "", "", 0},
+		{"end=20200507"                                  , false, "", "", "", "", 0},
+		{"start=2020-05-07&end=2020-05-01"               , false, "", "", "", "", 0},
+		{"limit=0"                                       , false, "", "", "", "", 0},
+		{"limit=x"                                       , false, "", "", "", "", 0},
+	}
+
+	ce := newTestExplorer()
+	for _, c := range cases {
+		status, limit, err := ce.parseArgs(httptest.NewRequest("GET", "/api/v1/cardinality?" + c.query, nil))
+		if (err == nil) != c.ok {
+			t.Errorf("parseArgs(%s) returns %v, want ok: %v", c.query, err, c.ok)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		if status.Db != c.db || status.Table != c.table || status.Start != c.start || status.End != c.end || limit != c.limit {
+			t.Errorf("parseArgs(%s) = %s.%s [%s, %s] limit %d, want %s.%s [%s, %s] limit %d", c.query,
+				status.Db, status.Table, status.Start, status.End, limit, c.db, c.table, c.start, c.end, c.limit)
+		}
+	}
+}
+
+func TestCardinalitySqls(t *testing.T) {
+
+	ce := newTestExplorer()
+
+	status := &cardinalityStatus{Db: "prometheus", Table: "samples", Start: "2020-05-01", End: "2020-05-07", Label: "jo'b"}
+	sqls   := ce.buildSqls(status, 20)
+
+	const settings = " SETTINGS max_execution_time = 30, max_rows_to_read = 1000000"
+
+	all := map[string]string{
+		"seriesCount" : sqls.seriesCount,
+		"byMetricName": sqls.byMetricName,
+		"labelValues" : sqls.labelValues,
+		"byLabelPair" : sqls.byLabelPair,
+		"byLabelValue": sqls.byLabelValue,
+		"newSeries"   : sqls.newSeries,
+	}
+	for name, q := range all {
+		if !strings.Contains(q, "FROM `prometheus`.`samples_metrics` WHERE ") {
+			t.Errorf("%s does not read the quoted table: %s", name, q)
+		}
+		if !strings.HasSuffix(q, settings) {
+			t.Errorf("%s does not end with the settings of limits: %s", name, q)
+		}
+		if name != "seriesCount" && name != "newSeries" && !strings.HasSuffix(q, "LIMIT 20" + settings) {
+			t.Errorf("%s is not limited by 20: %s", name, q)
+		}
+	}
+
+	if want := "SELECT uniqExact(fingerprint) FROM `prometheus`.`samples_metrics` WHERE date >= '2020-05-01' AND date <= '2020-05-07'" + settings; sqls.seriesCount != want {
+		t.Errorf("seriesCount:\n got: %s\nwant: %s", sqls.seriesCount, want)
+	}
+
+	// the label is escaped, and the value starts after "jo'b="
+	if !strings.Contains(sqls.byLabelValue, `substring(tag, 6)`) || !strings.Contains(sqls.byLabelValue, `startsWith(tag, 'jo\'b=')`) {
+		t.Errorf("byLabelValue does not match the escaped label: %s", sqls.byLabelValue)
+	}
+
+	// the dates before start are checked back to the lookback days only
+	if want := "SELECT toString(first) AS d, count() AS cnt FROM (SELECT fingerprint, min(date) AS first FROM `prometheus`.`samples_metrics` WHERE date >= toDate('2020-05-01') - 7 AND date <= '2020-05-07' GROUP BY fingerprint) WHERE first >= '2020-05-01' GROUP BY d ORDER BY d" + settings; sqls.newSeries != want {
+		t.Errorf("newSeries:\n got: %s\nwant: %s", sqls.newSeries, want)
+	}
+
+	// no label, no sql of its values
+	status.Label = ""
+	if sqls = ce.buildSqls(status, 20); sqls.byLabelValue != "" {
+		t.Errorf("byLabelValue is built without label: %s", sqls.byLabelValue)
+	}
+}
@@ -1,9 +1,12 @@
 package modules
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,11 +15,12 @@ type click struct {
 	db      *sql.DB
 	dsn     string
 	name    string
-	health  bool
+	health  int32		// atomic, 1 for healthy
 	connerr error
+	mu      sync.Mutex	// guards db opening and connerr
 	tag     string
 	sigs    chan int8
-	used    bool
+	used    int32		// atomic, 1 for used by reader or writer
 }
 
 func NewClick(name string, cfg *ClickCfg) (*click, error) {
@@ -105,14 +109,14 @@ func (c *click)ConnectingRoutine(){
 				time.Sleep(time.Second)
 		}
 
-		if ! c.used{
+		if atomic.LoadInt32(&c.used) == 0 {
 			continue
 		}
 
 		curCheck := time.Now()
 
 		if curCheck.Sub(lastCheck) > time.Second {
-			if c.health == false || newSig {
+			if !c.IsHealthy() || newSig {
 
 				lastCheck = curCheck
 
@@ -140,45 +144,78 @@ func (c *click)TryConnect() error {
 
 	var err error
 
+	c.mu.Lock()
 	if c.db == nil{
 		c.db, err = sql.Open("clickhouse", c.dsn)
 		if err != nil{
+			c.mu.Unlock()
 			return err
 		}
 	}
+	db := c.db
+	c.mu.Unlock()
 
-	err = c.db.Ping()
+	err = db.Ping()
+
+	c.mu.Lock()
+	c.connerr = err
+	c.mu.Unlock()
+
+	// the db is set before health, so it can be used without lock when healthy
 	if err != nil{
-		c.connerr = err
-		c.health  = false
+		atomic.StoreInt32(&c.health, 0)
 	} else {
-		c.connerr = nil
-		c.health  = true
+		atomic.StoreInt32(&c.health, 1)
 	}
 
 	return err
 }
 
+func (c *click)IsUsed() bool {
+	return atomic.LoadInt32(&c.used) == 1
+}
+
 func (c *click)IsHealthy() bool {
-	return c.health
+	return atomic.LoadInt32(&c.health) == 1
+}
+
+// ConnErr returns the error of last connecting, nil if connected ok
+func (c *click)ConnErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connerr
+}
+
+// Exec executes query in ctx, the query is cancelled in clickhouse when ctx is done
+func (c *click)Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if !c.IsHealthy() {
+		c.sigConnect()
+		return nil, fmt.Errorf("status, unheathy: %s", c.ConnErr())
+	}
+
+	return c.db.ExecContext(ctx, query, args...)
 }
 
-func (c *click)Exec(query string, args ...interface{}) (sql.Result, error) {
-	if c.health == false{
-		return nil, fmt.Errorf("status, unheathy: %s", c.connerr)
+// Query queries in ctx, the query is cancelled in clickhouse when ctx is done, and the query_id set by
+// clickhouse.WithQueryID in ctx is sent to clickhouse, close the rows as soon as they are read
+func (c *click)Query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if !c.IsHealthy() {
 		c.sigConnect()
+		return nil, fmt.Errorf("status, unheathy: %s", c.ConnErr())
 	}
 
-	return c.db.Exec(query, args...)
+	return c.db.QueryContext(ctx, query, args...)
 }
 
-func (c *click)Query(query string, args ...interface{}) (*sql.Rows, error) {
-	if c.health == false{
-		return nil, fmt.Errorf("status, unheathy: %s", c.connerr)
+// Begin starts a transaction in ctx, it will be rolled back if ctx is done before committed
+func (c *click)Begin(ctx context.Context) (*sql.Tx, error) {
+	if !c.IsHealthy() {
 		c.sigConnect()
+		return nil, fmt.Errorf("status, unheathy: %s", c.ConnErr())
 	}
 
-	return c.db.Query(query, args...)
+	return c.db.BeginTx(ctx, nil)
 }
 
 type clicksMan struct {
@@ -204,20 +241,20 @@ func (cs *clicksMan) GetServer(name string) *click {
 	click, exist := cs.clicks[name]
 
 	if exist{
-		click.used = true
+		atomic.StoreInt32(&click.used, 1)
 		return click
 	} else {
 		return nil
 	}
 }
 
-func (cs *clicksMan) Query(name string, query string) (*sql.Rows, error) {
+func (cs *clicksMan) Query(ctx context.Context, name string, query string) (*sql.Rows, error) {
 
 	click := cs.GetServer(name)
 
 	if click != nil{
-		return click.Query(query)
+		return click.Query(ctx, query)
 	} else {
-		return nil, fmt.Errorf("server named '%s' can not be found")
+		return nil, fmt.Errorf("server named '%s' can not be found", name)
 	}
 }
@@ -0,0 +1,154 @@
+package modules
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeClick is a database/sql driver like clickhouse-go, the rows executed are committed with the transaction,
+// the rows of badFingerprint fail to exec, and the commits of the queries containing failCommit fail,
+// the rows of the queries are returned by rows, and the queries run are kept in order
+type fakeClick struct {
+	mu             sync.Mutex
+	committed      map[string][][]driver.Value		// by the table inserted
+	badFingerprint uint64
+	failCommit     string
+	rows           func(query string) ([]string, [][]driver.Value)
+	queries        []string
+}
+
+type fakeClickConn struct {
+	db      *fakeClick
+	query   string
+	pending [][]driver.Value
+}
+
+type fakeClickStmt struct {
+	conn  *fakeClickConn
+	query string
+}
+
+type fakeClickRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+var fakeClicks = struct {
+	sync.Mutex
+	dbs map[string]*fakeClick
+}{dbs: map[string]*fakeClick{}}
+
+func init() {
+	sql.Register("fakeclick", fakeClickDriver{})
+}
+
+type fakeClickDriver struct{}
+
+func (fakeClickDriver) Open(name string) (driver.Conn, error) {
+	fakeClicks.Lock()
+	defer fakeClicks.Unlock()
+
+	return &fakeClickConn{db: fakeClicks.dbs[name]}, nil
+}
+
+func (c *fakeClickConn) Prepare(query string) (driver.Stmt, error) {
+	c.query = query
+	return &fakeClickStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeClickConn) Close() error              { return nil }
+func (c *fakeClickConn) Begin() (driver.Tx, error) { c.pending = nil; return c, nil }
+
+func (c *fakeClickConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if c.db.failCommit != "" && strings.Contains(c.query, c.db.failCommit) {
+		return fmt.Errorf("commit of %s failed", c.db.failCommit)
+	}
+	table := strings.Replace(strings.Fields(c.query)[2], "`", "", -1)
+	c.db.committed[table] = append(c.db.committed[table], c.pending...)
+	c.pending = nil
+
+	return nil
+}
+
+func (c *fakeClickConn) Rollback() error { c.pending = nil; return nil }
+
+func (s *fakeClickStmt) Close() error                               { return nil }
+func (s *fakeClickStmt) NumInput() int                              { return -1 }
+func (s *fakeClickStmt) CheckNamedValue(nv *driver.NamedValue) error { return nil }
+
+func (s *fakeClickStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+
+	db.mu.Lock()
+	db.queries = append(db.queries, s.query)
+	rows := db.rows
+	db.mu.Unlock()
+
+	if rows == nil {
+		return nil, fmt.Errorf("not supported")
+	}
+	columns, values := rows(s.query)
+
+	return &fakeClickRows{columns: columns, values: values}, nil
+}
+
+func (s *fakeClickStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if fp, ok := args[len(args) - 1].(uint64); ok && fp == s.conn.db.badFingerprint || args[0] == s.conn.db.badFingerprint {
+		return nil, fmt.Errorf("unsupported value")
+	}
+	s.conn.pending = append(s.conn.pending, args)
+
+	return driver.RowsAffected(1), nil
+}
+
+func (r *fakeClickRows) Columns() []string { return r.columns }
+func (r *fakeClickRows) Close() error      { return nil }
+
+// Next returns the values as is, like the arrays and uint8 returned by clickhouse-go
+func (r *fakeClickRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+
+	return nil
+}
+
+// takeQueries returns the queries run till now and forgets them
+func (fc *fakeClick) takeQueries() []string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	out := fc.queries
+	fc.queries = nil
+
+	return out
+}
+
+// newFakeClick returns a healthy click connected to a fakeClick of the test
+func newFakeClick(t *testing.T) (*click, *fakeClick) {
+
+	fc := &fakeClick{committed: map[string][][]driver.Value{}}
+
+	fakeClicks.Lock()
+	fakeClicks.dbs[t.Name()] = fc
+	fakeClicks.Unlock()
+
+	db, err := sql.Open("fakeclick", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	return &click{tag: "test", name: "test", db: db, health: 1}, fc
+}
@@ -9,11 +9,37 @@ import (
 
 var (
 	configFile = kingpin.Flag("config.file", "the config path").Default("./prom_to_click.yml").String()
+
+	serveCmd     = kingpin.Command("serve", "run as a remote storage of prometheus").Default()
+
+	importCmd    = kingpin.Command("import", "import historical data to clickhouse through the writer (mode 3 only)")
+	importFormat = importCmd.Flag("format", "the format of input, openmetrics: a text file with timestamps, tsdb: a prometheus tsdb block dir").Default("openmetrics").Enum("openmetrics", "tsdb")
+	importDb     = importCmd.Flag("db", "the database to write, default from the clickhouse server set in writer").String()
+	importTable  = importCmd.Flag("table", "the table to write, default from the clickhouse server set in writer").String()
+	importPath   = importCmd.Arg("path", "the openmetrics file or tsdb block dir to import").Required().String()
+
+	exportCmd    = kingpin.Command("export", "export series from clickhouse through the reader (mode 3 only)")
+	exportFormat = exportCmd.Flag("format", "the format of output, openmetrics: a text file, jsonl: one json object per series, tsdb: a prometheus tsdb block").Default("openmetrics").Enum("openmetrics", "jsonl", "tsdb")
+	exportMatch  = exportCmd.Flag("match", "the series selector, can be set multiple times").Required().Strings()
+	exportStart  = exportCmd.Flag("start", "the start time, unix seconds or rfc3339").Required().String()
+	exportEnd    = exportCmd.Flag("end", "the end time, unix seconds or rfc3339, default now").String()
+	exportStep   = exportCmd.Flag("step", "the step in seconds to downsample samples like the reader, default 0 to export raw samples").Default("0").Int64()
+	exportDb     = exportCmd.Flag("db", "the database to read, default from the clickhouse server set in reader").String()
+	exportTable  = exportCmd.Flag("table", "the table to read, default from the clickhouse server set in reader").String()
+	exportOutput = exportCmd.Flag("output", "the file to write, or the dir to create block in for tsdb").Short('o').Required().String()
 )
 
+var command string
+
+// Command returns the subcommand selected in cmdline
+func Command() string {
+	return command
+}
+
 type ServerCfg struct {
 	Addr  	       string   `yaml:"addr"`
 	Timeout        int      `yaml:"timeout"`
+	EnableAdminApi bool     `yaml:"enable_admin_api"`
 }
 
 type ClickCfg struct {
@@ -35,6 +61,39 @@ type ReaderCfg struct {
 	Clickhouse   string   `yaml:"clickhouse"`
 	Mode         int      `yaml:"mode"`
 	Utc          bool     `yaml:"utc"`
+	SlowQuery    float64  `yaml:"slow_query"`
+	LogComment   bool     `yaml:"log_comment"`
+	MaxExecutionTime int   `yaml:"max_execution_time"`
+	MaxMemoryUsage   int64 `yaml:"max_memory_usage"`
+	MaxRowsToRead    int64 `yaml:"max_rows_to_read"`	// limits the rows read by clickhouse, and the rows returned per sql
+	MaxSeries        int   `yaml:"max_series"`
+	MaxConcurrency   int   `yaml:"max_concurrency"`	// default 4, the queries of a /read request run at the same time
+	LabelIndex       bool  `yaml:"label_index"`		// mode 3 only, resolve the fingerprints of equality matchers from <table>_labels first
+	Downsample       string `yaml:"downsample"`		// default quantile in mode 1, first in mode 2 (the only one supported) and last in mode 3, the function to downsample the samples in a step
+	DownsampleRules  []DownsampleRule `yaml:"downsample_rules"`	// the downsample of metrics by name, the first matched is used
+	FingerprintCache ResolveCacheCfg `yaml:"fingerprint_cache"`
+	ResultsCache     ResultsCacheCfg `yaml:"results_cache"`
+	CardinalityLookback int          `yaml:"cardinality_lookback"`	// default 30, unit day, the series not found in these days before start are new in the cardinality explorer
+}
+
+// DownsampleRule sets the downsample of the metrics whose name matches
+type DownsampleRule struct {
+	Match        string   `yaml:"match"`			// the regexp of metric names, anchored like the matchers of prometheus
+	Downsample   string   `yaml:"downsample"`		// first, last, avg, min, max, sum, counter, quantile or quantile(0.9)
+}
+
+// ResolveCacheCfg configs the cache of fingerprints resolved from <table>_metrics by the matchers of queries in mode 3
+type ResolveCacheCfg struct {
+	MaxSize      int      `yaml:"max_size"`		// default 0 to disable, max matcher sets cached, the least recently used ones will be evicted
+	Ttl          int      `yaml:"ttl"`			// default 60, unit second, the series written by other processes may be missed in ttl
+	MaxSeries    int      `yaml:"max_series"`		// default 10000, the matcher sets matching more series are not cached
+}
+
+// ResultsCacheCfg configs the cache of the results of the past intervals (days) of queries
+type ResultsCacheCfg struct {
+	MaxSize      int64    `yaml:"max_size"`		// default 0 to disable, max samples cached, the least recently used intervals will be evicted
+	Ttl          int      `yaml:"ttl"`			// default 3600, unit second, the samples written by other processes into the past may be missed in ttl
+	MaxFreshness int      `yaml:"max_freshness"`	// default 600, unit second, the intervals ended in it are not cached, it should cover the delay of samples
 }
 
 type WriterCfg struct {
@@ -42,6 +101,27 @@ type WriterCfg struct {
 	Batch        int      `yaml:"batch"`
 	Buffer       int      `yaml:"buffer"`
 	Wait         int      `yaml:"wait"`
+	Shards       int      `yaml:"shards"`
+	IdleTimeout  int      `yaml:"idle_timeout"`
+	LabelIndex   bool     `yaml:"label_index"`		// mode 3 only, write the labels of new fingerprints to <table>_labels
+	FingerprintCache FingerprintCacheCfg `yaml:"fingerprint_cache"`
+}
+
+// FingerprintCacheCfg configs the cache of fingerprints written to <table>_metrics in mode 3
+type FingerprintCacheCfg struct {
+	MaxSize      int      `yaml:"max_size"`		// default 1000000, max entries of (fingerprint, date) per table, the least recently used ones will be evicted
+	HoldTime     int      `yaml:"hold_time"`		// default 86400, unit second, an entry not used in hold time will be removed
+	WarmUp       bool     `yaml:"warm_up"`		// load the fingerprints of recent dates from clickhouse when a table is first written
+	SnapshotDir  string   `yaml:"snapshot_dir"`	// save the cache to this dir when stop and load it when start, empty to disable
+}
+
+// TracingCfg configs the exporting of spans, the tracing is disabled if endpoint is empty
+type TracingCfg struct {
+	Endpoint     string   `yaml:"endpoint"`		// the otlp/http endpoint of collector, like localhost:4318
+	UrlPath      string   `yaml:"url_path"`		// default /v1/traces
+	Insecure     bool     `yaml:"insecure"`		// use http instead of https
+	SampleRatio  float64  `yaml:"sample_ratio"`	// default 1, the ratio of the traces started here to sample, the sampled flag of incoming traces is respected
+	ServiceName  string   `yaml:"service_name"`	// default prom_to_click
 }
 
 type LoggerCfg struct{
@@ -60,13 +140,14 @@ type ptcCfg struct{
 	Reader  ReaderCfg
 	Writer  WriterCfg
 	Logger  LoggerCfg
+	Tracing TracingCfg
 }
 
 var Cfg ptcCfg
 
 func initConfig()  {
 
-	kingpin.Parse()
+	command = kingpin.Parse()
 
 	buffer, err := ioutil.ReadFile(*configFile)
 	if err != nil {
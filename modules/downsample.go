@@ -0,0 +1,142 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// downsample is the function to downsample the real samples in a step, the staleness markers are handled the same
+// for all, see sqlLastStale
+type downsample struct {
+	fn       string			// first, last, avg, min, max, sum, quantile or counter
+	quantile float64
+}
+
+// parseDownsample parses the downsample like 'max', 'quantile(0.9)', or 'quantile' of the default quantile
+func parseDownsample(s string, quantile float64) (*downsample, error) {
+
+	s = strings.TrimSpace(s)
+
+	switch s {
+		case "first", "last", "avg", "min", "max", "sum", "counter":
+			return &downsample{fn: s}, nil
+		case "quantile":
+			return &downsample{fn: s, quantile: quantile}, nil
+	}
+
+	if strings.HasPrefix(s, "quantile(") && strings.HasSuffix(s, ")") {
+		q, err := strconv.ParseFloat(s[len("quantile(") : len(s) - 1], 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile in downsample '%s', it should be in [0, 1]", s)
+		}
+		return &downsample{fn: "quantile", quantile: q}, nil
+	}
+
+	return nil, fmt.Errorf("invalid downsample '%s', it should be one of first, last, avg, min, max, sum, counter, quantile or quantile(0.9)", s)
+}
+
+func (d *downsample) String() string {
+	if d.fn == "quantile" {
+		return fmt.Sprintf("quantile(%g)", d.quantile)
+	}
+
+	return d.fn
+}
+
+// isCounter returns whether the samples of a step are kept by counter, see counterRows
+func (d *downsample) isCounter() bool {
+	return d.fn == "counter"
+}
+
+// value returns the sql of the value of a step, it's empty for counter
+func (d *downsample) value() string {
+
+	notStale := "NOT (" + sqlIsStale + ")"
+
+	switch d.fn {
+		case "first"   : return fmt.Sprintf("argMinIf(val, ts, %s)", notStale)
+		case "last"    : return fmt.Sprintf("argMaxIf(val, ts, %s)", notStale)
+		case "avg"     : return fmt.Sprintf("avgIf(val, %s)", notStale)
+		case "min"     : return fmt.Sprintf("minIf(val, %s)", notStale)
+		case "max"     : return fmt.Sprintf("maxIf(val, %s)", notStale)
+		case "sum"     : return fmt.Sprintf("sumIf(val, %s)", notStale)
+		case "quantile": return fmt.Sprintf("quantileIf(%f)(val, %s)", d.quantile, notStale)
+	}
+
+	return ""
+}
+
+// counterRows returns the sqls of a step downsampled by counter, the first, the last and the ones around resets of the
+// real samples are kept with their own timestamps, so the increase across resets is kept and rate() works on them,
+// the columns are the timestamps (in ms) and the values of the samples kept, and the timestamp of the last sample
+func counterRows() []string {
+
+	// the real samples of the step sorted by time, with the values of the previous and next ones,
+	// +inf before the first and -inf after the last, so both of them are kept
+	samples := fmt.Sprintf("arraySort(groupArrayIf((toInt64(toUInt32(ts)) * 1000, val), NOT (%s)))", sqlIsStale)
+	values  := fmt.Sprintf("arrayMap(x -> x.2, %s)", samples)
+	prevs   := fmt.Sprintf("arrayPushFront(arrayPopBack(%s), inf)", values)
+	nexts   := fmt.Sprintf("arrayPushBack(arrayPopFront(%s), -inf)", values)
+	kept    := fmt.Sprintf("arrayFilter((x, p, n) -> p > x.2 OR n < x.2, %s, %s, %s)", samples, prevs, nexts)
+
+	return []string{
+		"arrayMap(x -> x.1, " + kept + ") as cts",
+		"arrayMap(x -> x.2, " + kept + ") as cvals",
+		"toInt64(toUInt32(max(ts))) * 1000 as tlast",
+	}
+}
+
+// counterSamples returns the samples of a step read by counterRows, a staleness marker is appended if the step is stale
+func counterSamples(cts []int64, cvals []float64, stale uint8, tlast int64) []*remote.Sample {
+
+	out := make([]*remote.Sample, 0, len(cts) + 1)
+	for i := range cts {
+		if i < len(cvals) {
+			out = append(out, &remote.Sample{Value: cvals[i], TimestampMs: cts[i]})
+		}
+	}
+	if stale != 0 {
+		out = append(out, &remote.Sample{Value: staleNaN, TimestampMs: tlast})
+	}
+
+	return out
+}
+
+type downsampleRule struct {
+	re *regexp.Regexp
+	ds *downsample
+}
+
+// newDownsampleRules parses the rules in config
+func newDownsampleRules(rules []DownsampleRule, quantile float64) ([]*downsampleRule, error) {
+
+	var out []*downsampleRule
+	for _, rule := range rules {
+		re, err := regexp.Compile(anchoredRegexp(rule.Match))
+		if err != nil {
+			return nil, fmt.Errorf("invalid match '%s' in downsample rules: %s", rule.Match, err)
+		}
+		ds, err := parseDownsample(rule.Downsample, quantile)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &downsampleRule{re: re, ds: ds})
+	}
+
+	return out, nil
+}
+
+// metricName returns the metric name selected by the equality matcher of __name__, empty if not found
+func metricName(matchers []*remote.LabelMatcher) string {
+	for _, m := range matchers {
+		if m.Name == "__name__" && m.Type == remote.MatchType_EQUAL {
+			return m.Value
+		}
+	}
+
+	return ""
+}
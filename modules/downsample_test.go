@@ -0,0 +1,171 @@
+package modules
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func TestParseDownsample(t *testing.T) {
+
+	cases := []struct {
+		s        string
+		fn       string
+		quantile float64
+		str      string
+		err      bool
+	}{
+		{"first"          , "first"   , 0   , "first"         , false},
+		{"last"           , "last"    , 0   , "last"          , false},
+		{" max "          , "max"     , 0   , "max"           , false},
+		{"counter"        , "counter" , 0   , "counter"       , false},
+		{"quantile"       , "quantile", 0.75, "quantile(0.75)", false},
+		{"quantile(0.9)"  , "quantile", 0.9 , "quantile(0.9)" , false},
+		{"quantile(0)"    , "quantile", 0   , "quantile(0)"   , false},
+		{"quantile(1)"    , "quantile", 1   , "quantile(1)"   , false},
+		{"quantile(1.5)"  , ""        , 0   , ""              , true},
+		{"quantile(-0.1)" , ""        , 0   , ""              , true},
+		{"quantile(x)"    , ""        , 0   , ""              , true},
+		{"quantile(0.9"   , ""        , 0   , ""              , true},
+		{"median"         , ""        , 0   , ""              , true},
+		{"MAX"            , ""        , 0   , ""              , true},
+		{""               , ""        , 0   , ""              , true},
+	}
+
+	for _, c := range cases {
+		ds, err := parseDownsample(c.s, 0.75)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseDownsample(%q) = %s, want an error", c.s, ds)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDownsample(%q) failed: %s", c.s, err)
+			continue
+		}
+		if ds.fn != c.fn || ds.quantile != c.quantile || ds.String() != c.str {
+			t.Errorf("parseDownsample(%q) = {%s, %g} %s, want {%s, %g} %s", c.s, ds.fn, ds.quantile, ds, c.fn, c.quantile, c.str)
+		}
+		if ds.isCounter() != (c.fn == "counter") || (ds.value() == "") != (c.fn == "counter") {
+			t.Errorf("parseDownsample(%q): isCounter %v, value %q", c.s, ds.isCounter(), ds.value())
+		}
+	}
+}
+
+func TestDownsampleValueSkipsStale(t *testing.T) {
+
+	for _, s := range []string{"first", "last", "avg", "min", "max", "sum", "quantile(0.5)"} {
+		ds, _ := parseDownsample(s, 0.75)
+		if !strings.Contains(ds.value(), "NOT (" + sqlIsStale + ")") {
+			t.Errorf("the value of %s does not skip the staleness markers: %s", s, ds.value())
+		}
+	}
+}
+
+func TestCounterRows(t *testing.T) {
+
+	rows := counterRows()
+	if len(rows) != 3 {
+		t.Fatalf("counterRows() returns %d columns, want 3", len(rows))
+	}
+
+	for i, alias := range []string{" as cts", " as cvals", " as tlast"} {
+		if !strings.HasSuffix(rows[i], alias) {
+			t.Errorf("column %d is %s, want it ends with%s", i, rows[i], alias)
+		}
+	}
+
+	// the markers are not kept, the first and last are kept by the infs around, and the samples are sorted by time
+	for _, want := range []string{
+		"groupArrayIf((toInt64(toUInt32(ts)) * 1000, val), NOT (" + sqlIsStale + "))",
+		"arraySort(",
+		"arrayPushFront(arrayPopBack(",
+		"), inf)",
+		"arrayPushBack(arrayPopFront(",
+		"), -inf)",
+		"p > x.2 OR n < x.2",
+	} {
+		for i := 0; i < 2; i++ {
+			if !strings.Contains(rows[i], want) {
+				t.Errorf("column %d does not contain %s: %s", i, want, rows[i])
+			}
+		}
+	}
+	if rows[2] != "toInt64(toUInt32(max(ts))) * 1000 as tlast" {
+		t.Errorf("the last column is %s", rows[2])
+	}
+}
+
+func TestCounterSamples(t *testing.T) {
+
+	cases := []struct {
+		cts   []int64
+		cvals []float64
+		stale uint8
+		tlast int64
+		want  []remote.Sample
+	}{
+		{[]int64{1000, 5000, 6000}, []float64{10, 30, 2}, 0, 6000, []remote.Sample{{Value: 10, TimestampMs: 1000}, {Value: 30, TimestampMs: 5000}, {Value: 2, TimestampMs: 6000}}},
+		{[]int64{1000, 5000}      , []float64{10, 30}   , 1, 9000, []remote.Sample{{Value: 10, TimestampMs: 1000}, {Value: 30, TimestampMs: 5000}, {Value: staleNaN, TimestampMs: 9000}}},
+		// only markers in the step
+		{nil                      , nil                 , 1, 9000, []remote.Sample{{Value: staleNaN, TimestampMs: 9000}}},
+		{nil                      , nil                 , 0, 0   , []remote.Sample{}},
+		// the values missed are skipped
+		{[]int64{1000, 5000}      , []float64{10}       , 0, 5000, []remote.Sample{{Value: 10, TimestampMs: 1000}}},
+	}
+
+	for i, c := range cases {
+		got := counterSamples(c.cts, c.cvals, c.stale, c.tlast)
+		if len(got) != len(c.want) {
+			t.Errorf("case %d: got %d samples, want %d", i, len(got), len(c.want))
+			continue
+		}
+		for j, s := range got {
+			w := c.want[j]
+			if s.TimestampMs != w.TimestampMs || math.Float64bits(s.Value) != math.Float64bits(w.Value) {
+				t.Errorf("case %d: sample %d is %v@%d, want %v@%d", i, j, s.Value, s.TimestampMs, w.Value, w.TimestampMs)
+			}
+		}
+	}
+}
+
+func TestDownsampleOfMode2(t *testing.T) {
+
+	cfg := newTestReaderCfg()
+	cfg.Mode = 2
+
+	for _, c := range []struct {
+		downsample string
+		rules      []DownsampleRule
+		ok         bool
+	}{
+		{"first", nil, true},
+		{"last" , nil, false},
+		{"first", []DownsampleRule{{Match: "up", Downsample: "first"}}, false},
+	} {
+		cfg.Downsample      = c.downsample
+		cfg.DownsampleRules = c.rules
+		if _, err := newQueryPlanner(cfg); (err == nil) != c.ok {
+			t.Errorf("newQueryPlanner(mode 2, %s, %d rules) returns %v", c.downsample, len(c.rules), err)
+		}
+	}
+
+	cfg.Downsample      = "first"
+	cfg.DownsampleRules = nil
+	p, _ := newQueryPlanner(cfg)
+
+	query := &remote.Query{StartTimestampMs: 0, EndTimestampMs: 3600 * 1000}
+	for _, s := range []string{"first", "max", "counter"} {
+		ds, _ := parseDownsample(s, 0.75)
+		_, err := p.plan(query, "prometheus", "samples", ds)
+		if s == "first" && err != nil {
+			t.Errorf("plan with downsample first failed in mode 2: %s", err)
+		}
+		if _, ok := err.(*queryError); s != "first" && !ok {
+			t.Errorf("plan with downsample %s returns %v in mode 2, want a queryError", s, err)
+		}
+	}
+}
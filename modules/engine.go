@@ -1,14 +1,16 @@
 package modules
 
 import (
+	"context"
 	"github.com/prometheus/prometheus/storage/remote"
 	"go.uber.org/zap"
 	"net/http"
+	"time"
 )
 
 type ptcReader interface {
 	init()
-	HandlePromReadReq(req *remote.ReadRequest, r *http.Request) (*remote.ReadResponse, error)
+	HandlePromReadReq(ctx context.Context, req *remote.ReadRequest, r *http.Request) (*remote.ReadResponse, error)
 	IsHealthy() bool
 }
 
@@ -19,14 +21,21 @@ type ptcWriter interface {
 	Start()
 	Stop()
 	Wait()
+	Outputs() *outputRegistry
 }
 
 type ptcEngine struct {
-	reader ptcReader
-	writer ptcWriter
-	server *ptcServer
-	clicks *clicksMan
-	log    *zap.SugaredLogger
+	reader   ptcReader
+	writer   ptcWriter
+	server   *ptcServer
+	clicks   *clicksMan
+	explorer *cardinalityExplorer
+	deleter  *seriesDeleter
+	importer *seriesImporter
+	exporter *seriesExporter
+	status   *statusPage
+	tracing  *ptcTracing
+	log      *zap.SugaredLogger
 }
 
 
@@ -45,7 +54,45 @@ func (e *ptcEngine)WaitServer(){
 	e.server.Wait()
 }
 
-func init(){
+func (e *ptcEngine)RunImport(){
+	if e.importer == nil {
+		slog.Fatalf("import is only supported in mode 3")
+	}
+
+	if err := e.importer.RunImport(); err != nil {
+		slog.Fatalf("import failed: %s", err)
+	}
+	e.tracing.Stop()
+}
+
+func (e *ptcEngine)RunExport(){
+	if e.exporter == nil {
+		slog.Fatalf("export is only supported in mode 3")
+	}
+
+	if err := e.exporter.RunExport(); err != nil {
+		slog.Fatalf("export failed: %s", err)
+	}
+	e.tracing.Stop()
+}
+
+// waitHealthy waits for the first connecting of clickhouse, return false if timeout
+func waitHealthy(isHealthy func() bool, timeout time.Duration) bool {
+
+	deadline := time.Now().Add(timeout)
+	for !isHealthy() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return true
+}
+
+// Init parses the command line and config, and initializes all the components, it's called by main before running
+// a command, so the package can be loaded without them, like by tests
+func Init(){
 
 	initConfig()
 	initLogger()
@@ -57,18 +104,36 @@ func init(){
 	Engine.reader = new(clickReader)
 	Engine.writer = new(clickWriter)
 	Engine.server = new(ptcServer)
-
-	if Cfg.Reader.Mode == 2{
-		Engine.reader = new(clickReader2)
-	}
+	Engine.status = new(statusPage)
+	Engine.tracing = new(ptcTracing)
 
 	if Cfg.Reader.Mode == 3{
-		Engine.reader = new(clickReader3)
 		Engine.writer = new(clickWriter3)
+		Engine.explorer = new(cardinalityExplorer)
+		Engine.importer = new(seriesImporter)
+		Engine.exporter = new(seriesExporter)
+
+		if Cfg.Server.EnableAdminApi {
+			Engine.deleter = new(seriesDeleter)
+		}
 	}
 
+	Engine.tracing.init()
 	Engine.clicks.init()
 	Engine.reader.init()
 	Engine.writer.init()
+	if Engine.explorer != nil {
+		Engine.explorer.init()
+	}
+	if Engine.deleter != nil {
+		Engine.deleter.init()
+	}
+	if Engine.importer != nil {
+		Engine.importer.init()
+	}
+	if Engine.exporter != nil {
+		Engine.exporter.init()
+	}
+	Engine.status.init()
 	Engine.server.init()
 }
\ No newline at end of file
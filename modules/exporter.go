@@ -0,0 +1,312 @@
+package modules
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// seriesExporter dumps series out of clickhouse through the query path of reader
+type seriesExporter struct {
+	tag    string
+	reader *clickReader
+}
+
+func (ex *seriesExporter) init() {
+	ex.tag    = "exporter"
+	ex.reader = Engine.reader.(*clickReader)
+}
+
+// Export reads the series matched by any of the selectors in [start, end], sorted by labels,
+// if step <= 0, the raw samples are returned
+func (ex *seriesExporter) Export(db string, table string, selectors []string, start time.Time, end time.Time, step int64) ([]*remote.TimeSeries, error) {
+
+	tsres := map[string]*remote.TimeSeries{}
+
+	// the export may read a lot of series, so it's not limited like the requests of prometheus
+	ctx := withoutLimits(withCaller(context.Background(), "export"))
+
+	for _, selector := range selectors {
+		matchers, err := parseSelector(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector '%s': %s", selector, err)
+		}
+
+		query := &remote.Query{
+			StartTimestampMs: start.Unix() * 1000,
+			EndTimestampMs  : end.Unix() * 1000,
+			Matchers        : matchers,
+		}
+
+		plan, err := ex.reader.planner.plan(query, db, table, nil)
+		if err != nil {
+			return nil, err
+		}
+		plan.step = step
+		if plan.step < 0 {
+			plan.step = 0
+		}
+
+		res, err := ex.reader.readPlan(ctx, plan)
+		if err != nil {
+			return nil, err
+		}
+
+		// the same series may be matched by different selectors
+		for key, ts := range res.series {
+			tsres[key] = ts
+		}
+	}
+
+	out := make([]*remote.TimeSeries, 0, len(tsres))
+	for _, ts := range tsres {
+		if len(ts.Labels) > 0 {
+			out = append(out, ts)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return labelsString(out[i].Labels) < labelsString(out[j].Labels) })
+
+	return out, nil
+}
+
+// labelsString returns the series in format like name{label="value", ...}, the labels need to be sorted by name
+func labelsString(lbs []*remote.LabelPair) string {
+
+	var (
+		name  string
+		pairs []string
+	)
+
+	for _, l := range lbs {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		pairs = append(pairs, l.Name + `="` + escapeLabelValue(l.Value) + `"`)
+	}
+
+	if len(pairs) == 0 {
+		return name
+	}
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+
+	return v
+}
+
+func formatFloat(v float64) string {
+	switch {
+		case math.IsNaN(v)   : return "NaN"
+		case math.IsInf(v, 1): return "+Inf"
+		case math.IsInf(v,-1): return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeOpenMetrics writes the series as openmetrics text, the timestamps are in seconds,
+// the staleness markers can not be written in text, they are skipped
+func writeOpenMetrics(w io.Writer, series []*remote.TimeSeries) error {
+
+	bw := bufio.NewWriter(w)
+
+	for _, ts := range series {
+		key := labelsString(ts.Labels)
+		for _, sp := range ts.Samples {
+			if isStaleNaN(sp.Value) {
+				continue
+			}
+			fmt.Fprintf(bw, "%s %s %s\n", key, formatFloat(sp.Value), strconv.FormatFloat(float64(sp.TimestampMs) / 1000, 'f', -1, 64))
+		}
+	}
+	bw.WriteString("# EOF\n")
+
+	return bw.Flush()
+}
+
+// writeJsonLines writes one json object per series, like:
+//   {"metric":{"__name__":"up","job":"node"},"values":[1,1],"timestamps":[1588291200000,1588291215000]}
+// the special values NaN, +Inf and -Inf are written as strings, and the staleness markers are skipped
+func writeJsonLines(w io.Writer, series []*remote.TimeSeries) error {
+
+	bw  := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	for _, ts := range series {
+		line := struct {
+			Metric     map[string]string `json:"metric"`
+			Values     []interface{}     `json:"values"`
+			Timestamps []int64           `json:"timestamps"`
+		}{
+			Metric    : make(map[string]string, len(ts.Labels)),
+			Values    : make([]interface{}, 0, len(ts.Samples)),
+			Timestamps: make([]int64, 0, len(ts.Samples)),
+		}
+
+		for _, l := range ts.Labels {
+			line.Metric[l.Name] = l.Value
+		}
+		for _, sp := range ts.Samples {
+			if isStaleNaN(sp.Value) {
+				continue
+			}
+			if math.IsNaN(sp.Value) || math.IsInf(sp.Value, 0) {
+				line.Values = append(line.Values, formatFloat(sp.Value))
+			} else {
+				line.Values = append(line.Values, sp.Value)
+			}
+			line.Timestamps = append(line.Timestamps, sp.TimestampMs)
+		}
+
+		if err := enc.Encode(&line); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// writeBlock writes the series as a prometheus tsdb block in dir, which can be read by 'promtool tsdb',
+// the staleness markers are kept
+func writeBlock(dir string, series []*remote.TimeSeries, start time.Time, end time.Time) (string, error) {
+
+	// the head only accept samples in the half of chunk range before the max time,
+	// so we make the chunk range large enough to cover the whole range
+	chunkRange := (end.Unix() - start.Unix()) * 1000 * 2 + int64(time.Hour / time.Millisecond) * 2
+
+	head, err := tsdb.NewHead(nil, nil, nil, chunkRange)
+	if err != nil {
+		return "", err
+	}
+	defer head.Close()
+
+	for _, ts := range series {
+		lbs := make(labels.Labels, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			lbs = append(lbs, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		sort.Sort(lbs)
+
+		app := head.Appender()
+		for _, sp := range ts.Samples {
+			if _, err = app.Add(lbs, sp.TimestampMs, sp.Value); err != nil {
+				app.Rollback()
+				return "", fmt.Errorf("add sample of %s failed: %s", lbs, err)
+			}
+		}
+		if err = app.Commit(); err != nil {
+			return "", err
+		}
+	}
+
+	if head.NumSeries() == 0 {
+		return "", fmt.Errorf("no series to write")
+	}
+
+	compactor, err := tsdb.NewLeveledCompactor(context.Background(), nil, nil, []int64{chunkRange}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := compactor.Write(dir, head, head.MinTime(), head.MaxTime() + 1, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return id.String(), nil
+}
+
+// RunExport runs the export subcommand
+func (ex *seriesExporter) RunExport() error {
+
+	db    := *exportDb
+	table := *exportTable
+	if db == "" {
+		db = ex.reader.click.cfg.Database
+	}
+	if table == "" {
+		table = ex.reader.click.cfg.Table
+	}
+	if err := checkDbTable(db, table); err != nil {
+		return err
+	}
+
+	start, err := parseTime(*exportStart)
+	if err != nil {
+		return err
+	}
+	end := time.Now()
+	if *exportEnd != "" {
+		if end, err = parseTime(*exportEnd); err != nil {
+			return err
+		}
+	}
+	if end.Before(start) {
+		return fmt.Errorf("end is before start")
+	}
+
+	if !waitHealthy(ex.reader.IsHealthy, time.Second * 30) {
+		return fmt.Errorf("reader is not healthy: %s", ex.reader.click.ConnErr())
+	}
+
+	tStart := time.Now()
+
+	series, err := ex.Export(db, table, *exportMatch, start, end, *exportStep)
+	if err != nil {
+		return err
+	}
+
+	nsamples := 0
+	for _, ts := range series {
+		nsamples += len(ts.Samples)
+	}
+
+	if *exportFormat == "tsdb" {
+		dir := *exportOutput
+
+		id, err := writeBlock(dir, series, start, end)
+		if err != nil {
+			return err
+		}
+
+		slog.Infof("%s: exported %d series, %d samples to block %s/%s, cost: %s", ex.tag, len(series), nsamples, dir, id, time.Now().Sub(tStart).String())
+		return nil
+	}
+
+	out, err := os.Create(*exportOutput)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	switch *exportFormat {
+		case "jsonl": err = writeJsonLines(out, series)
+		default     : err = writeOpenMetrics(out, series)
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Infof("%s: exported %d series, %d samples to %s, cost: %s", ex.tag, len(series), nsamples, *exportOutput, time.Now().Sub(tStart).String())
+
+	return nil
+}
@@ -39,4 +39,75 @@ func Fingerprint(labels []*remote.LabelPair) uint64 {
 		sum = hashAddByte(sum, separatorByte)
 	}
 	return sum
-}
\ No newline at end of file
+}
+
+// SeriesCheck calculates a secondary hash of SORTED BY NAME labels, it's used to check whether two series
+// with the same fingerprint are the same one, it's a fnv64 (not fnv64a) hash, independent of Fingerprint
+func SeriesCheck(labels []*remote.LabelPair) uint64 {
+	sum := offset64
+	for _, l := range labels {
+		for i := 0; i < len(l.Name); i++ {
+			sum *= prime64
+			sum ^= uint64(l.Name[i])
+		}
+		sum *= prime64
+		sum ^= uint64(separatorByte)
+		for i := 0; i < len(l.Value); i++ {
+			sum *= prime64
+			sum ^= uint64(l.Value[i])
+		}
+		sum *= prime64
+		sum ^= uint64(separatorByte)
+	}
+	return sum
+}
+
+// saltedFingerprint returns the n-th candidate id for a series whose fingerprint is collided with another series,
+// it's derived from both hashes of the labels, so the series gets the same ids in any process and after restart
+func saltedFingerprint(fingerprint uint64, check uint64, salt int) uint64 {
+	sum := offset64
+	for i := 0; i < 8; i++ {
+		sum = hashAddByte(sum, byte(fingerprint >> (8 * uint(i))))
+	}
+	sum = hashAddByte(sum, separatorByte)
+	for i := 0; i < 8; i++ {
+		sum = hashAddByte(sum, byte(check >> (8 * uint(i))))
+	}
+	sum = hashAddByte(sum, separatorByte)
+	for i := 0; i < 8; i++ {
+		sum = hashAddByte(sum, byte(uint64(salt) >> (8 * uint(i))))
+	}
+	return sum
+}
+
+// disambiguate returns the id to store the series with the fingerprint and check, the fingerprint itself is used
+// if possible, otherwise the first usable salted one, collided reports whether it's salted:
+//   ownerOf returns the check of the series owns an id, the salted ids owned by the series are used first,
+//           so a series keeps its salted id even if the owner of the fingerprint is not known anymore
+//   claim   reports whether an id can be used by the series, and makes the series own it if it can
+func disambiguate(fingerprint uint64, check uint64, ownerOf func(id uint64) (uint64, bool), claim func(id uint64) bool) (id uint64, collided bool) {
+
+	if c, exist := ownerOf(fingerprint); !exist || c != check {
+		for salt := 1; ; salt++ {
+			id = saltedFingerprint(fingerprint, check, salt)
+			c, exist := ownerOf(id)
+			if !exist {
+				break
+			}
+			if c == check {
+				return id, true
+			}
+		}
+	}
+
+	if claim(fingerprint) {
+		return fingerprint, false
+	}
+
+	for salt := 1; ; salt++ {
+		id = saltedFingerprint(fingerprint, check, salt)
+		if claim(id) {
+			return id, true
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package modules
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const fingerprintSnapshotMagic = "PTCFPC2\n"
+
+type fingerprintCheckpoint struct {
+	lastUse        time.Time
+	key            fingerprintKey
+}
+
+// fingerprintKey identifies a row in <table>_metrics, a fingerprint need to be written once for every date it has samples
+type fingerprintKey struct {
+	fingerprint uint64
+	date        int32		// like 20200501
+}
+
+func newFingerprintKey(fingerprint uint64, date time.Time) fingerprintKey {
+	y, m, d := date.Date()
+	return fingerprintKey{fingerprint, int32(y * 10000 + int(m) * 100 + d)}
+}
+
+// fingerprintOwner records which series owns a fingerprint in the cache
+type fingerprintOwner struct {
+	check   uint64		// SeriesCheck of the labels
+	refs    int			// num of (fingerprint, date) entries in caches
+	pinned  bool		// collided, kept when not cached, so the series are not merged after their entries are evicted
+}
+
+const fingerprintOwnerStripes = 64
+
+// fingerprintOwners records the owners of the fingerprints of an output, it's shared by the caches of all the shards,
+// because a salted fingerprint is cached in the shard of its series, not the one it maps to, so it must be checked
+// against the series of all the shards, it's thread safe, the owners are split to stripes to reduce the lock contention
+type fingerprintOwners struct {
+	stripes [fingerprintOwnerStripes]struct {
+		sync.Mutex
+		owners map[uint64]*fingerprintOwner
+	}
+}
+
+func newFingerprintOwners() *fingerprintOwners {
+	out := new(fingerprintOwners)
+	for i := range out.stripes {
+		out.stripes[i].owners = map[uint64]*fingerprintOwner{}
+	}
+
+	return out
+}
+
+// ownerOf returns the check of the series owns the fingerprint
+func (fo *fingerprintOwners) ownerOf(fingerprint uint64) (check uint64, exist bool) {
+	st := &fo.stripes[fingerprint % fingerprintOwnerStripes]
+	st.Lock()
+	defer st.Unlock()
+
+	if o, exist := st.owners[fingerprint]; exist {
+		return o.check, true
+	}
+
+	return 0, false
+}
+
+// claim makes the series with the check own the fingerprint if no one owns it, it reports whether the series owns it
+func (fo *fingerprintOwners) claim(fingerprint uint64, check uint64) bool {
+	st := &fo.stripes[fingerprint % fingerprintOwnerStripes]
+	st.Lock()
+	defer st.Unlock()
+
+	o, exist := st.owners[fingerprint]
+	if !exist {
+		st.owners[fingerprint] = &fingerprintOwner{check: check}
+		return true
+	}
+
+	return o.check == check
+}
+
+// ref refs the owner of the fingerprint for an entry cached, the owner is created by the check if not exist
+func (fo *fingerprintOwners) ref(fingerprint uint64, check uint64) {
+	st := &fo.stripes[fingerprint % fingerprintOwnerStripes]
+	st.Lock()
+	defer st.Unlock()
+
+	o, exist := st.owners[fingerprint]
+	if !exist {
+		o = &fingerprintOwner{check: check}
+		st.owners[fingerprint] = o
+	}
+	o.refs++
+}
+
+// unref unrefs the owner of the fingerprint for an entry removed, it's released if no entries left
+func (fo *fingerprintOwners) unref(fingerprint uint64) {
+	st := &fo.stripes[fingerprint % fingerprintOwnerStripes]
+	st.Lock()
+	defer st.Unlock()
+
+	if o, exist := st.owners[fingerprint]; exist {
+		if o.refs--; o.refs <= 0 && !o.pinned {
+			delete(st.owners, fingerprint)
+		}
+	}
+}
+
+// release releases the owner claimed but not cached, like when the series has no samples,
+// or the fingerprint stays owned by the series forever
+func (fo *fingerprintOwners) release(fingerprint uint64) {
+	st := &fo.stripes[fingerprint % fingerprintOwnerStripes]
+	st.Lock()
+	defer st.Unlock()
+
+	if o, exist := st.owners[fingerprint]; exist && o.refs <= 0 && !o.pinned {
+		delete(st.owners, fingerprint)
+	}
+}
+
+// pin keeps the owner of the fingerprint even if it's not cached, the owner is created by the check if not exist
+func (fo *fingerprintOwners) pin(fingerprint uint64, check uint64) {
+	st := &fo.stripes[fingerprint % fingerprintOwnerStripes]
+	st.Lock()
+	defer st.Unlock()
+
+	o, exist := st.owners[fingerprint]
+	if !exist {
+		o = &fingerprintOwner{check: check}
+		st.owners[fingerprint] = o
+	}
+	o.pinned = true
+}
+
+// pinned returns the pinned fingerprints and the checks of their owners
+func (fo *fingerprintOwners) pinned() map[uint64]uint64 {
+	out := map[uint64]uint64{}
+	for i := range fo.stripes {
+		st := &fo.stripes[i]
+		st.Lock()
+		for fingerprint, o := range st.owners {
+			if o.pinned {
+				out[fingerprint] = o.check
+			}
+		}
+		st.Unlock()
+	}
+
+	return out
+}
+
+type fingerprintCacheMetrics struct {
+	size       prometheus.Gauge
+	hits       prometheus.Counter
+	misses     prometheus.Counter
+	evictions  prometheus.Counter
+	collisions prometheus.Counter
+	entries    int64				// atomic, the same as size, for status
+}
+
+var (
+	fingerprintCacheSize      = prometheus.NewGaugeVec  (prometheus.GaugeOpts  {Name: "fingerprint_cache_size"           , Help: "Number of (fingerprint, date) entries in the fingerprint cache of writer."}, []string{"server", "db", "table"})
+	fingerprintCacheHits      = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "fingerprint_cache_hits_total"     , Help: "Total number of metrics found in the fingerprint cache of writer."}, []string{"server", "db", "table"})
+	fingerprintCacheMisses    = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "fingerprint_cache_misses_total"   , Help: "Total number of metrics not found in the fingerprint cache of writer, they will be written to clickhouse."}, []string{"server", "db", "table"})
+	fingerprintCacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "fingerprint_cache_evictions_total", Help: "Total number of entries evicted from the fingerprint cache of writer because it's full."}, []string{"server", "db", "table"})
+	fingerprintCollisions     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "fingerprint_collisions_total"     , Help: "Total number of series found sharing a fingerprint with another series, side is write or read."}, []string{"server", "db", "table", "side"})
+)
+
+func init() {
+	prometheus.MustRegister(fingerprintCacheSize)
+	prometheus.MustRegister(fingerprintCacheHits)
+	prometheus.MustRegister(fingerprintCacheMisses)
+	prometheus.MustRegister(fingerprintCacheEvictions)
+	prometheus.MustRegister(fingerprintCollisions)
+}
+
+func newFingerprintCacheMetrics(server string, db string, table string) *fingerprintCacheMetrics {
+	return &fingerprintCacheMetrics{
+		size      : fingerprintCacheSize     .WithLabelValues(server, db, table),
+		hits      : fingerprintCacheHits     .WithLabelValues(server, db, table),
+		misses    : fingerprintCacheMisses   .WithLabelValues(server, db, table),
+		evictions : fingerprintCacheEvictions.WithLabelValues(server, db, table),
+		collisions: fingerprintCollisions    .WithLabelValues(server, db, table, "write"),
+	}
+}
+
+// fingerprintCache is a LRU cache of the (fingerprint, date) written to <table>_metrics,
+// an entry is removed when it's not used in hold time, or it's the least recently used one when the cache is full,
+// note: it's not thread safe, every shard of clickOutput3 has its own cache and only accesses it in the shard goroutine,
+// except the owners, which are shared by the shards
+type fingerprintCache struct {
+	fingerprints map[fingerprintKey]*list.Element
+	timelines    *list.List		// checkpoints in the order of last use
+	owners       *fingerprintOwners
+	holdTime     time.Duration
+	maxSize      int
+	metrics      *fingerprintCacheMetrics
+}
+
+func newFingerprintCache(holdSecond int, maxSize int, metrics *fingerprintCacheMetrics, owners *fingerprintOwners) *fingerprintCache {
+	out := new(fingerprintCache)
+
+	if holdSecond < 0 {
+		holdSecond = 0
+	}
+
+	out.fingerprints = map[fingerprintKey]*list.Element{}
+	out.timelines    = list.New()
+	out.owners       = owners
+	out.holdTime     = time.Second * time.Duration(holdSecond)
+	out.maxSize      = maxSize
+	out.metrics      = metrics
+
+	return out
+}
+
+// claimable reports whether the fingerprint can be used by the series with the check, it's not if the fingerprint is owned by another series
+func (fc *fingerprintCache) claimable(fingerprint uint64, check uint64) bool {
+	c, exist := fc.owners.ownerOf(fingerprint)
+	return !exist || c == check
+}
+
+// claim likes claimable, but the fingerprint will be owned by the series if it can,
+// the owner will be released when all the entries of the fingerprint are removed, so cache it after claim
+func (fc *fingerprintCache) claim(fingerprint uint64, check uint64) bool {
+	return fc.owners.claim(fingerprint, check)
+}
+
+// release releases the owner claimed but not cached, see fingerprintOwners.release
+func (fc *fingerprintCache) release(fingerprint uint64) {
+	fc.owners.release(fingerprint)
+}
+
+// return true if is a new one, the date should be the date of sample (see metricDate), not the time received,
+// so the delayed and backfilled samples can also be found by date in <table>_metrics
+func (fc *fingerprintCache) cache(fingerprint uint64, check uint64, date time.Time) bool {
+
+	key := newFingerprintKey(fingerprint, date)
+
+	e, exist := fc.fingerprints[key]
+	if exist {
+		e.Value.(*fingerprintCheckpoint).lastUse = time.Now()
+		fc.timelines.MoveToBack(e)
+		fc.metrics.hits.Inc()
+		return false
+	}
+
+	fc.metrics.misses.Inc()
+	fc.put(key, check, time.Now())
+
+	return true
+}
+
+func (fc *fingerprintCache) put(key fingerprintKey, check uint64, lastUse time.Time) {
+
+	if _, exist := fc.fingerprints[key]; exist {
+		return
+	}
+
+	for fc.maxSize > 0 && fc.timelines.Len() >= fc.maxSize {
+		fc.drop(fc.timelines.Front())
+		fc.metrics.evictions.Inc()
+	}
+
+	fc.owners.ref(key.fingerprint, check)
+
+	fc.fingerprints[key] = fc.timelines.PushBack(&fingerprintCheckpoint{lastUse, key})
+	fc.metrics.size.Inc()
+	atomic.AddInt64(&fc.metrics.entries, 1)
+}
+
+func (fc *fingerprintCache) drop(e *list.Element) {
+
+	key := e.Value.(*fingerprintCheckpoint).key
+
+	delete(fc.fingerprints, key)
+	fc.timelines.Remove(e)
+	fc.metrics.size.Dec()
+	atomic.AddInt64(&fc.metrics.entries, -1)
+
+	fc.owners.unref(key.fingerprint)
+}
+
+// forget removes the entry of key if cached, it's called when the metric of key is not written,
+// so it's not saved to the snapshot, and the metric will be written again with the next sample of the date
+func (fc *fingerprintCache) forget(key fingerprintKey) {
+	if e, exist := fc.fingerprints[key]; exist {
+		fc.drop(e)
+	}
+}
+
+// remove removes the fingerprint of all dates, the owner is released with the last entry unless it's pinned,
+// so a collided series keeps its id when it's written again
+func (fc *fingerprintCache) remove(fingerprint uint64) {
+	for key, e := range fc.fingerprints {
+		if key.fingerprint == fingerprint {
+			fc.drop(e)
+		}
+	}
+}
+
+// Reset removes all the entries, it's called when the output is stopped, so the size metrics do not count them anymore
+func (fc *fingerprintCache) Reset() {
+	for e := fc.timelines.Front(); e != nil; e = fc.timelines.Front() {
+		fc.drop(e)
+	}
+}
+
+func (fc *fingerprintCache) Len() int {
+	return fc.timelines.Len()
+}
+
+func (fc *fingerprintCache)Shrink() int {
+
+	now := time.Now()
+	removed := 0
+
+	for e := fc.timelines.Front(); e != nil; e = fc.timelines.Front() {
+
+		fcp := e.Value.(*fingerprintCheckpoint)
+
+		// remove cache exceed deadline, a row will be written again if the samples of the same date still come after,
+		// it's ok because the rows of the same date will be merged by ReplacingMergeTree
+		if now.Sub(fcp.lastUse) <= fc.holdTime {
+			break
+		}
+
+		fc.drop(e)
+		removed++
+	}
+
+	return removed
+}
+
+// warmUpFingerprints reads the fingerprints of recent dates from <table>_metrics, so a restarted or new replica
+// will not write all the series again, note: the dates in <table>_metrics are in the zone of reader (see metricDate),
+// the tags are read too, so the owners are known, put gets the key, and the fingerprint and check of the labels,
+// the fingerprint of labels is not the one of key if the series is stored under a salted one
+func warmUpFingerprints(ctx context.Context, c *click, db string, table string, since time.Time, limit int, put func(key fingerprintKey, fingerprint uint64, check uint64)) (int, error) {
+
+	sql := fmt.Sprintf("SELECT fingerprint, toYYYYMMDD(date) AS d, any(tags) FROM %s WHERE date >= '%s' GROUP BY fingerprint, d",
+		sqlTable(db, table), metricDate(since).Format("2006-01-02"))
+	if limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := c.Query(ctx, sql)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cnt := 0
+	for rows.Next() {
+		var (
+			fingerprint uint64
+			date        uint32
+			tags        []string
+		)
+		if err = rows.Scan(&fingerprint, &date, &tags); err != nil {
+			return cnt, err
+		}
+
+		labels := makeLabels(tags)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		put(fingerprintKey{fingerprint, int32(date)}, Fingerprint(labels), SeriesCheck(labels))
+		cnt++
+	}
+
+	return cnt, rows.Err()
+}
+
+// saveFingerprintSnapshot writes all the entries of caches to a local file, which can be loaded by loadFingerprintSnapshot after restart,
+// the pinned owners are written as the entries of date 0
+func saveFingerprintSnapshot(path string, caches []*fingerprintCache, owners *fingerprintOwners) (int, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	// write to a tmp file first, so a broken snapshot will not overwrite the last one
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	bw  := bufio.NewWriter(f)
+	buf := make([]byte, 28)
+	cnt := 0
+
+	bw.WriteString(fingerprintSnapshotMagic)
+	for _, fc := range caches {
+		for e := fc.timelines.Front(); e != nil; e = e.Next() {
+			fcp := e.Value.(*fingerprintCheckpoint)
+
+			check, _ := fc.owners.ownerOf(fcp.key.fingerprint)
+
+			binary.LittleEndian.PutUint64(buf[0:] , fcp.key.fingerprint)
+			binary.LittleEndian.PutUint32(buf[8:] , uint32(fcp.key.date))
+			binary.LittleEndian.PutUint64(buf[12:], uint64(fcp.lastUse.Unix()))
+			binary.LittleEndian.PutUint64(buf[20:], check)
+			bw.Write(buf)
+			cnt++
+		}
+	}
+
+	now := time.Now()
+	for fingerprint, check := range owners.pinned() {
+		binary.LittleEndian.PutUint64(buf[0:] , fingerprint)
+		binary.LittleEndian.PutUint32(buf[8:] , 0)
+		binary.LittleEndian.PutUint64(buf[12:], uint64(now.Unix()))
+		binary.LittleEndian.PutUint64(buf[20:], check)
+		bw.Write(buf)
+	}
+
+	if err = bw.Flush(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err = f.Close(); err != nil {
+		return 0, err
+	}
+
+	return cnt, os.Rename(tmp, path)
+}
+
+// loadFingerprintSnapshot reads the entries saved by saveFingerprintSnapshot, the entries exceed hold time are skipped
+func loadFingerprintSnapshot(path string, holdTime time.Duration, put func(key fingerprintKey, check uint64, lastUse time.Time)) (int, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	br  := bufio.NewReader(f)
+	buf := make([]byte, 28)
+
+	if _, err = io.ReadFull(br, buf[:len(fingerprintSnapshotMagic)]); err != nil || string(buf[:len(fingerprintSnapshotMagic)]) != fingerprintSnapshotMagic {
+		return 0, fmt.Errorf("invalid snapshot file")
+	}
+
+	now := time.Now()
+	cnt := 0
+	for {
+		if _, err = io.ReadFull(br, buf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return cnt, err
+		}
+
+		lastUse := time.Unix(int64(binary.LittleEndian.Uint64(buf[12:])), 0)
+		if now.Sub(lastUse) > holdTime {
+			continue
+		}
+
+		put(fingerprintKey{binary.LittleEndian.Uint64(buf[0:]), int32(binary.LittleEndian.Uint32(buf[8:]))}, binary.LittleEndian.Uint64(buf[20:]), lastUse)
+		cnt++
+	}
+
+	return cnt, nil
+}
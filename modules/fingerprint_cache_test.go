@@ -0,0 +1,209 @@
+package modules
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func newTestFingerprintCache(maxSize int) *fingerprintCache {
+	return newFingerprintCache(3600, maxSize, newFingerprintCacheMetrics("test", "prometheus", "samples"), newFingerprintOwners())
+}
+
+func TestFingerprintCacheReleaseClaim(t *testing.T) {
+
+	fc := newTestFingerprintCache(0)
+
+	if !fc.claim(1, 100) {
+		t.Fatalf("claim of a new fingerprint failed")
+	}
+	if fc.claimable(1, 200) {
+		t.Fatalf("a claimed fingerprint is claimable by another series")
+	}
+
+	// no samples cached for the series, the claim is released
+	fc.release(1)
+	if !fc.claimable(1, 200) {
+		t.Fatalf("a released fingerprint is not claimable by another series")
+	}
+
+	// the cached ones are not released
+	fc.claim(2, 100)
+	fc.cache(2, 100, time.Now())
+	fc.release(2)
+	if fc.claimable(2, 200) {
+		t.Fatalf("a cached fingerprint is released")
+	}
+}
+
+func TestFingerprintCacheReset(t *testing.T) {
+
+	fc := newTestFingerprintCache(0)
+	fc.metrics.size.Set(0)
+
+	day := time.Date(2020, 5, 1, 0, 0, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		fc.claim(uint64(i), uint64(i))
+		fc.cache(uint64(i), uint64(i), day)
+		fc.cache(uint64(i), uint64(i), day.AddDate(0, 0, 1))
+	}
+	if got := testutil.ToFloat64(fc.metrics.size); got != 6 {
+		t.Fatalf("size = %g, want 6", got)
+	}
+
+	fc.Reset()
+
+	if got := testutil.ToFloat64(fc.metrics.size); got != 0 {
+		t.Errorf("size = %g after reset, want 0", got)
+	}
+	if fc.Len() != 0 || fc.metrics.entries != 0 {
+		t.Errorf("%d entries and %d counted after reset, want 0", fc.Len(), fc.metrics.entries)
+	}
+	for i := 0; i < 3; i++ {
+		if _, exist := fc.owners.ownerOf(uint64(i)); exist {
+			t.Errorf("owner of %d is not released after reset", i)
+		}
+	}
+}
+
+// resolve resolves the id of the series with the fingerprint and check like clickShard3.resolveFingerprint
+func resolve(owners *fingerprintOwners, fingerprint uint64, check uint64) uint64 {
+
+	id, collided := disambiguate(fingerprint, check, owners.ownerOf, func(id uint64) bool { return owners.claim(id, check) })
+	if collided {
+		if c, exist := owners.ownerOf(fingerprint); exist {
+			owners.pin(fingerprint, c)
+		}
+		owners.pin(id, check)
+	}
+
+	return id
+}
+
+func TestDisambiguate(t *testing.T) {
+
+	const fp, checkA, checkB = 1, 100, 200
+
+	owners := newFingerprintOwners()
+
+	if id := resolve(owners, fp, checkA); id != fp {
+		t.Fatalf("series A is stored as %d, want its fingerprint %d", id, fp)
+	}
+	salted := resolve(owners, fp, checkB)
+	if salted == fp {
+		t.Fatalf("series B is stored as the fingerprint of series A")
+	}
+	if salted != saltedFingerprint(fp, checkB, 1) {
+		t.Fatalf("series B is stored as %d, want the first salted one %d", salted, saltedFingerprint(fp, checkB, 1))
+	}
+	if id := resolve(owners, fp, checkB); id != salted {
+		t.Fatalf("series B is stored as %d again, want %d", id, salted)
+	}
+
+	// another process only knows the salted one, like loaded from snapshot, series B keeps it and A gets the fingerprint
+	other := newFingerprintOwners()
+	other.pin(salted, checkB)
+	if id := resolve(other, fp, checkB); id != salted {
+		t.Fatalf("series B is stored as %d in another process, want %d", id, salted)
+	}
+	if id := resolve(other, fp, checkA); id != fp {
+		t.Fatalf("series A is stored as %d in another process, want %d", id, fp)
+	}
+
+	// the salted one is the fingerprint of series C (in another shard), it's owned by series B already
+	if id := resolve(owners, salted, 300); id == salted {
+		t.Fatalf("series C is stored as the salted fingerprint of series B")
+	}
+
+	// the collided ones are pinned, they are kept after all the entries are evicted
+	fc := newFingerprintCache(3600, 1, newFingerprintCacheMetrics("test", "prometheus", "samples"), owners)
+	fc.cache(fp, checkA, time.Now())
+	fc.cache(salted, checkB, time.Now())
+	fc.Reset()
+	if c, _ := owners.ownerOf(fp); c != checkA {
+		t.Errorf("owner of %d is %d after evicted, want %d", fp, c, checkA)
+	}
+	if c, _ := owners.ownerOf(salted); c != checkB {
+		t.Errorf("owner of %d is %d after evicted, want %d", salted, c, checkB)
+	}
+}
+
+func TestFingerprintSnapshot(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "prometheus.samples_metrics.fpc")
+
+	fc := newTestFingerprintCache(0)
+	fc.claim(1, 100)
+	fc.cache(1, 100, time.Now())
+	fc.owners.pin(2, 200)
+
+	if _, err := saveFingerprintSnapshot(path, []*fingerprintCache{fc}, fc.owners); err != nil {
+		t.Fatalf("save snapshot failed: %s", err)
+	}
+
+	got := map[fingerprintKey]uint64{}
+	if _, err := loadFingerprintSnapshot(path, time.Hour, func(key fingerprintKey, check uint64, lastUse time.Time) { got[key] = check }); err != nil {
+		t.Fatalf("load snapshot failed: %s", err)
+	}
+
+	want := map[fingerprintKey]uint64{
+		newFingerprintKey(1, time.Now()): 100,
+		{fingerprint: 2}                : 200,		// pinned, without date
+	}
+	if len(got) != len(want) {
+		t.Fatalf("loaded %v, want %v", got, want)
+	}
+	for key, check := range want {
+		if got[key] != check {
+			t.Errorf("check of %v is %d, want %d", key, got[key], check)
+		}
+	}
+}
+
+func TestShardDropRowsForgetsEntries(t *testing.T) {
+
+	co := newTestOutput(1)
+	sh := co.shards[0]
+
+	labels := []*remote.LabelPair{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}}
+	name, tags, fingerprint := parseSeries(labels)
+	day := time.Date(2020, 5, 1, 12, 0, 0, 0, time.Local)
+
+	sh.handle(&shardInput3{labels: labels, name: name, tags: tags, fingerprint: fingerprint, samples: []*remote.Sample{
+		{Value: 1, TimestampMs: day.UnixNano() / 1e6},
+		{Value: 1, TimestampMs: day.AddDate(0, 0, 1).UnixNano() / 1e6},
+	}})
+	if len(sh.metrics) != 2 || sh.fingerprints.Len() != 2 {
+		t.Fatalf("%d metrics and %d entries after handled, want 2 and 2", len(sh.metrics), sh.fingerprints.Len())
+	}
+
+	dropped := writeDroppedRows.WithLabelValues("test", "prometheus", "samples", "metrics", dropStopped)
+	before  := testutil.ToFloat64(dropped)
+
+	// the metrics not written are not saved to the snapshot as written
+	sh.dropRows("metrics", sh.metrics, dropStopped)
+
+	if sh.fingerprints.Len() != 0 {
+		t.Errorf("%d entries left after the metrics dropped, want 0", sh.fingerprints.Len())
+	}
+	if got := testutil.ToFloat64(dropped) - before; got != 2 {
+		t.Errorf("%g metrics counted as dropped, want 2", got)
+	}
+	cnt, err := saveFingerprintSnapshot(filepath.Join(t.TempDir(), "test.fpc"), []*fingerprintCache{sh.fingerprints}, co.owners())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 0 {
+		t.Errorf("%d entries saved to the snapshot, want 0", cnt)
+	}
+
+	// written again with the next sample
+	sh.metrics = nil
+	sh.handle(&shardInput3{labels: labels, name: name, tags: tags, fingerprint: fingerprint, samples: []*remote.Sample{{Value: 1, TimestampMs: day.UnixNano() / 1e6}}})
+	if len(sh.metrics) != 1 {
+		t.Errorf("%d metrics after the next sample, want 1", len(sh.metrics))
+	}
+}
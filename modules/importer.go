@@ -0,0 +1,439 @@
+package modules
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+type importStats struct {
+	Db      string `json:"db"`
+	Table   string `json:"table"`
+	Series  int    `json:"series"`
+	Samples int    `json:"samples"`
+	Metrics int    `json:"metrics"`
+	MinTime int64  `json:"min_time"`
+	MaxTime int64  `json:"max_time"`
+	Cost    string `json:"cost"`
+}
+
+// importSession records the (fingerprint, date) pairs written to <table>_metrics in one import,
+// an import may cover a lot of old dates, we record them here and leave the fingerprint cache of writer untouched,
+// so the cache will not be flooded by the dates which will never be written again
+type importSession struct {
+	co      *clickOutput3
+	release func()
+	written map[uint64]map[string]bool
+	checks  map[uint64]uint64		// the SeriesCheck of the series of written fingerprints
+	pending map[*clickShard3][]*promSample3		// the rows not sent to shards yet
+	stats   importStats
+	tStart  time.Time
+}
+
+const (
+	importLinesPerChunk = 8192		// the lines of openmetrics grouped by series, so a series is resolved once per chunk
+	importRowsPerInput  = 8192		// the rows sent to a shard at once
+)
+
+// seriesImporter loads historical data into clickhouse through the same pipeline as clickWriter3
+type seriesImporter struct {
+	tag     string
+	writer  *clickWriter3
+	session func(db string, table string) (*importSession, error)		// opens a session on db.table, newSession by default
+}
+
+func (im *seriesImporter) init() {
+	im.tag     = "importer"
+	im.writer  = Engine.writer.(*clickWriter3)
+	im.session = im.newSession
+}
+
+func (im *seriesImporter) newSession(db string, table string) (*importSession, error) {
+
+	co, release, err := im.writer.getClickOutputByName(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	return newImportSession(co, release), nil
+}
+
+func newImportSession(co *clickOutput3, release func()) *importSession {
+
+	out := new(importSession)
+	out.co            = co
+	out.release       = release
+	out.written       = map[uint64]map[string]bool{}
+	out.checks        = map[uint64]uint64{}
+	out.pending       = map[*clickShard3][]*promSample3{}
+	out.stats.Db      = co.db
+	out.stats.Table   = co.table
+	out.stats.MinTime = math.MaxInt64
+	out.stats.MaxTime = math.MinInt64
+	out.tStart        = time.Now()
+
+	return out
+}
+
+// push adds the samples of a series to the rows of its shard, they are sent to the shard in batches, see send,
+// the labels will be sorted by name
+func (s *importSession) push(labels []*remote.LabelPair, samples []*remote.Sample) {
+
+	name, tags, fingerprint := parseSeries(labels)
+
+	sh := s.co.shardOf(fingerprint)
+	fingerprint = s.resolveFingerprint(sh, labels, fingerprint)
+
+	dates, exist := s.written[fingerprint]
+	if !exist {
+		dates = map[string]bool{}
+		s.written[fingerprint] = dates
+		s.stats.Series++
+	}
+
+	rows := make([]*promSample3, 0, len(samples) + 1)
+
+	for _, sample := range samples {
+		sp := new(promSample3)
+		sp.name        = name
+		sp.ts          = time.Unix(sample.TimestampMs/1000, (sample.TimestampMs % 1000) * int64(time.Millisecond))
+		sp.val         = sample.Value
+		sp.tags        = tags
+		sp.fingerprint = fingerprint
+		sp.isSample    = true
+
+		rows = append(rows, sp)
+
+		date := metricDate(sp.ts)
+		sDate := date.Format("2006-01-02")
+		if !dates[sDate] {
+			dates[sDate] = true
+
+			mt := new(promSample3)
+			mt.name        = name
+			mt.tags        = tags
+			mt.fingerprint = fingerprint
+			mt.date        = date
+
+			rows = append(rows, mt)
+			s.stats.Metrics++
+		}
+
+		if sample.TimestampMs < s.stats.MinTime {
+			s.stats.MinTime = sample.TimestampMs
+		}
+		if sample.TimestampMs > s.stats.MaxTime {
+			s.stats.MaxTime = sample.TimestampMs
+		}
+	}
+
+	s.pending[sh] = append(s.pending[sh], rows...)
+	if len(s.pending[sh]) >= importRowsPerInput {
+		s.send(sh)
+	}
+
+	s.stats.Samples += len(samples)
+}
+
+// send sends the pending rows of the shard, without waiting for them to be handled
+func (s *importSession) send(sh *clickShard3) {
+	if rows := s.pending[sh]; len(rows) > 0 {
+		sh.inputs <- &shardInput3{rows: rows}
+	}
+	delete(s.pending, sh)
+}
+
+// flush sends the pending rows of all the shards
+func (s *importSession) flush() {
+	for sh := range s.pending {
+		s.send(sh)
+	}
+}
+
+// resolveFingerprint likes clickShard3.resolveFingerprint, but not claims the fingerprints in the cache of writer,
+// the owners of writer are shared and locked, so it runs in the goroutine of importer
+func (s *importSession) resolveFingerprint(sh *clickShard3, labels []*remote.LabelPair, fingerprint uint64) uint64 {
+
+	check := SeriesCheck(labels)
+
+	ownerOf := func(id uint64) (uint64, bool) {
+		if c, exist := s.checks[id]; exist {
+			return c, true
+		}
+		return sh.fingerprints.owners.ownerOf(id)
+	}
+
+	// the salts are the same as writer, so a series imported and written at the same time gets the same id
+	id, collided := disambiguate(fingerprint, check, ownerOf, func(id uint64) bool {
+		if c, exist := ownerOf(id); exist {
+			return c == check
+		}
+		s.checks[id] = check
+		return true
+	})
+	if collided && s.written[id] == nil {
+		sh.fingerprints.metrics.collisions.Inc()
+		slog.Warnf("%s: fingerprint %d collided, series %v will be stored as %d", sh.tag, fingerprint, labels, id)
+	}
+
+	return id
+}
+
+// finish sends the pending rows and returns the stats
+func (s *importSession) finish() *importStats {
+
+	s.flush()
+
+	if s.stats.Samples == 0 {
+		s.stats.MinTime = 0
+		s.stats.MaxTime = 0
+	}
+	s.stats.Cost = time.Now().Sub(s.tStart).String()
+
+	return &s.stats
+}
+
+// ImportOpenMetrics imports the samples from an openmetrics text, every sample need a timestamp
+func (im *seriesImporter) ImportOpenMetrics(db string, table string, r io.Reader) (*importStats, error) {
+
+	s, err := im.session(db, table)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	err = s.pushOpenMetrics(r)
+
+	stats := s.finish()
+	if err != nil {
+		return stats, err
+	}
+	slog.Infof("%s: %s: imported %d series, %d samples, %d metrics from openmetrics, cost: %s", im.tag, s.co.tag, stats.Series, stats.Samples, stats.Metrics, stats.Cost)
+
+	return stats, nil
+}
+
+// pushOpenMetrics pushes the samples of an openmetrics text, the samples of a chunk of lines are grouped by series,
+// in the order first seen, the samples before an invalid line are still pushed
+func (s *importSession) pushOpenMetrics(r io.Reader) error {
+
+	var (
+		keys   []string
+		series = map[string]*remote.TimeSeries{}
+		lines  int
+	)
+	pushChunk := func() {
+		for _, key := range keys {
+			s.push(series[key].Labels, series[key].Samples)
+		}
+		keys   = keys[:0]
+		series = map[string]*remote.TimeSeries{}
+		lines  = 0
+	}
+
+	parser := newOpenMetricsParser(r)
+	for {
+		lbs, sample, err := parser.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pushChunk()
+			return err
+		}
+
+		key := seriesKey(lbs)
+		ts, exist := series[key]
+		if !exist {
+			ts = &remote.TimeSeries{Labels: lbs}
+			series[key] = ts
+			keys = append(keys, key)
+		}
+		ts.Samples = append(ts.Samples, sample)
+
+		if lines++; lines >= importLinesPerChunk {
+			pushChunk()
+		}
+	}
+	pushChunk()
+
+	return nil
+}
+
+// seriesKey returns the key of labels to group the samples, the labels in different orders are different series here
+func seriesKey(labels []*remote.LabelPair) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l.Name)
+		sb.WriteByte(separatorByte)
+		sb.WriteString(l.Value)
+		sb.WriteByte(separatorByte)
+	}
+
+	return sb.String()
+}
+
+// ImportBlock imports all the series from a prometheus tsdb block dir
+func (im *seriesImporter) ImportBlock(db string, table string, dir string) (*importStats, error) {
+
+	s, err := im.session(db, table)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	block, err := tsdb.OpenBlock(nil, dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer block.Close()
+
+	querier, err := tsdb.NewBlockQuerier(block, block.MinTime(), block.MaxTime())
+	if err != nil {
+		return nil, err
+	}
+	defer querier.Close()
+
+	ss, err := querier.Select(labels.NewMustRegexpMatcher("__name__", ".+"))
+	if err != nil {
+		return nil, err
+	}
+
+	const samplesPerPush = 1024
+
+	for ss.Next() {
+		series := ss.At()
+
+		var lbs []*remote.LabelPair
+		for _, l := range series.Labels() {
+			lbs = append(lbs, &remote.LabelPair{Name: l.Name, Value: l.Value})
+		}
+
+		var samples []*remote.Sample
+		it := series.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			samples = append(samples, &remote.Sample{TimestampMs: t, Value: v})
+
+			if len(samples) >= samplesPerPush {
+				s.push(lbs, samples)
+				samples = nil
+			}
+		}
+		if err = it.Err(); err != nil {
+			return s.finish(), err
+		}
+		if len(samples) > 0 {
+			s.push(lbs, samples)
+		}
+	}
+	if err = ss.Err(); err != nil {
+		return s.finish(), err
+	}
+
+	stats := s.finish()
+	slog.Infof("%s: %s: imported %d series, %d samples, %d metrics from block %s, cost: %s", im.tag, s.co.tag, stats.Series, stats.Samples, stats.Metrics, dir, stats.Cost)
+
+	return stats, nil
+}
+
+// handlerForImport handles /api/v1/import, the body is an openmetrics text with timestamps
+func (im *seriesImporter) handlerForImport(w http.ResponseWriter, r *http.Request) {
+
+	slog.Infof("%s: %s from %s @ %s", im.tag, r.RequestURI, r.Header.Get("User-Agent"), r.RemoteAddr)
+
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		respondError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if im.writer.IsHealthy() == false {
+		respondError(w, http.StatusInternalServerError, fmt.Errorf("writer is not healthy"))
+		return
+	}
+
+	// the args are in url only, r.ParseForm would consume the body sent as a form, like 'curl --data-binary' does
+	query := r.URL.Query()
+
+	db    := im.writer.click.cfg.Database
+	table := im.writer.click.cfg.Table
+	if arg := query.Get("db"); arg != "" {
+		db = arg
+	}
+	if arg := query.Get("table"); arg != "" {
+		table = arg
+	}
+	if err := checkDbTable(db, table); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	stats, err := im.ImportOpenMetrics(db, table, r.Body)
+	if err != nil {
+		slog.Errorf("%s: import failed: %s", im.tag, err)
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, stats)
+}
+
+// RunImport runs the import subcommand, the writer will be stopped after all the samples are written
+func (im *seriesImporter) RunImport() error {
+
+	db    := *importDb
+	table := *importTable
+	if db == "" {
+		db = im.writer.click.cfg.Database
+	}
+	if table == "" {
+		table = im.writer.click.cfg.Table
+	}
+	if err := checkDbTable(db, table); err != nil {
+		return err
+	}
+
+	if !waitHealthy(im.writer.IsHealthy, time.Second * 30) {
+		return fmt.Errorf("writer is not healthy: %s", im.writer.click.ConnErr())
+	}
+
+	var (
+		stats *importStats
+		err   error
+	)
+
+	switch *importFormat {
+	case "tsdb":
+		stats, err = im.ImportBlock(db, table, *importPath)
+
+	default:
+		var f *os.File
+		f, err = os.Open(*importPath)
+		if err != nil {
+			return err
+		}
+		stats, err = im.ImportOpenMetrics(db, table, f)
+		f.Close()
+	}
+
+	slog.Infof("%s: waiting for writer to flush...", im.tag)
+	im.writer.Stop()
+	im.writer.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	slog.Infof("%s: import done, %d series, %d samples from %s to %s", im.tag, stats.Series, stats.Samples,
+		time.Unix(stats.MinTime / 1000, 0).Format(time.RFC3339), time.Unix(stats.MaxTime / 1000, 0).Format(time.RFC3339))
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package modules
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestOutput returns an output not started, the rows sent to its shards are left in their inputs
+func newTestOutput(shards int) *clickOutput3 {
+
+	cw := &clickWriter3{
+		tag  : "writer",
+		cfg  : &WriterCfg{Shards: shards, Buffer: 1000},
+		click: &click{tag: "test", name: "test"},
+	}
+	cw.cfg.FingerprintCache.MaxSize  = 1000
+	cw.cfg.FingerprintCache.HoldTime = 3600
+
+	return NewClickOutput3(cw, "prometheus", "samples")
+}
+
+func TestImportOpenMetricsBatches(t *testing.T) {
+
+	text := `# TYPE up gauge
+up{job="api"} 1 1588291200
+up{job="web"} 1 1588291200
+go_goroutines{job="api"} 10 1588291200
+up{job="api"} 0 1588291215
+up{job="web"} 1 1588291215
+go_goroutines{job="api"} 12 1588291215
+# EOF
+`
+
+	co := newTestOutput(2)
+	s  := newImportSession(co, func() {})
+
+	if err := s.pushOpenMetrics(strings.NewReader(text)); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	stats := s.finish()
+
+	if stats.Series != 3 || stats.Samples != 6 || stats.Metrics != 3 {
+		t.Errorf("imported %d series, %d samples, %d metrics, want 3, 6, 3", stats.Series, stats.Samples, stats.Metrics)
+	}
+
+	// a batch of rows for every shard with series, nothing waits for a reply from shards
+	var inputs, samples, metrics int
+	for _, sh := range co.shards {
+		for len(sh.inputs) > 0 {
+			in := <-sh.inputs
+			if in.call != nil || in.rows == nil {
+				t.Fatalf("%s received an input without rows", sh.tag)
+			}
+			inputs++
+			for _, row := range in.rows {
+				if co.shardOf(row.fingerprint) != sh {
+					t.Errorf("%s received the rows of fingerprint %d", sh.tag, row.fingerprint)
+				}
+				if row.isSample {
+					samples++
+				} else {
+					metrics++
+				}
+			}
+		}
+	}
+	if inputs > len(co.shards) {
+		t.Errorf("%d inputs sent to %d shards, want one per shard at most", inputs, len(co.shards))
+	}
+	if samples != 6 || metrics != 3 {
+		t.Errorf("%d samples and %d metrics sent, want 6 and 3", samples, metrics)
+	}
+}
+
+func TestImportOpenMetricsInvalidLine(t *testing.T) {
+
+	text := `up{job="api"} 1 1588291200
+up{job="api"} 1
+`
+
+	co := newTestOutput(1)
+	s  := newImportSession(co, func() {})
+
+	if err := s.pushOpenMetrics(strings.NewReader(text)); err == nil {
+		t.Fatalf("push returns no error for a sample without timestamp")
+	}
+	if stats := s.finish(); stats.Samples != 1 {
+		t.Errorf("%d samples imported before the invalid line, want 1", stats.Samples)
+	}
+	if len(co.shards[0].inputs) != 1 {
+		t.Errorf("%d inputs sent, want 1", len(co.shards[0].inputs))
+	}
+}
+
+// newTestImporter returns an importer on a healthy writer, its sessions push the rows to newTestOutput
+func newTestImporter(opened *[]string) *seriesImporter {
+
+	im := &seriesImporter{
+		tag   : "importer",
+		writer: &clickWriter3{click: &click{health: 1, cfg: &ClickCfg{Database: "prometheus", Table: "samples"}}},
+	}
+	im.session = func(db string, table string) (*importSession, error) {
+		*opened = append(*opened, db + "." + table)
+		return newImportSession(newTestOutput(1), func() {}), nil
+	}
+
+	return im
+}
+
+func TestHandlerForImport(t *testing.T) {
+
+	body := `up{job="api"} 1 1588291200
+up{job="api"} 0 1588291215
+# EOF
+`
+
+	cases := []struct {
+		url     string
+		code    int
+		opened  string
+		samples int
+	}{
+		{"/api/v1/import"                           , http.StatusOK        , "prometheus.samples", 2},
+		{"/api/v1/import?db=metrics&table=imported" , http.StatusOK        , "metrics.imported"  , 2},
+		{"/api/v1/import?table=s%3BDROP+TABLE+x"    , http.StatusBadRequest, ""                  , 0},
+		{"/api/v1/import?db=a.b"                    , http.StatusBadRequest, ""                  , 0},
+	}
+
+	for _, c := range cases {
+		var opened []string
+		im := newTestImporter(&opened)
+
+		// the body sent by 'curl --data-binary' is a form by default, it should not be consumed as one
+		req := httptest.NewRequest(http.MethodPost, c.url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+
+		im.handlerForImport(rec, req)
+
+		if rec.Code != c.code {
+			t.Errorf("%s: got code %d, want %d: %s", c.url, rec.Code, c.code, rec.Body.String())
+			continue
+		}
+		if strings.Join(opened, ",") != c.opened {
+			t.Errorf("%s: sessions opened on %v, want %s", c.url, opened, c.opened)
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		var resp struct {
+			Data importStats `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: invalid response: %s", c.url, err)
+		}
+		if resp.Data.Samples != c.samples || resp.Data.Series != 1 {
+			t.Errorf("%s: imported %d series, %d samples, want 1, %d", c.url, resp.Data.Series, resp.Data.Samples, c.samples)
+		}
+	}
+}
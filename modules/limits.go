@@ -0,0 +1,113 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// queryLimits bounds the queries of a read request, the settings are sent to clickhouse with every sql,
+// and the num of rows and series are checked again while scanning rows, so a wild regex can not take down clickhouse
+type queryLimits struct {
+	maxRows   int64			// rows returned per sql, 0 for unlimited, the rows read are limited by clickhouse with the settings
+	maxSeries int				// series per request, 0 for unlimited
+	settings  []string
+}
+
+// queryLimitError is returned when a query exceeds the limits, it's the fault of the query, not the storage
+type queryLimitError struct {
+	msg string
+}
+
+func (e *queryLimitError) Error() string {
+	return e.msg
+}
+
+// serverTimeout returns the timeout of requests set in server config, default 30 seconds
+func serverTimeout() time.Duration {
+	if Cfg.Server.Timeout <= 0 {
+		Cfg.Server.Timeout = 30
+	}
+
+	return time.Second * time.Duration(Cfg.Server.Timeout)
+}
+
+// newQueryLimits returns the limits set in reader config, max_execution_time is default to the timeout of server,
+// the others are default unlimited, a negative value means unlimited too
+func newQueryLimits(cfg *ReaderCfg) *queryLimits {
+
+	out := new(queryLimits)
+
+	if cfg.MaxExecutionTime == 0 {
+		cfg.MaxExecutionTime = int(serverTimeout() / time.Second)
+	}
+	if cfg.MaxExecutionTime > 0 {
+		out.settings = append(out.settings, fmt.Sprintf("max_execution_time = %d", cfg.MaxExecutionTime))
+	}
+	if cfg.MaxMemoryUsage > 0 {
+		out.settings = append(out.settings, fmt.Sprintf("max_memory_usage = %d", cfg.MaxMemoryUsage))
+	}
+	if cfg.MaxRowsToRead > 0 {
+		out.settings = append(out.settings, fmt.Sprintf("max_rows_to_read = %d", cfg.MaxRowsToRead))
+		out.maxRows = cfg.MaxRowsToRead
+	}
+	if cfg.MaxSeries > 0 {
+		out.maxSeries = cfg.MaxSeries
+	}
+
+	return out
+}
+
+// checkRows checks the num of rows returned by a sql
+func (l *queryLimits) checkRows(n int64) error {
+	if l.maxRows > 0 && n > l.maxRows {
+		return &queryLimitError{fmt.Sprintf("query returns more than %d rows (reader.max_rows_to_read), please narrow the matchers or time range", l.maxRows)}
+	}
+
+	return nil
+}
+
+// limitErrorOf returns a queryLimitError for the exceptions of clickhouse raised by the limits in settings,
+// the others are returned as they are
+func limitErrorOf(err error) error {
+
+	var ex *clickhouse.Exception
+	if !errors.As(err, &ex) {
+		return err
+	}
+
+	switch ex.Code {
+		case 158, 396:		// TOO_MANY_ROWS, TOO_MANY_ROWS_OR_BYTES
+			return &queryLimitError{fmt.Sprintf("query reads too many rows (reader.max_rows_to_read), please narrow the matchers or time range: %s", ex.Message)}
+	}
+
+	return err
+}
+
+// checkSeries checks the num of series of a request
+func (l *queryLimits) checkSeries(n int) error {
+	if l.maxSeries > 0 && n > l.maxSeries {
+		return &queryLimitError{fmt.Sprintf("query matches more than %d series (reader.max_series), please narrow the matchers", l.maxSeries)}
+	}
+
+	return nil
+}
+
+type unlimitedKey struct{}
+
+// withoutLimits returns a context to run the queries without the limits of reader, like the ones of export command
+func withoutLimits(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unlimitedKey{}, true)
+}
+
+// limitsOf returns the limits of the queries run in ctx
+func limitsOf(ctx context.Context, limits *queryLimits) *queryLimits {
+	if unlimited, _ := ctx.Value(unlimitedKey{}).(bool); unlimited {
+		return &queryLimits{}
+	}
+
+	return limits
+}
@@ -0,0 +1,49 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+func TestLimitErrorOf(t *testing.T) {
+
+	cases := []struct {
+		err   error
+		limit bool
+	}{
+		{&clickhouse.Exception{Code: 158, Name: "DB::Exception", Message: "Limit for rows (controlled by 'max_rows_to_read' setting) exceeded"}, true},
+		{&clickhouse.Exception{Code: 396, Name: "DB::Exception", Message: "Limit for result exceeded"}, true},
+		{fmt.Errorf("read rows: %w", &clickhouse.Exception{Code: 158}), true},
+		{&clickhouse.Exception{Code: 60, Name: "DB::Exception", Message: "Table prometheus.none doesn't exist"}, false},
+		{context.Canceled, false},
+	}
+
+	for _, c := range cases {
+		_, ok := limitErrorOf(c.err).(*queryLimitError)
+		if ok != c.limit {
+			t.Errorf("limitErrorOf(%v) is a queryLimitError: %v, want %v", c.err, ok, c.limit)
+		}
+	}
+
+	if err := limitErrorOf(nil); err != nil {
+		t.Errorf("limitErrorOf(nil) = %v, want nil", err)
+	}
+}
+
+func TestCheckRows(t *testing.T) {
+
+	limits := newQueryLimits(&ReaderCfg{MaxExecutionTime: -1, MaxRowsToRead: 10})
+
+	if err := limits.checkRows(10); err != nil {
+		t.Errorf("checkRows(10) = %v, want nil", err)
+	}
+	if _, ok := limits.checkRows(11).(*queryLimitError); !ok {
+		t.Errorf("checkRows(11) is not a queryLimitError")
+	}
+	if len(limits.settings) != 1 || limits.settings[0] != "max_rows_to_read = 10" {
+		t.Errorf("settings = %v, want [max_rows_to_read = 10]", limits.settings)
+	}
+}
@@ -35,6 +35,9 @@ func getLogWriter(path string) zapcore.WriteSyncer {
 
 var slog *zap.SugaredLogger
 
+// slowLog writes the slow queries of reader to a separate file
+var slowLog *zap.SugaredLogger
+
 func GetLog() *zap.SugaredLogger{
 	return slog
 }
@@ -86,4 +89,7 @@ func initLogger() {
 
 	defer logger.Sync() 		// flushes buffer, if any
 	slog = logger.Sugar()
+
+	slowPath := Cfg.Logger.Dir + "/" + hostname + "_prom_to_click_slow.log"
+	slowLog   = zap.New(zapcore.NewCore(getEncoder(), getLogWriter(slowPath), zapcore.InfoLevel)).Sugar()
 }
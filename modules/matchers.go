@@ -0,0 +1,146 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// sqlEscaper escapes the chars which can end or break a string literal of clickhouse,
+// see https://clickhouse.com/docs/en/sql-reference/syntax#string
+var sqlEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`)
+
+// sqlString returns s as a quoted string literal of clickhouse, all the values from requests must be passed to sql by it
+func sqlString(s string) string {
+	return "'" + sqlEscaper.Replace(s) + "'"
+}
+
+// sqlStrings returns the list of ss as string literals, like 'a', 'b'
+func sqlStrings(ss []string) string {
+
+	quoted := make([]string, 0, len(ss))
+	for _, s := range ss {
+		quoted = append(quoted, sqlString(s))
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// sqlIdentRegexp is the names of databases and tables accepted from requests, the others are rejected instead of escaped
+var sqlIdentRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkDbTable checks the db and table from requests before they are passed to sql by sqlTable
+func checkDbTable(db string, table string) error {
+	if !sqlIdentRegexp.MatchString(db) || !sqlIdentRegexp.MatchString(table) {
+		return fmt.Errorf("invalid dbName '%s' or tbName '%s', they should match %s", db, table, sqlIdentRegexp)
+	}
+
+	return nil
+}
+
+// sqlTable returns db.table quoted as identifiers of clickhouse, they must be checked by checkDbTable first
+func sqlTable(db string, table string) string {
+	return "`" + db + "`.`" + table + "`"
+}
+
+// compileMatchers compiles the label matchers of a query to the wheres of sql, for the tables with
+// columns name (the metric name) and tags (the labels in <key>=<value> format), they are the same in all modes,
+// the results are the same as the matchers of prometheus:
+//   1. a missing label is the same as a label with empty value, so label="" selects the series without it
+//   2. the regexps are fully anchored, foo=~"bar" means foo=~"^(?:bar)$"
+func compileMatchers(matchers []*remote.LabelMatcher) []string {
+
+	var wheres []string
+
+	for _, m := range matchers {
+		if where := compileMatcher(m); where != "" {
+			wheres = append(wheres, where)
+		}
+	}
+
+	return wheres
+}
+
+// anchoredRegexp returns the regexp of a matcher anchored like prometheus
+func anchoredRegexp(val string) string {
+	return "^(?:" + val + ")$"
+}
+
+// matchesEmpty returns whether the regexp of a matcher matches the empty value, i.e. the series without the label,
+// if the regexp is invalid, false is returned and the error is left to clickhouse
+func matchesEmpty(val string) bool {
+	re, err := regexp.Compile(anchoredRegexp(val))
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString("")
+}
+
+// selectsMissing returns whether a matcher on a label (not __name__) selects the series without the label,
+// a missing label is the same as the empty value like prometheus
+func selectsMissing(m *remote.LabelMatcher) bool {
+	switch m.Type {
+	case remote.MatchType_EQUAL         : return m.Value == ""
+	case remote.MatchType_NOT_EQUAL     : return m.Value != ""
+	case remote.MatchType_REGEX_MATCH   : return matchesEmpty(m.Value)
+	case remote.MatchType_REGEX_NO_MATCH: return !matchesEmpty(m.Value)
+	}
+
+	return false
+}
+
+func compileMatcher(m *remote.LabelMatcher) string {
+
+	// __name__ is handled specially - match it directly
+	// as it is stored in the name column (it's also in tags as __name__), and it's never empty
+	if m.Name == model.MetricNameLabel {
+		switch m.Type {
+		case remote.MatchType_EQUAL         : return fmt.Sprintf("name = %s", sqlString(m.Value))
+		case remote.MatchType_NOT_EQUAL     : return fmt.Sprintf("name != %s", sqlString(m.Value))
+		case remote.MatchType_REGEX_MATCH   : return fmt.Sprintf("match(name, %s) = 1", sqlString(anchoredRegexp(m.Value)))
+		case remote.MatchType_REGEX_NO_MATCH: return fmt.Sprintf("match(name, %s) = 0", sqlString(anchoredRegexp(m.Value)))
+		}
+		return ""
+	}
+
+	// the tags of the label, a tag with empty value (<key>=) is the same as missing, see makeLabels
+	prefix  := m.Name + "="
+	present := fmt.Sprintf("startsWith(x, %s) AND x != %s", sqlString(prefix), sqlString(prefix))
+	value   := fmt.Sprintf("substring(x, %d)", len(prefix) + 1)
+
+	switch m.Type {
+	case remote.MatchType_EQUAL:
+		if selectsMissing(m) {
+			return fmt.Sprintf("arrayExists(x -> %s, tags) = 0", present)
+		}
+		return fmt.Sprintf("has(tags, %s) = 1", sqlString(prefix + m.Value))
+
+	case remote.MatchType_NOT_EQUAL:
+		if !selectsMissing(m) {
+			return fmt.Sprintf("arrayExists(x -> %s, tags) = 1", present)
+		}
+		return fmt.Sprintf("has(tags, %s) = 0", sqlString(prefix + m.Value))
+
+	case remote.MatchType_REGEX_MATCH:
+		re := sqlString(anchoredRegexp(m.Value))
+		if selectsMissing(m) {
+			// missing, or the value matches
+			return fmt.Sprintf("arrayExists(x -> %s AND match(%s, %s) = 0, tags) = 0", present, value, re)
+		}
+		return fmt.Sprintf("arrayExists(x -> %s AND match(%s, %s) = 1, tags) = 1", present, value, re)
+
+	case remote.MatchType_REGEX_NO_MATCH:
+		re := sqlString(anchoredRegexp(m.Value))
+		if !selectsMissing(m) {
+			// must be present, and the value not matches
+			return fmt.Sprintf("arrayExists(x -> %s AND match(%s, %s) = 0, tags) = 1", present, value, re)
+		}
+		return fmt.Sprintf("arrayExists(x -> %s AND match(%s, %s) = 1, tags) = 0", present, value, re)
+	}
+
+	return ""
+}
@@ -0,0 +1,384 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func TestSqlString(t *testing.T) {
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"up"          , `'up'`},
+		{""            , `''`},
+		{"it's"        , `'it\'s'`},
+		{`a\b`         , `'a\\b'`},
+		{`\'`          , `'\\\''`},
+		{"a\nb"        , `'a\nb'`},
+		{"a\rb"        , `'a\rb'`},
+		{"a\x00b"      , `'a\0b'`},
+		{"x' OR 1 = 1 --", `'x\' OR 1 = 1 --'`},
+	}
+
+	for _, c := range cases {
+		if got := sqlString(c.in); got != c.want {
+			t.Errorf("sqlString(%q) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestCompileMatcher(t *testing.T) {
+
+	cases := []struct {
+		name  string
+		typ   remote.MatchType
+		value string
+		want  string
+	}{
+		// __name__ is matched on the name column
+		{"__name__", remote.MatchType_EQUAL         , "up"   , `name = 'up'`},
+		{"__name__", remote.MatchType_NOT_EQUAL     , "up"   , `name != 'up'`},
+		{"__name__", remote.MatchType_REGEX_MATCH   , "up|go", `match(name, '^(?:up|go)$') = 1`},
+		{"__name__", remote.MatchType_REGEX_NO_MATCH, "up|go", `match(name, '^(?:up|go)$') = 0`},
+
+		// the other labels are matched on tags
+		{"job", remote.MatchType_EQUAL         , "api"    , `has(tags, 'job=api') = 1`},
+		{"job", remote.MatchType_NOT_EQUAL     , "api"    , `has(tags, 'job=api') = 0`},
+		{"job", remote.MatchType_REGEX_MATCH   , "api|web", `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=' AND match(substring(x, 5), '^(?:api|web)$') = 1, tags) = 1`},
+		{"job", remote.MatchType_REGEX_NO_MATCH, "api|web", `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=' AND match(substring(x, 5), '^(?:api|web)$') = 1, tags) = 0`},
+
+		// the empty value is the same as missing
+		{"job", remote.MatchType_EQUAL         , ""       , `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=', tags) = 0`},
+		{"job", remote.MatchType_NOT_EQUAL     , ""       , `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=', tags) = 1`},
+		{"job", remote.MatchType_REGEX_MATCH   , "api|"   , `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=' AND match(substring(x, 5), '^(?:api|)$') = 0, tags) = 0`},
+		{"job", remote.MatchType_REGEX_NO_MATCH, "api|"   , `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=' AND match(substring(x, 5), '^(?:api|)$') = 0, tags) = 1`},
+
+		// the names and values are escaped
+		{"__name__", remote.MatchType_EQUAL      , "it's"   , `name = 'it\'s'`},
+		{"__name__", remote.MatchType_REGEX_MATCH, `a\.b`   , `match(name, '^(?:a\\.b)$') = 1`},
+		{"job"     , remote.MatchType_EQUAL      , "it's"   , `has(tags, 'job=it\'s') = 1`},
+		{"job"     , remote.MatchType_EQUAL      , `a\b`    , `has(tags, 'job=a\\b') = 1`},
+		{"job"     , remote.MatchType_EQUAL      , "a\nb"   , `has(tags, 'job=a\nb') = 1`},
+		{"job"     , remote.MatchType_EQUAL      , "a\x00b" , `has(tags, 'job=a\0b') = 1`},
+		{"job"     , remote.MatchType_NOT_EQUAL  , "x') OR (1 = 1", `has(tags, 'job=x\') OR (1 = 1') = 0`},
+		{"jo'b"    , remote.MatchType_EQUAL      , "api"    , `has(tags, 'jo\'b=api') = 1`},
+		{`jo\b`    , remote.MatchType_NOT_EQUAL  , "api"    , `has(tags, 'jo\\b=api') = 0`},
+		{"jo\nb"   , remote.MatchType_EQUAL      , ""       , `arrayExists(x -> startsWith(x, 'jo\nb=') AND x != 'jo\nb=', tags) = 0`},
+		{"jo\x00b" , remote.MatchType_REGEX_MATCH, "a'|b"   , `arrayExists(x -> startsWith(x, 'jo\0b=') AND x != 'jo\0b=' AND match(substring(x, 6), '^(?:a\'|b)$') = 1, tags) = 1`},
+	}
+
+	for _, c := range cases {
+		m := &remote.LabelMatcher{Name: c.name, Type: c.typ, Value: c.value}
+		if got := compileMatcher(m); got != c.want {
+			t.Errorf("compileMatcher(%s %s %q):\n got: %s\nwant: %s", c.name, c.typ, c.value, got, c.want)
+		}
+	}
+}
+
+func TestCompileMatchers(t *testing.T) {
+
+	matchers := []*remote.LabelMatcher{
+		{Name: "__name__", Type: remote.MatchType_EQUAL    , Value: "up"},
+		{Name: "job"     , Type: remote.MatchType_NOT_EQUAL, Value: "api"},
+		{Name: "job"     , Type: remote.MatchType(99)      , Value: "api"},		// unknown types are skipped
+	}
+
+	wheres := compileMatchers(matchers)
+
+	want := []string{`name = 'up'`, `has(tags, 'job=api') = 0`}
+	if len(wheres) != len(want) {
+		t.Fatalf("compileMatchers returns %d wheres, want %d: %v", len(wheres), len(want), wheres)
+	}
+	for i := range want {
+		if wheres[i] != want[i] {
+			t.Errorf("wheres[%d] = %s, want %s", i, wheres[i], want[i])
+		}
+	}
+}
+
+// TestMatchLikePrometheus checks the decisions of compileMatcher against the matchers of prometheus:
+// a series without the label is selected by selectsMissing, and a value is matched by the fully anchored regexp
+func TestMatchLikePrometheus(t *testing.T) {
+
+	types := map[remote.MatchType]metric.MatchType{
+		remote.MatchType_EQUAL         : metric.Equal,
+		remote.MatchType_NOT_EQUAL     : metric.NotEqual,
+		remote.MatchType_REGEX_MATCH   : metric.RegexMatch,
+		remote.MatchType_REGEX_NO_MATCH: metric.RegexNoMatch,
+	}
+
+	cases := []struct {
+		typ   remote.MatchType
+		value string
+	}{
+		{remote.MatchType_EQUAL         , ""},
+		{remote.MatchType_EQUAL         , "foo"},
+		{remote.MatchType_NOT_EQUAL     , ""},
+		{remote.MatchType_NOT_EQUAL     , "foo"},
+		{remote.MatchType_REGEX_MATCH   , ".*"},
+		{remote.MatchType_REGEX_MATCH   , ".+"},
+		{remote.MatchType_REGEX_MATCH   , ""},
+		{remote.MatchType_REGEX_MATCH   , "foo"},
+		{remote.MatchType_REGEX_MATCH   , "foo|"},
+		{remote.MatchType_REGEX_MATCH   , "foo|bar"},
+		{remote.MatchType_REGEX_MATCH   , "fo+|ba?r"},
+		{remote.MatchType_REGEX_MATCH   , "f.*"},
+		{remote.MatchType_REGEX_MATCH   , "(foo)?"},
+		{remote.MatchType_REGEX_NO_MATCH, ".*"},
+		{remote.MatchType_REGEX_NO_MATCH, ".+"},
+		{remote.MatchType_REGEX_NO_MATCH, ""},
+		{remote.MatchType_REGEX_NO_MATCH, "foo"},
+		{remote.MatchType_REGEX_NO_MATCH, "foo|"},
+		{remote.MatchType_REGEX_NO_MATCH, "foo|bar"},
+		{remote.MatchType_REGEX_NO_MATCH, "f.*"},
+	}
+
+	// the values of the label in series, the empty one is the same as missing
+	values := []string{"", "foo", "bar", "foobar", "barfoo", "xfoo", "fo", "fooo", "br", "f"}
+
+	for _, c := range cases {
+		m := &remote.LabelMatcher{Name: "job", Type: c.typ, Value: c.value}
+
+		pm, err := metric.NewLabelMatcher(types[c.typ], "job", model.LabelValue(c.value))
+		if err != nil {
+			t.Fatalf("prometheus matcher of %s%q: %s", c.typ, c.value, err)
+		}
+
+		if got, want := selectsMissing(m), pm.Match(""); got != want {
+			t.Errorf("job%s%q: selects the series without the label: %v, prometheus: %v", pm.Type, c.value, got, want)
+		}
+
+		re := regexp.MustCompile(anchoredRegexp(c.value))
+		for _, v := range values[1:] {
+			var got bool
+			switch c.typ {
+			case remote.MatchType_EQUAL         : got = v == c.value
+			case remote.MatchType_NOT_EQUAL     : got = v != c.value
+			case remote.MatchType_REGEX_MATCH   : got = re.MatchString(v)
+			case remote.MatchType_REGEX_NO_MATCH: got = !re.MatchString(v)
+			}
+			if want := pm.Match(model.LabelValue(v)); got != want {
+				t.Errorf("job%s%q: selects job=%q: %v, prometheus: %v", pm.Type, c.value, v, got, want)
+			}
+		}
+	}
+}
+
+func TestCompileMatcherEmpty(t *testing.T) {
+
+	cases := []struct {
+		typ   remote.MatchType
+		value string
+		want  string
+	}{
+		// .* matches all, including the series without the label
+		{remote.MatchType_REGEX_MATCH   , ".*"   , `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=' AND match(substring(x, 5), '^(?:.*)$') = 0, tags) = 0`},
+		// "" matches the series without the label only
+		{remote.MatchType_REGEX_MATCH   , ""     , `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=' AND match(substring(x, 5), '^(?:)$') = 0, tags) = 0`},
+		// foo| matches the empty value, so the negation requires the label
+		{remote.MatchType_REGEX_NO_MATCH, "foo|" , `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=' AND match(substring(x, 5), '^(?:foo|)$') = 0, tags) = 1`},
+		// the alternations are anchored as a whole
+		{remote.MatchType_REGEX_MATCH   , "a|b.*", `arrayExists(x -> startsWith(x, 'job=') AND x != 'job=' AND match(substring(x, 5), '^(?:a|b.*)$') = 1, tags) = 1`},
+	}
+
+	for _, c := range cases {
+		m := &remote.LabelMatcher{Name: "job", Type: c.typ, Value: c.value}
+		if got := compileMatcher(m); got != c.want {
+			t.Errorf("compileMatcher(job %s %q):\n got: %s\nwant: %s", c.typ, c.value, got, c.want)
+		}
+	}
+}
+
+func TestCheckDbTable(t *testing.T) {
+
+	cases := []struct {
+		db    string
+		table string
+		ok    bool
+	}{
+		{"prometheus", "samples"     , true},
+		{"_db"       , "Samples_2020", true},
+		{""          , "samples"     , false},
+		{"prometheus", ""            , false},
+		{"1db"       , "samples"     , false},
+		{"prometheus", "samples-1"   , false},
+		{"prometheus", "a.b"         , false},
+		{"prometheus", "x` WHERE 1"  , false},
+		{"prometheus", "x'"          , false},
+		{"db\n"      , "samples"     , false},
+	}
+
+	for _, c := range cases {
+		if err := checkDbTable(c.db, c.table); (err == nil) != c.ok {
+			t.Errorf("checkDbTable(%q, %q) returns %v, want ok: %v", c.db, c.table, err, c.ok)
+		}
+	}
+
+	if got, want := sqlTable("prometheus", "samples_metrics"), "`prometheus`.`samples_metrics`"; got != want {
+		t.Errorf("sqlTable = %s, want %s", got, want)
+	}
+}
+
+// sqlMatcherForms are the forms of the wheres compiled by compileMatcher, to evaluate them like clickhouse
+var (
+	sqlNameEqual    = regexp.MustCompile(`^name (=|!=) ('.*')$`)
+	sqlNameMatch    = regexp.MustCompile(`^match\(name, ('.*')\) = ([01])$`)
+	sqlHasTag       = regexp.MustCompile(`^has\(tags, ('.*')\) = ([01])$`)
+	sqlTagExists    = regexp.MustCompile(`^arrayExists\(x -> startsWith\(x, ('.*')\) AND x != ('.*')(?: AND match\(substring\(x, (\d+)\), ('.*')\) = ([01]))?, tags\) = ([01])$`)
+	sqlUnescaper    = strings.NewReplacer(`\\`, `\`, `\'`, `'`, `\0`, "\x00", `\n`, "\n", `\r`, "\r")
+)
+
+// unquote returns the value of a string literal made by sqlString
+func unquote(t *testing.T, lit string) string {
+	if len(lit) < 2 || lit[0] != '\'' || lit[len(lit) - 1] != '\'' {
+		t.Fatalf("invalid string literal %s", lit)
+	}
+
+	return sqlUnescaper.Replace(lit[1 : len(lit) - 1])
+}
+
+// evalWhere evaluates a where of compileMatcher on a row of name and tags like clickhouse,
+// match() of clickhouse is re2, which is the same syntax as regexp of go
+func evalWhere(t *testing.T, where string, name string, tags []string) bool {
+
+	bit := func(s string) bool { return s == "1" }
+	match := func(lit string, s string) bool {
+		return regexp.MustCompile(unquote(t, lit)).MatchString(s)
+	}
+
+	if m := sqlNameEqual.FindStringSubmatch(where); m != nil {
+		return (name == unquote(t, m[2])) == (m[1] == "=")
+	}
+	if m := sqlNameMatch.FindStringSubmatch(where); m != nil {
+		return match(m[1], name) == bit(m[2])
+	}
+	if m := sqlHasTag.FindStringSubmatch(where); m != nil {
+		has := false
+		for _, tag := range tags {
+			has = has || tag == unquote(t, m[1])
+		}
+		return has == bit(m[2])
+	}
+	if m := sqlTagExists.FindStringSubmatch(where); m != nil {
+		prefix, empty := unquote(t, m[1]), unquote(t, m[2])
+		exists := false
+		for _, x := range tags {
+			ok := strings.HasPrefix(x, prefix) && x != empty
+			if ok && m[3] != "" {
+				from, _ := strconv.Atoi(m[3])
+				ok = match(m[4], x[from - 1:]) == bit(m[5])		// substring of clickhouse is 1-based
+			}
+			exists = exists || ok
+		}
+		return exists == bit(m[6])
+	}
+
+	t.Fatalf("unknown where: %s", where)
+	return false
+}
+
+// TestCompiledMatchersLikePrometheus evaluates the compiled sqls and the matchers of prometheus on the same series,
+// every query (a matcher or a pair of them) must select the same series
+func TestCompiledMatchersLikePrometheus(t *testing.T) {
+
+	// the series are stored like writer, tags has all the labels in <key>=<value> format, including __name__
+	series := []map[string]string{
+		{"__name__": "up"},
+		{"__name__": "up", "job": "api"},
+		{"__name__": "up", "job": "web"},
+		{"__name__": "up", "job": "api", "env": "prod"},
+		{"__name__": "up", "job": "foo|bar"},
+		{"__name__": "up", "job": "it's"},
+		{"__name__": "up", "job": `a\b`},
+		{"__name__": "up", "job": "a\nb"},
+		{"__name__": "up", "jobs": "api"},
+		{"__name__": "go_goroutines", "job": "api"},
+		{"__name__": "go_goroutines", "job": "apiserver"},
+		{"__name__": "go_goroutines", "env": "prod"},
+		{"__name__": "go_threads", "job": "xapi"},
+	}
+
+	types := map[remote.MatchType]metric.MatchType{
+		remote.MatchType_EQUAL         : metric.Equal,
+		remote.MatchType_NOT_EQUAL     : metric.NotEqual,
+		remote.MatchType_REGEX_MATCH   : metric.RegexMatch,
+		remote.MatchType_REGEX_NO_MATCH: metric.RegexNoMatch,
+	}
+
+	var matchers []*remote.LabelMatcher
+	for _, name := range []string{"__name__", "job", "env"} {
+		for _, value := range []string{"", "up", "api", "prod", ".*", ".+", "api|", "api|web", "a.*", "go_.*", "foo|bar", "it's", `a\\b`, "a\nb", "(api)?"} {
+			for typ := range types {
+				if (typ == remote.MatchType_EQUAL || typ == remote.MatchType_NOT_EQUAL) && strings.ContainsAny(value, "*+|?()\\") {
+					continue
+				}
+				if typ != remote.MatchType_EQUAL && typ != remote.MatchType_NOT_EQUAL && value == "it's" {
+					continue
+				}
+				matchers = append(matchers, &remote.LabelMatcher{Name: name, Type: typ, Value: value})
+			}
+		}
+	}
+
+	// a query of one or two matchers
+	var queries [][]*remote.LabelMatcher
+	for i, m := range matchers {
+		queries = append(queries, []*remote.LabelMatcher{m})
+		if i % 7 == 0 {
+			for _, n := range matchers {
+				queries = append(queries, []*remote.LabelMatcher{m, n})
+			}
+		}
+	}
+
+	for _, query := range queries {
+		var pms []*metric.LabelMatcher
+		for _, m := range query {
+			pm, err := metric.NewLabelMatcher(types[m.Type], model.LabelName(m.Name), model.LabelValue(m.Value))
+			if err != nil {
+				t.Fatalf("prometheus matcher %s%s%q: %s", m.Name, m.Type, m.Value, err)
+			}
+			pms = append(pms, pm)
+		}
+		wheres := compileMatchers(query)
+
+		for _, labels := range series {
+			var tags []string
+			for k, v := range labels {
+				tags = append(tags, k + "=" + v)
+			}
+
+			want := true
+			for _, pm := range pms {
+				want = want && pm.Match(model.LabelValue(labels[string(pm.Name)]))
+			}
+			got := true
+			for _, where := range wheres {
+				got = got && evalWhere(t, where, labels["__name__"], tags)
+			}
+
+			if got != want {
+				t.Errorf("%s on %v: selected by sql: %v, by prometheus: %v\n  sql: %s", queryString(query), labels, got, want, strings.Join(wheres, " AND "))
+			}
+		}
+	}
+}
+
+func queryString(query []*remote.LabelMatcher) string {
+	var out []string
+	for _, m := range query {
+		op := map[remote.MatchType]string{remote.MatchType_EQUAL: "=", remote.MatchType_NOT_EQUAL: "!=", remote.MatchType_REGEX_MATCH: "=~", remote.MatchType_REGEX_NO_MATCH: "!~"}[m.Type]
+		out = append(out, fmt.Sprintf("%s%s%q", m.Name, op, m.Value))
+	}
+
+	return "{" + strings.Join(out, ", ") + "}"
+}
@@ -0,0 +1,131 @@
+package modules
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// the metrics of writer and reader, labelled by server (the name of clickhouse in config), db and table,
+// the metrics of fingerprint cache are in fingerprint_cache.go
+var (
+	writeReceivedSamples = prometheus.NewCounterVec  (prometheus.CounterOpts  {Name: "write_received_samples_total", Help: "Total number of samples received by writer."}, []string{"server", "db", "table"})
+	writeSamples         = prometheus.NewCounterVec  (prometheus.CounterOpts  {Name: "write_samples_total"         , Help: "Total number of samples written to clickhouse."}, []string{"server", "db", "table"})
+	writeFailedSamples   = prometheus.NewCounterVec  (prometheus.CounterOpts  {Name: "write_failed_samples_total"  , Help: "Total number of rows in the batches failed to write to clickhouse, the batches are kept and retried."}, []string{"server", "db", "table"})
+	writeDroppedSamples  = prometheus.NewCounterVec  (prometheus.CounterOpts  {Name: "write_dropped_samples_total" , Help: "Total number of samples dropped by writer, by reason."}, []string{"server", "db", "table", "reason"})
+	writeDroppedRows     = prometheus.NewCounterVec  (prometheus.CounterOpts  {Name: "write_dropped_rows_total"    , Help: "Total number of the rows of metrics and labels dropped by writer, by kind and reason, the series will be written again with the next samples."}, []string{"server", "db", "table", "kind", "reason"})
+	writeBatchSize       = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "write_batch_size"            , Help: "Number of rows in the batches written to clickhouse, kind is samples, metrics or labels.", Buckets: prometheus.ExponentialBuckets(16, 4, 8)}, []string{"server", "db", "table", "kind"})
+	writeBatchDuration   = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "write_batch_duration_seconds", Help: "Duration of inserting a batch to clickhouse, kind is samples, metrics or labels.", Buckets: prometheus.DefBuckets}, []string{"server", "db", "table", "kind"})
+	readQueryDuration    = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "read_query_duration_seconds" , Help: "Duration of the queries to clickhouse by reader, mode is the mode of reader.", Buckets: prometheus.DefBuckets}, []string{"server", "db", "table", "mode"})
+	readQueryRows        = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "read_query_rows"             , Help: "Number of rows read from clickhouse per query by reader.", Buckets: prometheus.ExponentialBuckets(1, 4, 12)}, []string{"server", "db", "table", "mode"})
+)
+
+// the reasons of write_dropped_samples_total and write_dropped_rows_total
+const (
+	dropNoOutput   = "no_output"		// the db.table of request is invalid, or writer is stopping
+	dropExecFailed = "exec_failed"		// the row is rejected by clickhouse in a batch
+	dropStopped    = "stopped"			// the batch can not be written when writer stops
+)
+
+func init() {
+	prometheus.MustRegister(writeReceivedSamples)
+	prometheus.MustRegister(writeSamples)
+	prometheus.MustRegister(writeFailedSamples)
+	prometheus.MustRegister(writeDroppedSamples)
+	prometheus.MustRegister(writeDroppedRows)
+	prometheus.MustRegister(writeBatchSize)
+	prometheus.MustRegister(writeBatchDuration)
+	prometheus.MustRegister(readQueryDuration)
+	prometheus.MustRegister(readQueryRows)
+}
+
+// writeMetrics is the metrics of an output of writer
+type writeMetrics struct {
+	server   string
+	db       string
+	table    string
+	received prometheus.Counter
+	written  prometheus.Counter
+	failed   prometheus.Counter
+}
+
+func newWriteMetrics(server string, db string, table string) *writeMetrics {
+	return &writeMetrics{
+		server  : server,
+		db      : db,
+		table   : table,
+		received: writeReceivedSamples.WithLabelValues(server, db, table),
+		written : writeSamples        .WithLabelValues(server, db, table),
+		failed  : writeFailedSamples  .WithLabelValues(server, db, table),
+	}
+}
+
+func (m *writeMetrics) dropped(reason string, n int) {
+	writeDroppedSamples.WithLabelValues(m.server, m.db, m.table, reason).Add(float64(n))
+}
+
+// droppedRows records n rows of kind (metrics or labels) dropped by reason
+func (m *writeMetrics) droppedRows(kind string, reason string, n int) {
+	writeDroppedRows.WithLabelValues(m.server, m.db, m.table, kind, reason).Add(float64(n))
+}
+
+// batch records a batch of kind written in cost
+func (m *writeMetrics) batch(kind string, rows int, cost time.Duration) {
+	writeBatchSize    .WithLabelValues(m.server, m.db, m.table, kind).Observe(float64(rows))
+	writeBatchDuration.WithLabelValues(m.server, m.db, m.table, kind).Observe(cost.Seconds())
+}
+
+// observeQuery records a query to clickhouse by reader
+func observeQuery(server string, db string, table string, mode int, rows int64, cost time.Duration) {
+	m := strconv.Itoa(mode)
+	readQueryDuration.WithLabelValues(server, db, table, m).Observe(cost.Seconds())
+	readQueryRows    .WithLabelValues(server, db, table, m).Observe(float64(rows))
+}
+
+// outputsCollector collects the queue length of the outputs of writer when scraped,
+// the outputs are created and stopped on the fly, so they are not kept in vecs
+type outputsCollector struct {
+	server   string
+	outputs  *outputRegistry
+	queue    *prometheus.Desc
+	capacity *prometheus.Desc
+	pending  *prometheus.Desc
+}
+
+func newOutputsCollector(server string, outputs *outputRegistry) *outputsCollector {
+	labels := []string{"server", "db", "table"}
+
+	return &outputsCollector{
+		server  : server,
+		outputs : outputs,
+		queue   : prometheus.NewDesc("write_queue_length"  , "Number of items waiting in the inputs of writer output.", labels, nil),
+		capacity: prometheus.NewDesc("write_queue_capacity", "Buffer size of the inputs of writer output.", labels, nil),
+		pending : prometheus.NewDesc("write_pending_rows"  , "Number of rows in the batches of writer output waiting to be written.", labels, nil),
+	}
+}
+
+func (c *outputsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queue
+	ch <- c.capacity
+	ch <- c.pending
+}
+
+func (c *outputsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, st := range c.outputs.Statuses() {
+		ch <- prometheus.MustNewConstMetric(c.queue   , prometheus.GaugeValue, float64(st.Queue)   , c.server, st.Db, st.Table)
+		ch <- prometheus.MustNewConstMetric(c.capacity, prometheus.GaugeValue, float64(st.Capacity), c.server, st.Db, st.Table)
+		ch <- prometheus.MustNewConstMetric(c.pending , prometheus.GaugeValue, float64(st.Pending) , c.server, st.Db, st.Table)
+	}
+}
+
+// countSamples returns the num of samples in a write request
+func countSamples(req *remote.WriteRequest) int {
+	n := 0
+	for _, series := range req.Timeseries {
+		n += len(series.Samples)
+	}
+
+	return n
+}
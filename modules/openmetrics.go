@@ -0,0 +1,196 @@
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// openMetricsParser parses the samples from an openmetrics text exposition line by line,
+// only the sample lines are handled, the metadata lines like '# TYPE' and '# HELP' are ignored,
+// note: in openmetrics, the timestamps are in seconds, not milliseconds like the prometheus text format
+type openMetricsParser struct {
+	scanner *bufio.Scanner
+	lineNo  int
+	eof     bool
+}
+
+func newOpenMetricsParser(r io.Reader) *openMetricsParser {
+	out := new(openMetricsParser)
+
+	out.scanner = bufio.NewScanner(r)
+	out.scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+
+	return out
+}
+
+// Next returns the next sample with its labels, the samples without timestamp will be rejected,
+// io.EOF will be returned if no more samples
+func (p *openMetricsParser) Next() ([]*remote.LabelPair, *remote.Sample, error) {
+
+	for !p.eof && p.scanner.Scan() {
+		p.lineNo++
+
+		line := strings.TrimSpace(p.scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			if line == "# EOF" {
+				p.eof = true
+			}
+			continue
+		}
+
+		labels, sample, err := p.parseLine(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", p.lineNo, err)
+		}
+
+		return labels, sample, nil
+	}
+
+	if err := p.scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return nil, nil, io.EOF
+}
+
+// parseLine parses a line like: name{label="value",...} value timestamp [# exemplar]
+func (p *openMetricsParser) parseLine(line string) ([]*remote.LabelPair, *remote.Sample, error) {
+
+	i := 0
+	for i < len(line) && isMetricNameChar(line[i], i == 0) {
+		i++
+	}
+	if i == 0 {
+		return nil, nil, fmt.Errorf("invalid metric name")
+	}
+
+	labels := []*remote.LabelPair{{Name: "__name__", Value: line[:i]}}
+	rest   := line[i:]
+
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		labels, rest, err = parseLabels(labels, rest[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// drop the exemplar
+	if idx := strings.Index(rest, " # "); idx >= 0 {
+		rest = rest[:idx]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 1 {
+		return nil, nil, fmt.Errorf("sample without timestamp")
+	}
+	if len(fields) != 2 {
+		return nil, nil, fmt.Errorf("invalid sample '%s'", rest)
+	}
+
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid value '%s'", fields[0])
+	}
+	ts, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid timestamp '%s'", fields[1])
+	}
+
+	sample := &remote.Sample{
+		Value      : value,
+		TimestampMs: int64(math.Round(ts * 1000)),
+	}
+
+	return labels, sample, nil
+}
+
+func parseLabels(labels []*remote.LabelPair, s string) ([]*remote.LabelPair, string, error) {
+
+	for {
+		s = strings.TrimLeft(s, " ")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+
+		i := 0
+		for i < len(s) && isMetricNameChar(s[i], i == 0) && s[i] != ':' {
+			i++
+		}
+		if i == 0 {
+			return nil, "", fmt.Errorf("invalid label name")
+		}
+		name := s[:i]
+
+		s = strings.TrimLeft(s[i:], " ")
+		if !strings.HasPrefix(s, `="`) {
+			return nil, "", fmt.Errorf("expected '=\"' after label name '%s'", name)
+		}
+		s = s[2:]
+
+		var (
+			value   strings.Builder
+			escaped bool
+			closed  bool
+		)
+		for i = 0; i < len(s); i++ {
+			c := s[i]
+			if escaped {
+				switch c {
+					case 'n' : value.WriteByte('\n')
+					default  : value.WriteByte(c)
+				}
+				escaped = false
+				continue
+			}
+			if c == '\\' {
+				escaped = true
+				continue
+			}
+			if c == '"' {
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated value of label '%s'", name)
+		}
+		s = strings.TrimLeft(s[i + 1:], " ")
+
+		labels = append(labels, &remote.LabelPair{Name: name, Value: value.String()})
+
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", fmt.Errorf("expected ',' or '}' after value of label '%s'", name)
+		}
+	}
+}
+
+func isMetricNameChar(c byte, first bool) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' {
+		return true
+	}
+
+	return !first && c >= '0' && c <= '9'
+}
+
+func parseFloat(s string) (float64, error) {
+	switch s {
+		case "+Inf", "Inf": return math.Inf(1), nil
+		case "-Inf"       : return math.Inf(-1), nil
+		case "NaN"        : return math.NaN(), nil
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
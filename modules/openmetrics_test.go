@@ -0,0 +1,102 @@
+package modules
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestOpenMetricsParser(t *testing.T) {
+
+	text := `# HELP http_requests_total The total of requests.
+# TYPE http_requests_total counter
+
+http_requests_total{code="200",path="/api"} 1027 1588291200
+http_requests_total{ code="500" , path="/a\"b\\c\nd" } 3 1588291200.5
+up 1 1588291215 # {trace_id="abc"} 1 1588291215
+temp{room="x"} -Inf 1588291200
+temp{room="y"} NaN 1588291200
+empty{} +Inf 1588291200
+# EOF
+ignored_after_eof 1 1588291200
+`
+
+	type sample struct {
+		labels string
+		value  float64
+		ts     int64
+	}
+	want := []sample{
+		{`__name__=http_requests_total,code=200,path=/api`   , 1027           , 1588291200000},
+		{"__name__=http_requests_total,code=500,path=/a\"b\\c\nd", 3          , 1588291200500},
+		{`__name__=up`                                       , 1              , 1588291215000},
+		{`__name__=temp,room=x`                              , math.Inf(-1)   , 1588291200000},
+		{`__name__=temp,room=y`                              , math.NaN()     , 1588291200000},
+		{`__name__=empty`                                    , math.Inf(1)    , 1588291200000},
+	}
+
+	p := newOpenMetricsParser(strings.NewReader(text))
+	for i, w := range want {
+		labels, s, err := p.Next()
+		if err != nil {
+			t.Fatalf("sample %d: %s", i, err)
+		}
+
+		var pairs []string
+		for _, l := range labels {
+			pairs = append(pairs, l.Name + "=" + l.Value)
+		}
+		if got := strings.Join(pairs, ","); got != w.labels {
+			t.Errorf("sample %d: labels %q, want %q", i, got, w.labels)
+		}
+		if s.TimestampMs != w.ts {
+			t.Errorf("sample %d: timestamp %d, want %d", i, s.TimestampMs, w.ts)
+		}
+		if !(s.Value == w.value || math.IsNaN(s.Value) && math.IsNaN(w.value)) {
+			t.Errorf("sample %d: value %v, want %v", i, s.Value, w.value)
+		}
+	}
+
+	if _, _, err := p.Next(); err != io.EOF {
+		t.Errorf("got %v after # EOF, want io.EOF", err)
+	}
+}
+
+func TestOpenMetricsParserInvalid(t *testing.T) {
+
+	cases := []struct {
+		line string
+		err  string
+	}{
+		{`up 1`                           , "sample without timestamp"},
+		{`up`                             , "invalid sample"},
+		{`up 1 2 3`                       , "invalid sample"},
+		{`up x 1588291200`                , "invalid value"},
+		{`up 1 yesterday`                 , "invalid timestamp"},
+		{`1up 1 1588291200`               , "invalid metric name"},
+		{`{job="api"} 1 1588291200`       , "invalid metric name"},
+		{`up{job} 1 1588291200`           , "expected '=\"'"},
+		{`up{job=api} 1 1588291200`       , "expected '=\"'"},
+		{`up{job="api} 1 1588291200`      , "unterminated value"},
+		{`up{job="api" x="y"} 1 1588291200`, "expected ',' or '}'"},
+		{`up{1a="b"} 1 1588291200`        , "invalid label name"},
+		{`up{a:b="c"} 1 1588291200`       , "expected '=\"'"},
+	}
+
+	for _, c := range cases {
+		p := newOpenMetricsParser(strings.NewReader("up 1 1588291200\n" + c.line + "\n"))
+
+		if _, _, err := p.Next(); err != nil {
+			t.Fatalf("%s: the first line failed: %s", c.line, err)
+		}
+		_, _, err := p.Next()
+		if err == nil {
+			t.Errorf("%s: got no error", c.line)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "line 2: ") || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %q, want 'line 2: %s...'", c.line, err, c.err)
+		}
+	}
+}
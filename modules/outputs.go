@@ -0,0 +1,267 @@
+package modules
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writerOutput is an output of writer for a db.table, it's managed by outputRegistry
+type writerOutput interface {
+	Start()
+	Stop()
+	Status() outputStatus
+}
+
+type outputStatus struct {
+	Db                   string    `json:"db"`
+	Table                string    `json:"table"`
+	Tag                  string    `json:"tag"`
+	Queue                int       `json:"queue"`			// num of items waiting in the inputs
+	Capacity             int       `json:"capacity"`		// the buffer size of inputs
+	Fill                 float64   `json:"fill"`			// percent of queue / capacity
+	Shards               int       `json:"shards"`
+	Pending              int       `json:"pending"`			// num of rows in batches waiting to be written
+	Batch                int       `json:"batch"`
+	LastCommit           time.Time `json:"last_commit"`
+	LastCommitAge        string    `json:"last_commit_age"`
+	FingerprintCacheSize int       `json:"fingerprint_cache_size"`
+	TotalRecv            uint64    `json:"total_recv"`
+	Users                int32     `json:"users"`
+	Created              time.Time `json:"created"`
+	LastUse              time.Time `json:"last_use"`
+}
+
+type registeredOutput struct {
+	output  writerOutput
+	db      string
+	table   string
+	ready   chan struct{}	// closed when the output is created and started
+	users   int32			// atomic, num of users acquired and not released
+	lastUse int64			// atomic, unix nano
+	created time.Time
+}
+
+func (ro *registeredOutput) release() {
+	atomic.StoreInt64(&ro.lastUse, time.Now().UnixNano())
+	atomic.AddInt32(&ro.users, -1)
+}
+
+// outputRegistry holds the outputs of writer by db.table, the outputs are created when first acquired,
+// and stopped when not used in idle timeout, an acquired output will not be stopped until it's released
+type outputRegistry struct {
+	tag         string
+	mu          sync.RWMutex
+	outputs     map[string]*registeredOutput
+	idleTimeout time.Duration		// <= 0 means never
+	create      func(db string, table string) writerOutput
+	stopped     bool
+	quit        chan struct{}
+}
+
+// idleTimeout returns the idle timeout of outputs set in writer config, default 3600 seconds, -1 for never
+func idleTimeout(cfg *WriterCfg) time.Duration {
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = 3600
+	}
+	if cfg.IdleTimeout < 0 {
+		return 0
+	}
+
+	return time.Second * time.Duration(cfg.IdleTimeout)
+}
+
+func newOutputRegistry(tag string, idleTimeout time.Duration, create func(db string, table string) writerOutput) *outputRegistry {
+	out := new(outputRegistry)
+
+	out.tag         = tag
+	out.outputs     = map[string]*registeredOutput{}
+	out.idleTimeout = idleTimeout
+	out.create      = create
+	out.quit        = make(chan struct{})
+
+	if idleTimeout > 0 {
+		go out.reapingRoutine()
+	}
+
+	return out
+}
+
+// Acquire returns the output of db.table, it will be created if not exists, call release when the output is not used
+func (r *outputRegistry) Acquire(db string, table string) (output writerOutput, release func(), err error) {
+
+	if err := checkDbTable(db, table); err != nil {
+		return nil, nil, err
+	}
+
+	key := db + "." + table
+
+	r.mu.RLock()
+	ro, exist := r.outputs[key]
+	if exist {
+		atomic.AddInt32(&ro.users, 1)
+	}
+	r.mu.RUnlock()
+
+	if !exist {
+		r.mu.Lock()
+		if r.stopped {
+			r.mu.Unlock()
+			return nil, nil, fmt.Errorf("writer is stopped")
+		}
+		ro, exist = r.outputs[key]
+		if !exist {
+			ro = &registeredOutput{db: db, table: table, ready: make(chan struct{}), created: time.Now()}
+			r.outputs[key] = ro
+		}
+		atomic.AddInt32(&ro.users, 1)
+		r.mu.Unlock()
+
+		// create the output out of lock, it may take a while to warm up, the others acquiring it will wait for ready
+		if !exist {
+			ro.output = r.create(db, table)
+			ro.output.Start()
+			close(ro.ready)
+
+			slog.Infof("%s: output %s created", r.tag, key)
+		}
+	}
+
+	<-ro.ready
+	atomic.StoreInt64(&ro.lastUse, time.Now().UnixNano())
+
+	return ro.output, ro.release, nil
+}
+
+// Lookup likes Acquire, but returns nil if the output not exists
+func (r *outputRegistry) Lookup(db string, table string) (writerOutput, func()) {
+
+	r.mu.RLock()
+	ro, exist := r.outputs[db + "." + table]
+	if exist {
+		atomic.AddInt32(&ro.users, 1)
+	}
+	r.mu.RUnlock()
+
+	if !exist {
+		return nil, nil
+	}
+
+	<-ro.ready
+
+	return ro.output, ro.release
+}
+
+func (r *outputRegistry) reapingRoutine() {
+
+	interval := r.idleTimeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+			r.reapIdle()
+		}
+	}
+}
+
+// reapIdle stops the outputs not used in idle timeout
+func (r *outputRegistry) reapIdle() {
+
+	var idles []*registeredOutput
+
+	deadline := time.Now().Add(-r.idleTimeout).UnixNano()
+
+	r.mu.Lock()
+	for key, ro := range r.outputs {
+		// users is only increased in lock, so it will not be acquired by others after removed
+		if atomic.LoadInt32(&ro.users) == 0 && atomic.LoadInt64(&ro.lastUse) < deadline {
+			delete(r.outputs, key)
+			idles = append(idles, ro)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, ro := range idles {
+		slog.Infof("%s: output %s.%s is idle for %s, stopping", r.tag, ro.db, ro.table, r.idleTimeout)
+		ro.output.Stop()
+	}
+}
+
+// Stop stops all the outputs after they are released, no more outputs can be acquired after stopped
+func (r *outputRegistry) Stop() {
+
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.stopped = true
+	close(r.quit)
+
+	outputs := r.outputs
+	r.outputs = map[string]*registeredOutput{}
+	r.mu.Unlock()
+
+	for _, ro := range outputs {
+		<-ro.ready
+		for atomic.LoadInt32(&ro.users) > 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+		ro.output.Stop()
+	}
+}
+
+// Statuses returns the status of all the ready outputs, sorted by db.table
+func (r *outputRegistry) Statuses() []outputStatus {
+
+	r.mu.RLock()
+	out := make([]outputStatus, 0, len(r.outputs))
+	for _, ro := range r.outputs {
+		select {
+		case <-ro.ready:
+		default:
+			continue
+		}
+
+		st := ro.output.Status()
+		st.Db      = ro.db
+		st.Table   = ro.table
+		st.Users   = atomic.LoadInt32(&ro.users)
+		st.Created = ro.created
+		st.LastUse = time.Unix(0, atomic.LoadInt64(&ro.lastUse))
+		if st.Capacity > 0 {
+			st.Fill = float64(st.Queue) * 100 / float64(st.Capacity)
+		}
+		if !st.LastCommit.IsZero() {
+			st.LastCommitAge = time.Now().Sub(st.LastCommit).Truncate(time.Millisecond).String()
+		}
+
+		out = append(out, st)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Db != out[j].Db {
+			return out[i].Db < out[j].Db
+		}
+		return out[i].Table < out[j].Table
+	})
+
+	return out
+}
+
+// handlerForOutputs handles /api/v1/admin/outputs, lists the active outputs of writer
+func (r *outputRegistry) handlerForOutputs(w http.ResponseWriter, req *http.Request) {
+	respondJSON(w, r.Statuses())
+}
@@ -0,0 +1,227 @@
+package modules
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// queryPlan is the logical plan of a query of remote read, it's the same for all the modes,
+// the backend of mode renders it to sqls and decodes the rows to series
+type queryPlan struct {
+	query       *remote.Query
+	db          string
+	table       string
+	start       int64			// in seconds
+	end         int64
+	sStart      string			// in the zone of reader, see reader.utc
+	sEnd        string
+	sStartDate  string
+	sEndDate    string
+	step        int64			// in seconds, the samples in a step are downsampled to one, 0 for raw samples
+	downsample  *downsample		// the function to downsample the samples in a step
+	matchers    []string		// the wheres compiled from the matchers of query
+}
+
+// timeExpr returns the sql of the timestamp (in ms) of samples, aligned to step
+func (p *queryPlan) timeExpr() string {
+	if p.step <= 0 {
+		return "toInt64(toUInt32(ts)) * 1000"
+	}
+
+	return fmt.Sprintf("(intDiv(toUInt32(ts), %d) * %d) * 1000", p.step, p.step)
+}
+
+// staleNaNBits is the bits of the staleness markers of prometheus, a NaN written when a series or target is gone,
+// it's stored in val as is, and found by its bits in the sqls as NaN never equals
+const staleNaNBits uint64 = 0x7ff0000000000002
+
+var staleNaN = math.Float64frombits(staleNaNBits)
+
+// the sql returns 1 if val is a staleness marker
+var sqlIsStale = fmt.Sprintf("reinterpretAsUInt64(val) = %d", staleNaNBits)
+
+// the sql returns 1 if the last sample in a group (a step) is a staleness marker, then the step is stale,
+// the markers are ignored in other cases, so a step is downsampled from the real samples only
+var sqlLastStale = "argMax(" + sqlIsStale + ", ts)"
+
+func isStaleNaN(v float64) bool {
+	return math.Float64bits(v) == staleNaNBits
+}
+
+// sampleValue returns the value of a sample read, stale is the result of sqlIsStale or sqlLastStale
+func sampleValue(value float64, stale uint8) float64 {
+	if stale != 0 {
+		return staleNaN
+	}
+
+	return value
+}
+
+// queryError is returned when a query is invalid, like a wrong downsample, it's the fault of the query
+type queryError struct {
+	msg string
+}
+
+func (e *queryError) Error() string {
+	return e.msg
+}
+
+// checkDownsample2 returns an error if ds is not the one of mode 2, it keeps the first sample in a step only
+func checkDownsample2(ds *downsample) error {
+	if ds.fn != "first" {
+		return fmt.Errorf("downsample '%s' is not supported in mode 2, the first sample in a step is kept", ds)
+	}
+
+	return nil
+}
+
+// queryPlanner plans the queries by the config of reader
+type queryPlanner struct {
+	cfg        *ReaderCfg
+	downsample *downsample			// the default one
+	rules      []*downsampleRule
+}
+
+func newQueryPlanner(cfg *ReaderCfg) (*queryPlanner, error) {
+
+	def, err := parseDownsample(cfg.Downsample, float64(cfg.Quantile))
+	if err != nil {
+		return nil, err
+	}
+	rules, err := newDownsampleRules(cfg.DownsampleRules, float64(cfg.Quantile))
+	if err != nil {
+		return nil, err
+	}
+
+	// mode 2 downsamples the raw samples by itself, see clickDecoder2
+	if cfg.Mode == 2 {
+		if err = checkDownsample2(def); err != nil {
+			return nil, err
+		}
+		if len(rules) > 0 {
+			return nil, fmt.Errorf("downsample rules are not supported in mode 2, the first sample in a step is kept")
+		}
+	}
+
+	return &queryPlanner{cfg: cfg, downsample: def, rules: rules}, nil
+}
+
+// downsampleOf returns the downsample of the first rule matching the metric name of query, or the default one
+func (p *queryPlanner) downsampleOf(query *remote.Query) *downsample {
+
+	if name := metricName(query.Matchers); name != "" {
+		for _, rule := range p.rules {
+			if rule.re.MatchString(name) {
+				return rule.ds
+			}
+		}
+	}
+
+	return p.downsample
+}
+
+// plan returns the plan of query on db.table, the step is chosen so that a series will not return more than max_samples,
+// the samples in a step are downsampled by ds if set (like by the request), or by the config
+func (p *queryPlanner) plan(query *remote.Query, db string, table string, ds *downsample) (*queryPlan, error) {
+
+	if query.EndTimestampMs < query.StartTimestampMs {
+		return nil, &queryError{"start time is after end time"}
+	}
+
+	out := &queryPlan{
+		query   : query,
+		db      : db,
+		table   : table,
+		start   : query.StartTimestampMs / 1000,
+		end     : query.EndTimestampMs   / 1000,
+		matchers: compileMatchers(query.Matchers),
+	}
+
+	out.sStart, out.sStartDate = formatTime(time.Unix(out.start, 0), p.cfg.Utc)
+	out.sEnd  , out.sEndDate   = formatTime(time.Unix(out.end  , 0), p.cfg.Utc)
+
+	out.step = (out.end - out.start) / int64(p.cfg.MaxSamples)
+	if out.step < int64(p.cfg.MinStep) {
+		out.step = int64(p.cfg.MinStep)
+	}
+
+	if ds != nil && p.cfg.Mode == 2 {
+		if err := checkDownsample2(ds); err != nil {
+			return nil, &queryError{err.Error()}
+		}
+	}
+
+	out.downsample = ds
+	if out.downsample == nil {
+		out.downsample = p.downsampleOf(query)
+	}
+
+	return out, nil
+}
+
+// rangeOf returns a copy of plan reading [start, end] (in seconds) with the same step and downsample
+func (p *queryPlanner) rangeOf(plan *queryPlan, start int64, end int64) *queryPlan {
+
+	out := *plan
+	out.start = start
+	out.end   = end
+
+	out.sStart, out.sStartDate = formatTime(time.Unix(out.start, 0), p.cfg.Utc)
+	out.sEnd  , out.sEndDate   = formatTime(time.Unix(out.end  , 0), p.cfg.Utc)
+
+	return &out
+}
+
+// readBackend renders the sqls of plans and decodes the rows for the tables of a mode
+type readBackend interface {
+	// mode returns the mode of the tables
+	mode() int
+	// newDecoder returns a decoder for the rows of the sqls of plan
+	newDecoder(plan *queryPlan) rowsDecoder
+	// render returns the sqls of plan (not generated yet) decoded by dec, they are run at the same time by reader,
+	// there must be at least one
+	render(plan *queryPlan, dec rowsDecoder) []*sqlQuery
+}
+
+// rowsDecoder decodes the rows of the sqls of a plan to series, the sqls are read at the same time,
+// so the rows of different sqls are decoded in different goroutines
+type rowsDecoder interface {
+	// decode decodes the current row of the i-th sql
+	decode(i int, rows *sql.Rows) error
+	// done is called after the rows of the i-th sql are all read
+	done(i int)
+	// count returns the num of series found by the i-th sql till now, to check the limits
+	count(i int) int
+	// result returns the series decoded, it's called after all the sqls are done
+	result() *readResult
+}
+
+// readResult is the series read for a query
+type readResult struct {
+	series  map[string]*remote.TimeSeries		// by the tags joined with '\xff'
+	rows    int64
+	samples int64
+}
+
+func newReadResult() *readResult {
+	return &readResult{series: map[string]*remote.TimeSeries{}}
+}
+
+// merge merges the series of other into r, the same series may be returned by different queries
+func (r *readResult) merge(other *readResult) {
+	for key, cur := range other.series {
+		ts, ok := r.series[key]
+		if !ok {
+			r.series[key] = cur
+			continue
+		}
+		ts.Samples = append(ts.Samples, cur.Samples...)
+	}
+
+	r.rows    += other.rows
+	r.samples += other.samples
+}
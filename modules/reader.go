@@ -1,35 +1,44 @@
 package modules
 
 import (
-	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/ClickHouse/clickhouse-go"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/remote"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var readerContent = []interface{}{"component", "reader"}
 
+// clickReader serves the remote read of all the modes, the queries are planned by planner,
+// then the sqls are rendered and the rows are decoded by the backend of mode
 type clickReader struct {
 	click   *click
 	cfg     *ReaderCfg
-	queries prometheus.Counter
-	rows    prometheus.Counter
+	limits  *queryLimits
+	planner *queryPlanner
+	backend readBackend
+	read    func(ctx context.Context, plan *queryPlan) (*readResult, error)		// reads a plan, readCached by default
 	tag     string
 }
 
 func (r *clickReader) init() {
 
-	r.tag = "reader"
-
 	r.cfg   = &Cfg.Reader
 	r.click = Engine.clicks.GetServer(r.cfg.Clickhouse)
 
+	switch r.cfg.Mode {
+		case 2 : r.tag = "reader2"; r.backend = &clickBackend2{}
+		case 3 : r.tag = "reader3"; r.backend = &clickBackend3{click: r.click, labelIndex: r.cfg.LabelIndex}
+		default: r.tag = "reader" ; r.backend = &clickBackend1{}
+	}
+
 	if r.click == nil {
 		slog.Fatalf("%s: the clickhouse '%s' set in reader can not be found", r.tag, r.cfg.Clickhouse)
 	}
@@ -50,101 +59,138 @@ func (r *clickReader) init() {
 	if r.cfg.MinStep <= 0 {
 		r.cfg.MinStep = 15
 	}
+
+	if r.cfg.MaxConcurrency <= 0 {
+		r.cfg.MaxConcurrency = 4
+	}
+
+	if r.cfg.FingerprintCache.Ttl <= 0 {
+		r.cfg.FingerprintCache.Ttl = 60
+	}
+
+	if r.cfg.FingerprintCache.MaxSeries == 0 {
+		r.cfg.FingerprintCache.MaxSeries = 10000
+	}
+
+	if r.cfg.Mode == 3 && r.cfg.FingerprintCache.MaxSize > 0 {
+		resolveCache = newSeriesResolveCache(&r.cfg.FingerprintCache)
+		slog.Infof("%s: fingerprint cache enabled, max size: %d, ttl: %ds", r.tag, r.cfg.FingerprintCache.MaxSize, r.cfg.FingerprintCache.Ttl)
+	}
+
+	if r.cfg.ResultsCache.Ttl <= 0 {
+		r.cfg.ResultsCache.Ttl = 3600
+	}
+
+	if r.cfg.ResultsCache.MaxFreshness <= 0 {
+		r.cfg.ResultsCache.MaxFreshness = 600
+	}
+
+	if r.cfg.ResultsCache.MaxSize > 0 {
+		resultsCache = newQueryResultsCache(&r.cfg.ResultsCache)
+		slog.Infof("%s: results cache enabled, max size: %d samples, ttl: %ds, max freshness: %ds", r.tag, r.cfg.ResultsCache.MaxSize, r.cfg.ResultsCache.Ttl, r.cfg.ResultsCache.MaxFreshness)
+	}
+
+	// the same as before the downsample can be set
+	if r.cfg.Downsample == "" {
+		switch r.cfg.Mode {
+			case 2 : r.cfg.Downsample = "first"
+			case 3 : r.cfg.Downsample = "last"
+			default: r.cfg.Downsample = "quantile"
+		}
+	}
+
+	var err error
+	if r.planner, err = newQueryPlanner(r.cfg); err != nil {
+		slog.Fatalf("%s: %s", r.tag, err)
+	}
+
+	r.limits  = newQueryLimits(r.cfg)
+	r.read    = r.readCached
 }
 
 func (r *clickReader) IsHealthy() bool {
 	return r.click.IsHealthy()
 }
 
-func (r *clickReader) HandlePromReadReq(req *remote.ReadRequest, hr *http.Request) (*remote.ReadResponse, error) {
-
-	var err error
-
-	resp := remote.ReadResponse{
-		Results: []*remote.QueryResult{
-			{Timeseries: make([]*remote.TimeSeries, 0, 0)},
-		},
-	}
+func (r *clickReader) HandlePromReadReq(ctx context.Context, req *remote.ReadRequest, hr *http.Request) (*remote.ReadResponse, error) {
 
-	// need to map tags to timeseries to record samples
-	var tsres = make(map[string]*remote.TimeSeries)
+	resp := remote.ReadResponse{}
 
-	// for Debugfging/figuring out query format/etc
-	rcount := 0
-	tag    := r.tag
+	slog.Infof("%s: new query req: %d queries", r.tag, len(req.Queries))
 	tStart := time.Now()
-	for _, query := range req.Queries {
 
-		// get the select sql
-		q := r.getSqlQuery(query, hr)
-		if q == nil{
-			return &resp, err
+	dbName, tbName, err := r.getDbTable(hr)
+	if err != nil {
+		slog.Errorf("%s: %s", r.tag, err)
+		return &resp, &queryError{err.Error()}
+	}
+	tag := r.click.tag + "/" + dbName + "." + tbName
+
+	// the downsample of all the queries can be set by request, like /read?downsample=max
+	var ds *downsample
+	if args, ok := hr.Form["downsample"]; ok {
+		if ds, err = parseDownsample(args[0], float64(r.cfg.Quantile)); err != nil {
+			slog.Errorf("%s: %s", tag, err)
+			return &resp, &queryError{err.Error()}
 		}
-		slog.Debugf("%s: query: running sql: %s", q.tag, q.sql)
-		tag = q.tag
+	}
 
-		// todo: metrics on number of errors, rows, selects, timings, etc
-		cStart := time.Now()
-		rows, err := r.click.Query(q.sql)
+	plans := make([]*queryPlan, len(req.Queries))
+	for i, query := range req.Queries {
+		plan, err := r.planner.plan(query, dbName, tbName, ds)
 		if err != nil {
-			slog.Errorf("%s: query sql failed: %s: %s", q.tag, q.sql, err)
+			slog.Errorf("%s: plan query failed: %s", tag, err)
 			return &resp, err
 		}
+		plans[i] = plan
+	}
 
-		defer rows.Close()
-
-		curRCount := 0
-		// build map of timeseries from sql result
-		for rows.Next() {
-			curRCount++
-			var (
-				cnt   int
-				t     int64
-				name  string
-				tags  []string
-				value float64
-			)
-			if err = rows.Scan(&cnt, &t, &name, &tags, &value); err != nil {
-				slog.Errorf("%s: scan: %s", q.tag, err.Error())
-			}
-
-			// debug
-			//fmt.Printf(fmt.Sprintf("%d,%d,%s,%s,%f\n", cnt, t, name, strings.Join(tags, ":"), value))
-
-			// borrowed from influx remote storage adapter - array sep
-			key := strings.Join(tags, "\xff")
-			ts, ok := tsres[key]
-			if !ok {
-				ts = &remote.TimeSeries{
-					Labels: makeLabels(tags),
-				}
-				tsres[key] = ts
-			}
-			ts.Samples = append(ts.Samples, &remote.Sample{
-				Value       : value,
-				TimestampMs : t,
-			})
-		}
-
-		rcount += curRCount
-
-		slog.Debugf("%s: returned %d rows, cost: %s", q.tag, curRCount, time.Now().Sub(cStart).String())
+	// the queries run at the same time, bounded by max_concurrency, the results are kept in the order of queries
+	results := make([]*readResult, len(plans))
+	err = runBounded(ctx, len(plans), r.cfg.MaxConcurrency, func(ctx context.Context, i int) error {
+		cur, err := r.read(ctx, plans[i])
+		results[i] = cur
+		return err
+	})
+	if err != nil {
+		return &resp, err
 	}
 
-	// now add results to response
-	for _, ts := range tsres {
-		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
+	// the series limit is of the whole request
+	var rows, samples int64
+	var series int
+	for _, cur := range results {
+		rows    += cur.rows
+		samples += cur.samples
+		series  += len(cur.series)
+	}
+	if err = r.limits.checkSeries(series); err != nil {
+		return &resp, err
 	}
 
-	slog.Infof("%s: query: returning %d rows for %d queries, cost: %s", tag, rcount, len(req.Queries), time.Now().Sub(tStart).String())
+	resp.Results = queryResults(results)
+
+	slog.Infof("%s: query: returning %d rows for %d queries, wrapped: %d series, %d samples, cost: %s", tag, rows, len(req.Queries), series, samples, time.Now().Sub(tStart).String())
 
 	return &resp, nil
 }
 
-func (r *clickReader) getSqlQuery(query *remote.Query, hr *http.Request) *sqlQuery {
+// queryResults returns the results of response, Results[i] is of Queries[i] as the remote read protocol requires,
+// so a series matched by several queries is returned in all of them
+func queryResults(results []*readResult) []*remote.QueryResult {
+
+	out := make([]*remote.QueryResult, len(results))
+	for i, res := range results {
+		out[i] = &remote.QueryResult{Timeseries: make([]*remote.TimeSeries, 0, len(res.series))}
+		for _, ts := range res.series {
+			out[i].Timeseries = append(out[i].Timeseries, ts)
+		}
+	}
+
+	return out
+}
 
-	q := newSqlQuery(query)
-	q.tag = r.tag + ": " + q.tag
+func (r *clickReader) getDbTable(hr *http.Request) (string, string, error) {
 
 	hr.ParseForm()
 
@@ -162,137 +208,254 @@ func (r *clickReader) getSqlQuery(query *remote.Query, hr *http.Request) *sqlQue
 			tbName = args[0]
 		}
 	}
-	q.tag = r.tag + "<-" + r.click.tag + "/" + dbName + "." + tbName
 
-	// valid time period checker
-	if query.EndTimestampMs < query.StartTimestampMs {
-		slog.Errorf("%s: Start time is after end time", q.tag)
+	return dbName, tbName, checkDbTable(dbName, tbName)
+}
+
+// readPlan runs the sqls of plan rendered by backend, and returns the series decoded,
+// the queries are canceled in clickhouse if ctx is done in the middle
+func (r *clickReader) readPlan(ctx context.Context, plan *queryPlan) (*readResult, error) {
+
+	limits := limitsOf(ctx, r.limits)
+
+	dec  := r.backend.newDecoder(plan)
+	sqls := r.backend.render(plan, dec)
+	if len(sqls) == 0 {
+		return nil, fmt.Errorf("%s: no sql rendered for query %s", r.tag, matchersString(plan.query.Matchers))
 	}
 
-	q.iStart = query.StartTimestampMs / 1000
-	q.iEnd   = query.EndTimestampMs   / 1000
-	if r.cfg.Utc{
-		q.sStart      = time.Unix(q.iStart, 0).UTC().Format("2006-01-02 15:04:05")
-		q.sEnd        = time.Unix(q.iEnd  , 0).UTC().Format("2006-01-02 15:04:05")
-		q.sStartDate  = time.Unix(q.iStart, 0).UTC().Format("2006-01-02")
-		q.sEndDate    = time.Unix(q.iEnd  , 0).UTC().Format("2006-01-02")
-	} else {
-		q.sStart      = time.Unix(q.iStart, 0).Format("2006-01-02 15:04:05")
-		q.sEnd        = time.Unix(q.iEnd  , 0).Format("2006-01-02 15:04:05")
-		q.sStartDate  = time.Unix(q.iStart, 0).Format("2006-01-02")
-		q.sEndDate    = time.Unix(q.iEnd  , 0).Format("2006-01-02")
+	cStart := time.Now()
+
+	// the sqls of a plan are independent, they run at the same time, like the metrics and samples of mode 3
+	counts := make([]int64, len(sqls))
+	err := runBounded(ctx, len(sqls), len(sqls), func(ctx context.Context, i int) error {
+		q := sqls[i]
+		q.tag      = r.tag + "<-" + r.click.tag + "/" + q.tag
+		q.ctx      = ctx
+		q.settings = limits.settings
+		q.genSql()
+
+		n, err := r.readRows(ctx, q, i, dec, limits)
+		counts[i] = n
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	period := q.iEnd - q.iStart
-	step := period / int64(r.cfg.MaxSamples)
-	if step < int64(r.cfg.MinStep) {
-		step = int64(r.cfg.MinStep)
+	var rows int64
+	for _, n := range counts {
+		rows += n
 	}
 
-	q.rows = append(q.rows, fmt.Sprintf("COUNT() AS CNT, (intDiv(toUInt32(ts), %d) * %d) * 1000 as t", step, step))
-	q.rows = append(q.rows, "name", "tags")
-	q.rows = append(q.rows, fmt.Sprintf("quantile(%f)(val) as value", r.cfg.Quantile))
+	out := dec.result()
+	out.rows = rows
 
-	q.from = fmt.Sprintf("%s.%s", dbName, tbName)
+	tag := sqls[len(sqls) - 1].tag
+	slog.Infof("%s: query: returned %d rows, wrapped %d samples, cost: %s", tag, rows, out.samples, time.Now().Sub(cStart).String())
+	slowQueries.record(tag, plan.query, sqls, rows, time.Now().Sub(cStart))
+	observeQuery(r.click.name, plan.db, plan.table, r.backend.mode(), rows, time.Now().Sub(cStart))
 
-	q.wheres = append(q.wheres, fmt.Sprintf("date >= '%s' AND ts >= '%s' AND ts <= '%s'", q.sStartDate, q.sStart, q.sEnd))
-	q.wheres = append(q.wheres, r.getMatchWheres(query)...)
+	return out, nil
+}
 
-	q.groupBy = "t, name, tags"
-	q.orderBy = "tags"
+// readRows runs the i-th sql of a plan and decodes its rows by dec, the rows are closed when it returns,
+// the sqls of a plan are read at the same time
+func (r *clickReader) readRows(ctx context.Context, q *sqlQuery, i int, dec rowsDecoder, limits *queryLimits) (int64, error) {
 
-	q.genSql()
+	slog.Debugf("%s: query: running sql: %s", q.tag, q.sql)
 
-	return q
-}
+	cStart := time.Now()
 
-func (r *clickReader) getMatchWheres(query *remote.Query) []string {
-
-	var matchWheres []string
-
-	for _, m := range query.Matchers {
-		// __name__ is handled specially - match it directly
-		// as it is stored in the name column (it's also in tags as __name__)
-		// note to self: add name to index.. otherwise this will be slow..
-		if m.Name == model.MetricNameLabel {
-			var whereAdd string
-			switch m.Type {
-			case remote.MatchType_EQUAL:
-				whereAdd = fmt.Sprintf(` name='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
-			case remote.MatchType_NOT_EQUAL:
-				whereAdd = fmt.Sprintf(` name!='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
-			case remote.MatchType_REGEX_MATCH:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 1 `, strings.Replace(m.Value, `/`, `\/`, -1))
-			case remote.MatchType_REGEX_NO_MATCH:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 0 `, strings.Replace(m.Value, `/`, `\/`, -1))
-			}
-			matchWheres = append(matchWheres, whereAdd)
+	// the sql runs in the span, so the spans of the sqls of parallel queries are not mixed
+	ctx, span := startClickSpan(ctx, "clickhouse query", r.click, q.db, q.sql)
+	q.ctx = ctx
+
+	rows, err := r.click.Query(q.context(), q.sql)
+	if err != nil {
+		err = limitErrorOf(err)
+		endSpan(span, err)
+		slog.Errorf("%s: query sql failed: %s: %s", q.tag, q.sql, err)
+		return 0, err
+	}
+	defer rows.Close()
+
+	var (
+		count int64
+		qerr  error
+	)
+	for rows.Next() {
+		count++
+		if qerr = limits.checkRows(count); qerr != nil {
+			break
+		}
+		if err = dec.decode(i, rows); err != nil {
+			slog.Errorf("%s: scan: %s", q.tag, err.Error())
 			continue
 		}
+		if qerr = limits.checkSeries(dec.count(i)); qerr != nil {
+			break
+		}
+	}
+	if qerr == nil {
+		qerr = limitErrorOf(rows.Err())		// canceled or failed in the middle, like by the limits in settings
+	}
+	if qerr != nil {
+		endSpan(span, qerr)
+		slog.Errorf("%s: query_id: %s, read rows failed: %s", q.tag, q.queryId, qerr)
+		return count, qerr
+	}
+	dec.done(i)
 
-		switch m.Type {
-		case remote.MatchType_EQUAL:
-			var insql bytes.Buffer
-			asql := "arrayExists(x -> x IN (%s), tags) = 1"
-			// value appears to be | sep'd for multiple matches
-			for i, val := range strings.Split(m.Value, "|") {
-				if len(val) < 1 {
-					continue
-				}
-				if i == 0 {
-					istr := fmt.Sprintf(`'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				} else {
-					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				}
-			}
-			wstr := fmt.Sprintf(asql, insql.String())
-			matchWheres = append(matchWheres, wstr)
-
-		case remote.MatchType_NOT_EQUAL:
-			var insql bytes.Buffer
-			asql := "arrayExists(x -> x IN (%s), tags) = 0"
-			// value appears to be | sep'd for multiple matches
-			for i, val := range strings.Split(m.Value, "|") {
-				if len(val) < 1 {
-					continue
-				}
-				if i == 0 {
-					istr := fmt.Sprintf(`'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				} else {
-					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				}
-			}
-			wstr := fmt.Sprintf(asql, insql.String())
-			matchWheres = append(matchWheres, wstr)
-
-		case remote.MatchType_REGEX_MATCH:
-			asql := `arrayExists(x -> 1 == match(x, '^%s=%s'),tags) = 1`
-			// we can't have ^ in the regexp since keys are stored in arrays of key=value
-			if strings.HasPrefix(m.Value, "^") {
-				val := strings.Replace(m.Value, "^", "", 1)
-				val = strings.Replace(val, `/`, `\/`, -1)
-				matchWheres = append(matchWheres, fmt.Sprintf(asql, m.Name, val))
-			} else {
-				val := strings.Replace(m.Value, `/`, `\/`, -1)
-				matchWheres = append(matchWheres, fmt.Sprintf(asql, m.Name, val))
-			}
+	slog.Debugf("%s: query_id: %s, returned %d rows, cost: %s", q.tag, q.queryId, count, time.Now().Sub(cStart).String())
+	span.SetAttributes(attribute.Int64("db.rows", count))
+	span.End()
+
+	return count, nil
+}
+
+// runBounded runs fn for [0, n) in at most limit goroutines, the first error is returned and the others are canceled by ctx
+func runBounded(ctx context.Context, n int, limit int, fn func(ctx context.Context, i int) error) error {
+
+	if n == 1 {
+		return fn(ctx, 0)
+	}
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+	sem := make(chan struct{}, limit)
+	for i := 0; i < n; i++ {
+		select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
 
-		case remote.MatchType_REGEX_NO_MATCH:
-			asql := `arrayExists(x -> 1 == match(x, '^%s=%s'),tags) = 0`
-			if strings.HasPrefix(m.Value, "^") {
-				val := strings.Replace(m.Value, "^", "", 1)
-				val = strings.Replace(val, `/`, `\/`, -1)
-				matchWheres = append(matchWheres, fmt.Sprintf(asql, m.Name, val))
-			} else {
-				val := strings.Replace(m.Value, `/`, `\/`, -1)
-				matchWheres = append(matchWheres, fmt.Sprintf(asql, m.Name, val))
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+
+			if err := fn(ctx, i); err != nil {
+				once.Do(func() { first = err; cancel() })
 			}
+		}(i)
+	}
+	wg.Wait()
+
+	// canceled by the caller before all started
+	if first == nil {
+		first = ctx.Err()
+	}
+
+	return first
+}
+
+// clickBackend1 reads the table of mode 1, the samples are downsampled by the downsample of plan in clickhouse
+type clickBackend1 struct {}
+
+func (b *clickBackend1) mode() int {
+	return 1
+}
+
+func (b *clickBackend1) render(plan *queryPlan, dec rowsDecoder) []*sqlQuery {
+
+	q := newSqlQuery(plan.query)
+	q.db    = plan.db
+	q.table = plan.table
+	q.tag   = plan.db + "." + plan.table
+
+	q.rows = append(q.rows, "COUNT() AS CNT, " + plan.timeExpr() + " as t")
+	q.rows = append(q.rows, "name", "tags")
+	if plan.downsample.isCounter() {
+		q.rows = append(q.rows, counterRows()...)
+	} else {
+		q.rows = append(q.rows, plan.downsample.value() + " as value")
+	}
+	q.rows = append(q.rows, sqlLastStale + " as stale")
+
+	q.from = sqlTable(plan.db, plan.table)
+
+	q.wheres = append(q.wheres, fmt.Sprintf("date >= '%s' AND ts >= '%s' AND ts <= '%s'", plan.sStartDate, plan.sStart, plan.sEnd))
+	q.wheres = append(q.wheres, plan.matchers...)
+
+	q.groupBy = "t, name, tags"
+	q.orderBy = "tags, t"
+
+	return []*sqlQuery{q}
+}
+
+func (b *clickBackend1) newDecoder(plan *queryPlan) rowsDecoder {
+	return &clickDecoder1{res: newReadResult(), counter: plan.downsample.isCounter()}
+}
+
+type clickDecoder1 struct {
+	res     *readResult
+	counter bool			// the rows are of counterRows
+}
+
+func (d *clickDecoder1) decode(i int, rows *sql.Rows) error {
+	var (
+		cnt   int
+		t     int64
+		name  string
+		tags  []string
+		value float64
+		stale uint8
+		cts   []int64
+		cvals []float64
+		tlast int64
+		err   error
+	)
+	if d.counter {
+		err = rows.Scan(&cnt, &t, &name, &tags, &cts, &cvals, &stale, &tlast)
+	} else {
+		err = rows.Scan(&cnt, &t, &name, &tags, &value, &stale)
+	}
+	if err != nil {
+		return err
+	}
+
+	// borrowed from influx remote storage adapter - array sep
+	key := strings.Join(tags, "\xff")
+	ts, ok := d.res.series[key]
+	if !ok {
+		ts = &remote.TimeSeries{
+			Labels: makeLabels(tags),
 		}
+		d.res.series[key] = ts
+	}
+	if d.counter {
+		samples := counterSamples(cts, cvals, stale, tlast)
+		ts.Samples = append(ts.Samples, samples...)
+		d.res.samples += int64(len(samples))
+		return nil
 	}
+	ts.Samples = append(ts.Samples, &remote.Sample{
+		Value       : sampleValue(value, stale),
+		TimestampMs : t,
+	})
+	d.res.samples++
 
-	return matchWheres
-}
\ No newline at end of file
+	return nil
+}
+
+func (d *clickDecoder1) done(i int) {}
+
+func (d *clickDecoder1) count(i int) int {
+	return len(d.res.series)
+}
+
+func (d *clickDecoder1) result() *readResult {
+	return d.res
+}
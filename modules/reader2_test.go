@@ -0,0 +1,65 @@
+package modules
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func TestDecoder2DownsamplesStaleness(t *testing.T) {
+
+	api := []string{"__name__=up", "job=api"}
+	web := []string{"__name__=up", "job=web"}
+
+	// the raw samples ordered by tags and ts, t is aligned to the step of a minute
+	rows := [][]driver.Value{
+		// the first real sample is kept
+		{int64(0)     , "up", api, float64(1), uint8(0)},
+		{int64(0)     , "up", api, float64(2), uint8(0)},
+		// ended by a marker
+		{int64(60000) , "up", api, float64(3), uint8(0)},
+		{int64(60000) , "up", api, staleNaN  , uint8(1)},
+		// started by a marker, then written again
+		{int64(120000), "up", api, staleNaN  , uint8(1)},
+		{int64(120000), "up", api, float64(5), uint8(0)},
+		{int64(120000), "up", api, float64(6), uint8(0)},
+		// only a marker
+		{int64(180000), "up", api, staleNaN  , uint8(1)},
+		// the next series starts at the same step
+		{int64(180000), "up", web, staleNaN  , uint8(1)},
+		{int64(180000), "up", web, float64(7), uint8(0)},
+		{int64(240000), "up", web, float64(8), uint8(0)},
+		{int64(240000), "up", web, staleNaN  , uint8(1)},
+		{int64(240000), "up", web, float64(9), uint8(0)},
+	}
+
+	cfg := newTestReaderCfg()
+	cfg.Mode       = 2
+	cfg.MinStep    = 60
+	cfg.Downsample = "first"
+
+	r := newRowsTestReader(t, cfg, &clickBackend2{}, func(query string) ([]string, [][]driver.Value) {
+		return []string{"t", "name", "tags", "val", "stale"}, rows
+	})
+
+	plan, err := r.planner.plan(newTestQuery(0, 10, "__name__=up"), "prometheus", "samples", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := r.readPlan(context.Background(), plan)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	checkSamples(t, res, map[string][]remote.Sample{
+		strings.Join(api, "\xff"): {{Value: 1, TimestampMs: 0}, {Value: staleNaN, TimestampMs: 60000}, {Value: 5, TimestampMs: 120000}, {Value: staleNaN, TimestampMs: 180000}},
+		strings.Join(web, "\xff"): {{Value: 7, TimestampMs: 180000}, {Value: 8, TimestampMs: 240000}},
+	})
+	if res.samples != 6 || res.rows != int64(len(rows)) {
+		t.Errorf("%d samples and %d rows read, want 6 and %d", res.samples, res.rows, len(rows))
+	}
+}
@@ -1,457 +1,335 @@
 package modules
 
 import (
-	"bytes"
+	"database/sql"
 	"fmt"
-	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/ClickHouse/clickhouse-go"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/remote"
 )
 
-type clickReader3 struct {
-	click   *click
-	cfg     *ReaderCfg
-	queries prometheus.Counter
-	rows    prometheus.Counter
-	tag     string
-}
-
-func (r *clickReader3) init() {
-	r.tag = "reader3"
-
-	r.cfg   = &Cfg.Reader
-	r.click = Engine.clicks.GetServer(r.cfg.Clickhouse)
-
-	if r.click == nil {
-		slog.Fatalf("the clickhouse '%s' set in reader can not be found", r.cfg.Clickhouse)
-	}
-
-	// check and set default vals
-	if r.cfg.MaxSamples == 0 {
-		r.cfg.MaxSamples = 11000
-	}
-
-	if r.cfg.Quantile == 0 {
-		r.cfg.Quantile = 0.75
-	} else if r.cfg.Quantile < 0.0 {
-		r.cfg.Quantile = 0.0
-	} else if r.cfg.Quantile > 1.0 {
-		r.cfg.Quantile = 1.0
-	}
-
-	if r.cfg.MinStep <= 0 {
-		r.cfg.MinStep = 15
-	}
+// clickBackend3 reads the tables of mode 3, <table>_metrics for the labels of fingerprints, <table>_samples for the samples,
+// here we do not using inner join to return all result in one query
+// because 1. it need more memory for clickhouse to do 'group by' and 'order by' operations
+//         2. it transfer more data
+type clickBackend3 struct {
+	click      *click
+	labelIndex bool			// resolve the fingerprints of equality matchers from <table>_labels first
 }
 
-func (r *clickReader3) IsHealthy() bool {
-	return r.click.IsHealthy()
+func (b *clickBackend3) mode() int {
+	return 3
 }
 
-func (r *clickReader3) HandlePromReadReq(req *remote.ReadRequest, hr *http.Request) (*remote.ReadResponse, error) {
+func (b *clickBackend3) render(plan *queryPlan, dec rowsDecoder) []*sqlQuery {
 
-	var err error
+	tbNameMetrics := plan.table + "_metrics"
+	tbNameSamples := plan.table + "_samples"
 
-	resp := remote.ReadResponse{
-		Results: []*remote.QueryResult{
-			{Timeseries: make([]*remote.TimeSeries, 0, 0)},
-		},
+	// the wheres on <table>_metrics, the postings go first to skip the rows not matched before matching tags
+	var wheres []string
+	wheres = append(wheres, fmt.Sprintf("date >= '%s' AND date <= '%s'", plan.sStartDate, plan.sEndDate))
+	if postings := b.postings(plan); postings != "" {
+		wheres = append(wheres, postings)
 	}
+	wheres = append(wheres, plan.matchers...)
 
-	// need to map tags to timeseries to record samples
-	var tsres = make(map[uint64]*remote.TimeSeries)
+	// first, we need to query the metrics needed, target sql like:
+	// select count() as cnt, fingerprint, tags from <db>.<table>_metrics where has(tags, '__name__=up') group by fingerprint, tags
+	q1 := newSqlQuery(plan.query)
+	q1.db    = plan.db
+	q1.table = plan.table
+	q1.tag   = plan.db + "." + tbNameMetrics
 
-	var (
-		t        	 int64
-		tags     	 []string
-		value    	 float64
-		cnt      	 int
-		rcount   	 int64			// row count
-		scount   	 int64			// sample count
-		lastTSms 	 int64 			// last timestamp
-		lastFP  	 uint64
-		lastLPs      []*remote.LabelPair
-		lastTS  	 *remote.TimeSeries
-		fingerprint  uint64
-		fingerprints map[uint64][]*remote.LabelPair
-		exist        bool
-	)
+	q1.rows = append(q1.rows, "count() as cnt, fingerprint, tags")
 
-	slog.Infof("%s: new query req: %d queries", r.tag, len(req.Queries))
-	tStart := time.Now()
+	q1.from = sqlTable(plan.db, tbNameMetrics)
 
-	tag := r.tag
-	fingerprints = map[uint64][]*remote.LabelPair{}
+	q1.wheres = append(q1.wheres, wheres...)
 
-	for _, query := range req.Queries {
+	q1.groupBy = "fingerprint, tags"
 
-		q1 := r.getSqlQuery(query, hr)
-		q2 := r.getSqlQuery2(query, hr)
-		if q1 == nil || q2 == nil{
-			slog.Errorf("%s: gen (getSqlQuery)s failed", r.tag)
-			return &resp, err
-		}
+	// then the samples of the fingerprints, target sql like:
+	// select fingerprint, t, argMaxIf(val, ts, NOT stale) (by the downsample of plan), argMax(stale, ts) from <db>.<table>_samples where fingerprint in (select fingerprint from <db>.<table>_metrics where ...) group by fingerprint, t order by fingerprint, t
+	q2 := newSqlQuery(plan.query)
+	q2.db    = plan.db
+	q2.table = plan.table
+	q2.tag   = plan.db + ".[" + tbNameMetrics + "," + tbNameSamples + "]"
 
-		slog.Debugf("%s: query: running sql: %s", q1.tag, q1.sql)
-		rows1, err1 := r.click.Query(q1.sql)
-		if err1 != nil {
-			slog.Errorf("%s: query sql failed: %s: %s", q1.tag, q1.sql, err1)
-			return &resp, err1
-		}
-		slog.Debugf("%s: query: running sql: %s", q2.tag, q2.sql)
-		rows2, err2 := r.click.Query(q2.sql)
-		if err2 != nil {
-			slog.Errorf("%s: query sql failed: %s: %s", q2.tag, q2.sql, err2)
-			return &resp, err2
+	q2.rows = append(q2.rows, "fingerprint")
+	q2.rows = append(q2.rows, plan.timeExpr() + " as t")
+	if plan.step > 0 {
+		if plan.downsample.isCounter() {
+			q2.rows = append(q2.rows, counterRows()...)
+		} else {
+			q2.rows = append(q2.rows, plan.downsample.value() + " as value")
 		}
+		q2.rows = append(q2.rows, sqlLastStale + " as stale")
+	} else {
+		q2.rows = append(q2.rows, "val as value")
+		q2.rows = append(q2.rows, sqlIsStale + " as stale")
+	}
 
-		tag = q2.tag
-
-		defer rows1.Close()
-		defer rows2.Close()
+	q2.from = sqlTable(plan.db, tbNameSamples)
 
-		var (
-			curRCount1 int64
-			curSCount1 int64
-		)
+	inSQL := fmt.Sprintf("fingerprint in (select fingerprint from %s where %s group by fingerprint)", sqlTable(plan.db, tbNameMetrics), strings.Join(wheres," AND "))
 
-		// handle fingerprints and tags in rows1, parsing to LabelPair
-		for rows1.Next(){
-			curRCount1++
+	q2.wheres = append(q2.wheres, fmt.Sprintf("ts >= '%s' AND ts <= '%s'", plan.sStart, plan.sEnd))
 
-			if err = rows1.Scan(&cnt, &fingerprint, &tags); err != nil {
-				slog.Errorf("%s: scan: %s", q1.tag, err.Error())
-			}
+	if plan.step > 0 {
+		q2.groupBy = "fingerprint, t"
+	}
+	q2.orderBy = "fingerprint, t"
 
-			_, ok := fingerprints[fingerprint]
-			if !ok {
-				curSCount1 ++
-				fingerprints[fingerprint] = makeLabels(tags)
-			}
+	// the fingerprints are found in cache, only the samples are queried
+	if d := dec.(*clickDecoder3); d.cached {
+		fingerprints := make([]uint64, 0, len(d.fingerprints))
+		for fingerprint := range d.fingerprints {
+			fingerprints = append(fingerprints, fingerprint)
 		}
-		slog.Debugf("%s: returned %d rows, parsed %d metrics", q1.tag, curRCount1, curSCount1)
-
-		var (
-			curRCount2 int64
-			curSCount2 int64
-		)
-
-		// build map of timeseries from sql result
-		for rows2.Next() {
-			curRCount2++
-
-			if err = rows2.Scan(&fingerprint, &t, &value); err != nil {
-				slog.Errorf("%s: scan: %s", q2.tag, err.Error())
-			}
-
-			// new query, order by tags,t, so the same tags will be returned together
-			// so we can using the last tag and current tag to check if is new
-
-			if fingerprint != lastFP{
-				lastFP = fingerprint
-
-				lastLPs, exist = fingerprints[fingerprint]
-				if !exist {
-					// this should not happen
-					slog.Errorf("%s: invalid sample, fingerprint '%s' can not be found in query1", q2.tag, fingerprint)
-				}
-
-				// maybe a new tag, check and create new one
-				ts, ok := tsres[fingerprint]
-				if !ok {
-					ts = &remote.TimeSeries{
-						Labels: lastLPs,
-					}
-					tsres[fingerprint] = ts
-				}
-
-				lastTS   = ts
-				lastTSms = 0
-			} else if lastLPs == nil {
-				continue		// skip invalid samples, of cause this should not happen like prev branch
-			}
+		sort.Slice(fingerprints, func(i, j int) bool { return fingerprints[i] < fingerprints[j] })
 
-			// the same as last, append directly
-			ts := lastTS
-			if lastTSms != t{
-				curSCount2++
-				ts.Samples = append(ts.Samples, &remote.Sample{
-					Value       : value,
-					TimestampMs : t,
-				})
-			}
-			lastTSms = t
+		ins := make([]string, 0, len(fingerprints))
+		for _, fingerprint := range fingerprints {
+			ins = append(ins, strconv.FormatUint(fingerprint, 10))
 		}
 
-		slog.Debugf("%s: returned %d rows, wrapped %d samples", q2.tag, curRCount2, curSCount2)
-
-		rcount += curRCount2
-		scount += curSCount2
-	}
+		q2.tag    = plan.db + "." + tbNameSamples
+		q2.wheres = append(q2.wheres, fmt.Sprintf("fingerprint in (%s)", strings.Join(ins, ",")))
 
-	// now add results to response
-	for _, ts := range tsres {
-		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
+		return []*sqlQuery{q2}
 	}
 
-	slog.Infof("%s: query: returning %d rows for %d queries, wrapped: %d samples, cost: %s", tag, rcount, len(req.Queries), scount, time.Now().Sub(tStart).String())
+	q2.wheres = append(q2.wheres, inSQL)
 
-	return &resp, nil
+	return []*sqlQuery{q1, q2}
 }
 
-// first, we need to query the metrics needed, here we do not using inner join to return all result in one query
-// because 1. it need more memory for clickhouse to do 'group by' and 'order by' operations
-//         2. it transfer more data
-func (r *clickReader3) getSqlQuery(query *remote.Query, hr *http.Request) *sqlQuery {
-
-	q := newSqlQuery(query)
-	q.tag = r.tag + ": " + q.tag
+// postings returns the where of the fingerprints having all the labels of the equality matchers, they are read from
+// <table>_labels by its primary key (label, value, date), empty if the index is not enabled or no such matchers
+func (b *clickBackend3) postings(plan *queryPlan) string {
 
-	hr.ParseForm()
+	if !b.labelIndex {
+		return ""
+	}
 
-	dbName := r.click.cfg.Database
-	tbName := r.click.cfg.Table
-	{
-		args, ok := hr.Form["db"]
-		if ok {
-			dbName = args[0]
+	var pairs []string
+	seen := map[string]bool{}
+	for _, m := range plan.query.Matchers {
+		// label="" selects the series without the label, it's not in the index
+		if m.Type != remote.MatchType_EQUAL || m.Value == "" {
+			continue
 		}
-	}
-	{
-		args, ok := hr.Form["table"]
-		if ok {
-			tbName = args[0]
+		pair := fmt.Sprintf("(%s, %s)", sqlString(m.Name), sqlString(m.Value))
+		if !seen[pair] {
+			seen[pair] = true
+			pairs = append(pairs, pair)
 		}
 	}
-	tbNameMetrics := tbName + "_metrics"
-	q.tag = r.click.tag + "/" + dbName + "." + tbNameMetrics
-
-	q.iStart = query.StartTimestampMs / 1000
-	q.iEnd   = query.EndTimestampMs   / 1000
-	if r.cfg.Utc{
-		q.sStart      = time.Unix(q.iStart, 0).UTC().Format("2006-01-02 15:04:05")
-		q.sEnd        = time.Unix(q.iEnd  , 0).UTC().Format("2006-01-02 15:04:05")
-		q.sStartDate  = time.Unix(q.iStart, 0).UTC().Format("2006-01-02")
-		q.sEndDate    = time.Unix(q.iEnd  , 0).UTC().Format("2006-01-02")
-	} else {
-		q.sStart      = time.Unix(q.iStart, 0).Format("2006-01-02 15:04:05")
-		q.sEnd        = time.Unix(q.iEnd  , 0).Format("2006-01-02 15:04:05")
-		q.sStartDate  = time.Unix(q.iStart, 0).Format("2006-01-02")
-		q.sEndDate    = time.Unix(q.iEnd  , 0).Format("2006-01-02")
+	if len(pairs) == 0 {
+		return ""
 	}
 
+	// a fingerprint having all the pairs, the rows may be duplicated before merged by ReplacingMergeTree
+	return fmt.Sprintf("fingerprint IN (SELECT fingerprint FROM %s WHERE (label, value) IN (%s) AND date >= '%s' AND date <= '%s' GROUP BY fingerprint HAVING uniqExact(label, value) = %d)",
+		sqlTable(plan.db, plan.table + "_labels"), strings.Join(pairs, ", "), plan.sStartDate, plan.sEndDate, len(pairs))
+}
 
-	// target sql like: select count() as cnt, fingerprint, tags from mode3_metrics where has(tags, '__name__=up') from <db>.<table> group by fingerprint, tags
-
-	q.rows = append(q.rows, "count() as cnt, fingerprint, tags")
+func (b *clickBackend3) newDecoder(plan *queryPlan) rowsDecoder {
+
+	d := &clickDecoder3{
+		b           : b,
+		plan        : plan,
+		res         : newReadResult(),
+		fingerprints: map[uint64][]*remote.LabelPair{},
+		tagsOfFP    : map[uint64]string{},
+		skipped     : map[uint64]bool{},
+		samples     : map[uint64]*remote.TimeSeries{},
+		counter     : plan.step > 0 && plan.downsample.isCounter(),
+		since       : time.Now(),
+	}
 
-	q.from = fmt.Sprintf("%s.%s", dbName, tbNameMetrics)
+	if resolveCache == nil {
+		return d
+	}
 
-	q.wheres = append(q.wheres, fmt.Sprintf("date >= '%s' AND date <= '%s'", q.sStartDate, q.sEndDate) )
-	q.wheres = append(q.wheres, r.getMatchWheres(query)...)
+	// the cached maps are shared, they are only read by the decoder
+	if series := resolveCache.get(plan); series != nil {
+		d.fingerprints = series.labels
+		d.tagsOfFP     = series.tags
+		d.cached       = true
+		resolveCacheHits.WithLabelValues(b.click.name, plan.db, plan.table).Inc()
+	} else {
+		resolveCacheMisses.WithLabelValues(b.click.name, plan.db, plan.table).Inc()
+	}
 
-	q.groupBy = "fingerprint, tags"
-	q.orderBy = ""
+	return d
+}
 
-	q.genSql()
+// clickDecoder3 parses the fingerprints and tags from the rows of the first sql, and the samples of the fingerprints
+// from the second, the two sqls are read at the same time, so the samples are kept by fingerprint till both are done
+type clickDecoder3 struct {
+	b            *clickBackend3
+	plan         *queryPlan
+	res          *readResult
+	fingerprints map[uint64][]*remote.LabelPair
+	tagsOfFP     map[uint64]string
+	skipped      map[uint64]bool		// the fingerprints of ambiguous series
+	counter      bool					// the samples are of counterRows
+	cached       bool					// the fingerprints are from resolveCache, the first sql is not run
+	since        time.Time				// when the fingerprints are resolved, for resolveCache
+
+	// the samples without labels by fingerprint, only accessed by the goroutine of the second sql
+	samples      map[uint64]*remote.TimeSeries
+	lastTSms     int64 			// last timestamp
+	lastFP       uint64
+	lastTS       *remote.TimeSeries
+}
 
-	return q
+// isMetrics returns whether the i-th sql is the one of <table>_metrics
+func (d *clickDecoder3) isMetrics(i int) bool {
+	return i == 0 && !d.cached
 }
 
-func (r *clickReader3) getSqlQuery2(query *remote.Query, hr *http.Request) *sqlQuery {
-	q := newSqlQuery(query)
-	q.tag = r.tag + ": " + q.tag
+func (d *clickDecoder3) decode(i int, rows *sql.Rows) error {
+	if d.isMetrics(i) {
+		return d.decodeMetric(rows)
+	}
 
-	hr.ParseForm()
+	return d.decodeSample(rows)
+}
 
-	dbName        := r.click.cfg.Database
-	tbName        := r.click.cfg.Table
-	{
-		args, ok := hr.Form["db"]
-		if ok {
-			dbName = args[0]
-		}
-	}
-	{
-		args, ok := hr.Form["table"]
-		if ok {
-			tbName = args[0]
-		}
+// decodeMetric handles fingerprints and tags in rows1, parsing to LabelPair
+func (d *clickDecoder3) decodeMetric(rows *sql.Rows) error {
+	var (
+		cnt         int
+		fingerprint uint64
+		tags        []string
+	)
+	if err := rows.Scan(&cnt, &fingerprint, &tags); err != nil {
+		return err
 	}
-	tbNameMetrics := tbName + "_metrics"
-	tbNameSamples := tbName + "_samples"
-	q.tag = r.click.tag + "/" + dbName + ".[" + tbNameMetrics + "," + tbNameSamples + "]"
 
-	// target sql like:
-	// select * from mode3_samples inner join (select fingerprint from mode3_metrics where name == 'up' group by fingerprint) using fingerprint group by fingerprint, ts order by ts
-
-	// valid time period checker
-	if query.EndTimestampMs < query.StartTimestampMs {
-		slog.Errorf("%s: Start time is after end time", q.tag)
-		return nil
+	sort.Strings(tags)
+	key := strings.Join(tags, "\xff")
+
+	last, ok := d.tagsOfFP[fingerprint]
+	if !ok {
+		d.fingerprints[fingerprint] = makeLabels(tags)
+		d.tagsOfFP[fingerprint]     = key
+	} else if last != key && !d.skipped[fingerprint] {
+		// different series are written with the same fingerprint (by a writer not detected the collision),
+		// their samples are mixed in <table>_samples, so we skip them rather than returning a wrong series
+		d.skipped[fingerprint] = true
+		fingerprintCollisions.WithLabelValues(d.b.click.name, d.plan.db, d.plan.table, "read").Inc()
+		slog.Warnf("reader3: fingerprint %d is shared by different series, skipped: %v, %v", fingerprint, d.fingerprints[fingerprint], makeLabels(tags))
 	}
 
-	q.iStart = query.StartTimestampMs / 1000
-	q.iEnd   = query.EndTimestampMs   / 1000
-	if r.cfg.Utc{
-		q.sStart      = time.Unix(q.iStart, 0).UTC().Format("2006-01-02 15:04:05")
-		q.sEnd        = time.Unix(q.iEnd  , 0).UTC().Format("2006-01-02 15:04:05")
-		q.sStartDate  = time.Unix(q.iStart, 0).UTC().Format("2006-01-02")
-		q.sEndDate    = time.Unix(q.iEnd  , 0).UTC().Format("2006-01-02")
+	return nil
+}
+
+// decodeSample keeps the samples of rows2 by fingerprint, the samples are ordered by fingerprint and time
+func (d *clickDecoder3) decodeSample(rows *sql.Rows) error {
+	var (
+		fingerprint uint64
+		t           int64
+		value       float64
+		stale       uint8
+		cts         []int64
+		cvals       []float64
+		tlast       int64
+		err         error
+	)
+	if d.counter {
+		err = rows.Scan(&fingerprint, &t, &cts, &cvals, &stale, &tlast)
 	} else {
-		q.sStart      = time.Unix(q.iStart, 0).Format("2006-01-02 15:04:05")
-		q.sEnd        = time.Unix(q.iEnd  , 0).Format("2006-01-02 15:04:05")
-		q.sStartDate  = time.Unix(q.iStart, 0).Format("2006-01-02")
-		q.sEndDate    = time.Unix(q.iEnd  , 0).Format("2006-01-02")
+		err = rows.Scan(&fingerprint, &t, &value, &stale)
 	}
-
-	period := q.iEnd - q.iStart
-	step := period / int64(r.cfg.MaxSamples)
-	if step < int64(r.cfg.MinStep) {
-		step = int64(r.cfg.MinStep)
+	if err != nil {
+		return err
 	}
 
-	q.rows = append(q.rows, "fingerprint")
-	q.rows = append(q.rows, fmt.Sprintf("(intDiv(toUInt32(ts), %d) * %d) * 1000 as t", step, step))
-	q.rows = append(q.rows, "anyLast(val) as value")
-
-	q.from = fmt.Sprintf("%s.%s", dbName, tbNameSamples)
-
-
-	var wheres []string
-	wheres = append(wheres, fmt.Sprintf("date >= '%s' AND date <= '%s'", q.sStartDate, q.sEndDate))
-	wheres = append(wheres, r.getMatchWheres(query)...)
-	inSQL := fmt.Sprintf("fingerprint in (select fingerprint from %s.%s where %s group by fingerprint)", dbName, tbNameMetrics, strings.Join(wheres," AND "))
+	if fingerprint != d.lastFP || d.lastTS == nil {
+		ts, ok := d.samples[fingerprint]
+		if !ok {
+			ts = &remote.TimeSeries{}
+			d.samples[fingerprint] = ts
+		}
 
-	q.wheres = append(q.wheres, fmt.Sprintf("ts >= '%s' AND ts <= '%s'", q.sStart, q.sEnd))
-	q.wheres = append(q.wheres, inSQL)
+		d.lastFP   = fingerprint
+		d.lastTS   = ts
+		d.lastTSms = -1			// the first step of a series may be at 0
+	}
 
-	q.groupBy = "fingerprint, t"
-	q.orderBy = "fingerprint, t"
+	// a step, the samples kept are in their own time
+	if d.counter {
+		d.lastTS.Samples = append(d.lastTS.Samples, counterSamples(cts, cvals, stale, tlast)...)
+		return nil
+	}
 
-	q.genSql()
+	// the same as last, append directly
+	if d.lastTSms != t{
+		d.lastTS.Samples = append(d.lastTS.Samples, &remote.Sample{
+			Value       : sampleValue(value, stale),
+			TimestampMs : t,
+		})
+	}
+	d.lastTSms = t
 
-	return q
+	return nil
 }
 
-func (r *clickReader3) getWhereName(query *remote.Query) string {
-	for _, m := range query.Matchers {
-		// __name__ is handled specially - match it directly
-		// as it is stored in the name column (it's also in tags as __name__)
-		// note to self: add name to index.. otherwise this will be slow..
-		if m.Name == model.MetricNameLabel {
-			var whereAdd string
-			switch m.Type {
-			case remote.MatchType_EQUAL:
-				whereAdd = fmt.Sprintf(` name='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
-			case remote.MatchType_NOT_EQUAL:
-				whereAdd = fmt.Sprintf(` name!='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
-			case remote.MatchType_REGEX_MATCH:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 1 `, strings.Replace(m.Value, `/`, `\/`, -1))
-			case remote.MatchType_REGEX_NO_MATCH:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 0 `, strings.Replace(m.Value, `/`, `\/`, -1))
-			}
+func (d *clickDecoder3) done(i int) {
+	if d.isMetrics(i) {
+		for fingerprint := range d.skipped {
+			delete(d.fingerprints, fingerprint)
+			delete(d.tagsOfFP    , fingerprint)
+		}
 
-			return whereAdd
+		// nothing to reuse if no series matched
+		if len(d.fingerprints) > 0 {
+			resolveCache.put(d.plan, d.since, &resolvedSeries{labels: d.fingerprints, tags: d.tagsOfFP})
 		}
 	}
+}
+
+// count returns the num of series matched, the ones without samples are also counted by the first sql
+func (d *clickDecoder3) count(i int) int {
+	if d.isMetrics(i) {
+		return len(d.tagsOfFP)
+	}
 
-	return ""
+	return len(d.samples)
 }
 
+// result builds the series from the samples of the fingerprints found by the first sql
+func (d *clickDecoder3) result() *readResult {
 
-func (r *clickReader3) getMatchWheres(query *remote.Query) []string  {
-
-	var matchWheres []string
-
-	for _, m := range query.Matchers {
-		// __name__ is handled specially - match it directly
-		// as it is stored in the name column (it's also in tags as __name__)
-		// note to self: add name to index.. otherwise this will be slow..
-		if m.Name == model.MetricNameLabel {
-			var whereAdd string
-			switch m.Type {
-			case remote.MatchType_EQUAL:
-				whereAdd = fmt.Sprintf(` name='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
-			case remote.MatchType_NOT_EQUAL:
-				whereAdd = fmt.Sprintf(` name!='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
-			case remote.MatchType_REGEX_MATCH:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 1 `, strings.Replace(m.Value, `/`, `\/`, -1))
-			case remote.MatchType_REGEX_NO_MATCH:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 0 `, strings.Replace(m.Value, `/`, `\/`, -1))
+	for fingerprint, cur := range d.samples {
+		lps, exist := d.fingerprints[fingerprint]
+		if !exist {
+			// ambiguous, or written after the first sql is done
+			if !d.skipped[fingerprint] {
+				slog.Debugf("reader3: fingerprint '%d' can not be found in query1, %d samples skipped", fingerprint, len(cur.Samples))
 			}
-			matchWheres = append(matchWheres, whereAdd)
 			continue
 		}
 
-		switch m.Type {
-		case remote.MatchType_EQUAL:
-			var insql bytes.Buffer
-			asql := "arrayExists(x -> x IN (%s), tags) = 1"
-			// value appears to be | sep'd for multiple matches
-			for i, val := range strings.Split(m.Value, "|") {
-				if len(val) < 1 {
-					continue
-				}
-				if i == 0 {
-					istr := fmt.Sprintf(`'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				} else {
-					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				}
-			}
-			wstr := fmt.Sprintf(asql, insql.String())
-			matchWheres = append(matchWheres, wstr)
-
-		case remote.MatchType_NOT_EQUAL:
-			var insql bytes.Buffer
-			asql := "arrayExists(x -> x IN (%s), tags) = 0"
-			// value appears to be | sep'd for multiple matches
-			for i, val := range strings.Split(m.Value, "|") {
-				if len(val) < 1 {
-					continue
-				}
-				if i == 0 {
-					istr := fmt.Sprintf(`'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				} else {
-					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				}
-			}
-			wstr := fmt.Sprintf(asql, insql.String())
-			matchWheres = append(matchWheres, wstr)
-
-		case remote.MatchType_REGEX_MATCH:
-			asql := `arrayExists(x -> 1 == match(x, '^%s=%s'),tags) = 1`
-			// we can't have ^ in the regexp since keys are stored in arrays of key=value
-			if strings.HasPrefix(m.Value, "^") {
-				val := strings.Replace(m.Value, "^", "", 1)
-				val = strings.Replace(val, `/`, `\/`, -1)
-				matchWheres = append(matchWheres, fmt.Sprintf(asql, m.Name, val))
-			} else {
-				val := strings.Replace(m.Value, `/`, `\/`, -1)
-				matchWheres = append(matchWheres, fmt.Sprintf(asql, m.Name, val))
-			}
-
-		case remote.MatchType_REGEX_NO_MATCH:
-			asql := `arrayExists(x -> 1 == match(x, '^%s=%s'),tags) = 0`
-			if strings.HasPrefix(m.Value, "^") {
-				val := strings.Replace(m.Value, "^", "", 1)
-				val = strings.Replace(val, `/`, `\/`, -1)
-				matchWheres = append(matchWheres, fmt.Sprintf(asql, m.Name, val))
-			} else {
-				val := strings.Replace(m.Value, `/`, `\/`, -1)
-				matchWheres = append(matchWheres, fmt.Sprintf(asql, m.Name, val))
+		key := d.tagsOfFP[fingerprint]
+		ts, ok := d.res.series[key]
+		if !ok {
+			ts = &remote.TimeSeries{
+				Labels: lps,
 			}
+			d.res.series[key] = ts
 		}
+		ts.Samples = append(ts.Samples, cur.Samples...)
+		d.res.samples += int64(len(cur.Samples))
 	}
+	d.samples = nil
 
-	return matchWheres
+	return d.res
 }
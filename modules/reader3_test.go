@@ -0,0 +1,82 @@
+package modules
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func TestDecoder3KeepsStaleness(t *testing.T) {
+
+	api := []string{"__name__=up", "job=api"}
+	web := []string{"__name__=up", "job=web"}
+
+	metrics := [][]driver.Value{
+		{int64(1), uint64(1), api},
+		{int64(1), uint64(2), web},
+	}
+
+	for _, c := range []struct {
+		name       string
+		downsample string
+		step       int64
+		columns    []string
+		rows       [][]driver.Value			// the samples ordered by fingerprint and t
+		want       map[string][]remote.Sample
+	}{
+		// the markers are the raw values with stale set by sqlIsStale
+		{"raw", "last", 0, []string{"fingerprint", "t", "value", "stale"}, [][]driver.Value{
+			{uint64(1), int64(0)    , float64(1), uint8(0)},
+			{uint64(1), int64(15000), staleNaN  , uint8(1)},
+			{uint64(1), int64(30000), float64(3), uint8(0)},
+			{uint64(2), int64(0)    , staleNaN  , uint8(1)},
+		}, map[string][]remote.Sample{
+			strings.Join(api, "\xff"): {{Value: 1, TimestampMs: 0}, {Value: staleNaN, TimestampMs: 15000}, {Value: 3, TimestampMs: 30000}},
+			strings.Join(web, "\xff"): {{Value: staleNaN, TimestampMs: 0}},
+		}},
+		// a step is stale by sqlLastStale, the value is downsampled from the real samples
+		{"steps", "last", 60, []string{"fingerprint", "t", "value", "stale"}, [][]driver.Value{
+			{uint64(1), int64(0)     , float64(1), uint8(0)},
+			{uint64(1), int64(60000) , float64(2), uint8(1)},
+			{uint64(1), int64(120000), float64(0), uint8(1)},
+			{uint64(2), int64(60000) , float64(4), uint8(0)},
+		}, map[string][]remote.Sample{
+			strings.Join(api, "\xff"): {{Value: 1, TimestampMs: 0}, {Value: staleNaN, TimestampMs: 60000}, {Value: staleNaN, TimestampMs: 120000}},
+			strings.Join(web, "\xff"): {{Value: 4, TimestampMs: 60000}},
+		}},
+		// the marker of a counter is at the last sample of the step
+		{"counter", "counter", 60, []string{"fingerprint", "t", "cts", "cvals", "stale", "tlast"}, [][]driver.Value{
+			{uint64(1), int64(0)    , []int64{1000, 5000}, []float64{10, 30}, uint8(0), int64(5000)},
+			{uint64(1), int64(60000), []int64{61000}     , []float64{40}    , uint8(1), int64(62000)},
+			{uint64(2), int64(0)    , []int64{}          , []float64{}      , uint8(1), int64(2000)},
+		}, map[string][]remote.Sample{
+			strings.Join(api, "\xff"): {{Value: 10, TimestampMs: 1000}, {Value: 30, TimestampMs: 5000}, {Value: 40, TimestampMs: 61000}, {Value: staleNaN, TimestampMs: 62000}},
+			strings.Join(web, "\xff"): {{Value: staleNaN, TimestampMs: 2000}},
+		}},
+	} {
+		cfg := newTestReaderCfg()
+		cfg.Mode    = 3
+		cfg.MinStep = 60
+
+		c := c
+		r := newRowsTestReader(t, cfg, &clickBackend3{}, func(query string) ([]string, [][]driver.Value) {
+			if strings.Contains(query, " FROM `prometheus`.`samples_metrics` ") {
+				return []string{"cnt", "fingerprint", "tags"}, metrics
+			}
+			return c.columns, c.rows
+		})
+
+		ds, _ := parseDownsample(c.downsample, 0.75)
+		plan, _ := r.planner.plan(newTestQuery(0, 10, "__name__=up"), "prometheus", "samples", ds)
+		plan.step = c.step
+
+		res, err := r.readPlan(context.Background(), plan)
+		if err != nil {
+			t.Fatalf("%s: read failed: %s", c.name, err)
+		}
+		checkSamples(t, res, c.want)
+	}
+}
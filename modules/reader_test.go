@@ -0,0 +1,399 @@
+package modules
+
+import (
+	"context"
+	"database/sql/driver"
+	"math"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/remote"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	slog = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+// fakeSeries are the series read by newTestReader, with a sample for every minute in [0, 10) minutes
+var fakeSeries = [][]string{
+	{"__name__=up", "job=api"},
+	{"__name__=up", "job=web"},
+	{"__name__=go", "job=api"},
+}
+
+// fakeMatches returns whether the equality matchers select the series with the tags
+func fakeMatches(matchers []*remote.LabelMatcher, tags []string) bool {
+	for _, m := range matchers {
+		found := false
+		for _, tag := range tags {
+			found = found || tag == m.Name + "=" + m.Value
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newTestReader returns a reader reading fakeSeries for the queries, the earlier queries are read slower,
+// so they are done after the later ones
+func newTestReader(cfg *ReaderCfg, queries []*remote.Query) *clickReader {
+
+	r := &clickReader{
+		cfg  : cfg,
+		click: &click{tag: "test", cfg: &ClickCfg{Database: "prometheus", Table: "samples"}},
+		tag  : "reader",
+	}
+	r.planner, _ = newQueryPlanner(cfg)
+	r.limits     = newQueryLimits(cfg)
+
+	r.read = func(ctx context.Context, plan *queryPlan) (*readResult, error) {
+
+		for i, query := range queries {
+			if query == plan.query {
+				time.Sleep(time.Millisecond * time.Duration(10 * (len(queries) - i)))
+			}
+		}
+
+		out := newReadResult()
+		for _, tags := range fakeSeries {
+			if !fakeMatches(plan.query.Matchers, tags) {
+				continue
+			}
+
+			ts := &remote.TimeSeries{Labels: makeLabels(tags)}
+			for i := int64(0); i < 10; i++ {
+				if t := i * 60; t >= plan.start && t <= plan.end {
+					ts.Samples = append(ts.Samples, &remote.Sample{Value: float64(i), TimestampMs: t * 1000})
+				}
+			}
+			if len(ts.Samples) == 0 {
+				continue
+			}
+
+			out.series[strings.Join(tags, "\xff")] = ts
+			out.samples += int64(len(ts.Samples))
+			out.rows    += int64(len(ts.Samples))
+		}
+
+		return out, nil
+	}
+
+	return r
+}
+
+func newTestQuery(startMin int64, endMin int64, matchers ...string) *remote.Query {
+
+	out := &remote.Query{StartTimestampMs: startMin * 60000, EndTimestampMs: endMin * 60000}
+	for _, m := range matchers {
+		kv := strings.SplitN(m, "=", 2)
+		out.Matchers = append(out.Matchers, &remote.LabelMatcher{Name: kv[0], Type: remote.MatchType_EQUAL, Value: kv[1]})
+	}
+
+	return out
+}
+
+func newTestReaderCfg() *ReaderCfg {
+	return &ReaderCfg{MaxSamples: 11000, MinStep: 15, Quantile: 0.75, MaxConcurrency: 2, Downsample: "last"}
+}
+
+// seriesString returns the labels of a series like {__name__="up", job="api"}
+func seriesString(ts *remote.TimeSeries) string {
+
+	var pairs []string
+	for _, l := range ts.Labels {
+		pairs = append(pairs, l.Name + "=\"" + l.Value + "\"")
+	}
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func TestReadResultsOfQueries(t *testing.T) {
+
+	queries := []*remote.Query{
+		newTestQuery(0, 4, "__name__=up"),				// 2 series in [0, 4] minutes
+		newTestQuery(0, 9, "__name__=none"),			// empty in the middle
+		newTestQuery(3, 9, "job=api"),					// 2 series in [3, 9] minutes, one of them is in the first query too
+		newTestQuery(8, 8, "__name__=up", "job=web"),	// a series in the first query, a single minute
+	}
+
+	// the series and the minutes of their samples in the result of every query
+	want := []map[string][]int64{
+		{`{__name__="up", job="api"}`: {0, 1, 2, 3, 4}, `{__name__="up", job="web"}`: {0, 1, 2, 3, 4}},
+		{},
+		{`{__name__="up", job="api"}`: {3, 4, 5, 6, 7, 8, 9}, `{__name__="go", job="api"}`: {3, 4, 5, 6, 7, 8, 9}},
+		{`{__name__="up", job="web"}`: {8}},
+	}
+
+	r := newTestReader(newTestReaderCfg(), queries)
+
+	resp, err := r.HandlePromReadReq(context.Background(), &remote.ReadRequest{Queries: queries}, httptest.NewRequest("POST", "/read", nil))
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	if len(resp.Results) != len(queries) {
+		t.Fatalf("%d results returned for %d queries", len(resp.Results), len(queries))
+	}
+
+	for i, res := range resp.Results {
+		if res == nil {
+			t.Errorf("Results[%d] is nil", i)
+			continue
+		}
+		if len(res.Timeseries) != len(want[i]) {
+			t.Errorf("Results[%d] has %d series, want %d", i, len(res.Timeseries), len(want[i]))
+		}
+
+		for _, ts := range res.Timeseries {
+			minutes, ok := want[i][seriesString(ts)]
+			if !ok {
+				t.Errorf("Results[%d] has unexpected series %s", i, seriesString(ts))
+				continue
+			}
+			if len(ts.Samples) != len(minutes) {
+				t.Errorf("Results[%d] series %s has %d samples, want %d", i, seriesString(ts), len(ts.Samples), len(minutes))
+				continue
+			}
+			for j, s := range ts.Samples {
+				if s.TimestampMs != minutes[j] * 60000 {
+					t.Errorf("Results[%d] series %s sample %d at %d, want %d", i, seriesString(ts), j, s.TimestampMs, minutes[j] * 60000)
+				}
+			}
+		}
+	}
+}
+
+func TestReadSeriesLimitOfRequest(t *testing.T) {
+
+	queries := []*remote.Query{
+		newTestQuery(0, 9, "__name__=up"),
+		newTestQuery(0, 9, "job=api"),
+	}
+
+	// 2 series per query, but 4 in the request
+	cfg := newTestReaderCfg()
+	cfg.MaxSeries = 3
+
+	r := newTestReader(cfg, queries)
+
+	_, err := r.HandlePromReadReq(context.Background(), &remote.ReadRequest{Queries: queries}, httptest.NewRequest("POST", "/read", nil))
+	if _, ok := err.(*queryLimitError); !ok {
+		t.Fatalf("read returns %v, want a queryLimitError", err)
+	}
+}
+
+// emptyBackend renders no sql for any plan
+type emptyBackend struct {
+	clickBackend1
+}
+
+func (b *emptyBackend) render(plan *queryPlan, dec rowsDecoder) []*sqlQuery {
+	return nil
+}
+
+func TestReadPlanWithoutSql(t *testing.T) {
+
+	queries := []*remote.Query{newTestQuery(0, 9, "__name__=up")}
+
+	r := newTestReader(newTestReaderCfg(), queries)
+	r.backend = &emptyBackend{}
+	r.read    = r.readPlan
+
+	if _, err := r.HandlePromReadReq(context.Background(), &remote.ReadRequest{Queries: queries}, httptest.NewRequest("POST", "/read", nil)); err == nil {
+		t.Fatalf("read returns no error for a plan without sql")
+	}
+}
+
+func TestSqlQueryTagsOfParallelQueries(t *testing.T) {
+
+	tags := make([]string, 100)
+	runBounded(context.Background(), len(tags), 8, func(ctx context.Context, i int) error {
+		tags[i] = newSqlQuery(nil).tag
+		return nil
+	})
+
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		if seen[tag] {
+			t.Fatalf("tag %s is used by more than one query", tag)
+		}
+		seen[tag] = true
+	}
+}
+
+func TestReadChecksDbTable(t *testing.T) {
+
+	queries := []*remote.Query{newTestQuery(0, 9, "__name__=up")}
+
+	r := newTestReader(newTestReaderCfg(), queries)
+
+	for _, url := range []string{
+		"/read?table=samples%20WHERE%201%3D1%3B--",
+		"/read?db=system.tables",
+		"/read?db=",
+	} {
+		_, err := r.HandlePromReadReq(context.Background(), &remote.ReadRequest{Queries: queries}, httptest.NewRequest("POST", url, nil))
+		if _, ok := err.(*queryError); !ok {
+			t.Errorf("read %s returns %v, want a queryError", url, err)
+		}
+	}
+
+	if _, err := r.HandlePromReadReq(context.Background(), &remote.ReadRequest{Queries: queries}, httptest.NewRequest("POST", "/read?db=metrics&table=samples_2", nil)); err != nil {
+		t.Errorf("read of a valid db.table failed: %s", err)
+	}
+}
+
+func TestRenderQuotesTables(t *testing.T) {
+
+	p, _ := newQueryPlanner(newTestReaderCfg())
+	plan, _ := p.plan(newTestQuery(0, 3600, "__name__=up", "job=api"), "prometheus", "samples", nil)
+
+	backends := []readBackend{&clickBackend1{}, &clickBackend2{}, &clickBackend3{click: &click{name: "test"}, labelIndex: true}}
+	for _, b := range backends {
+		for _, q := range b.render(plan, b.newDecoder(plan)) {
+			q.genSql()
+
+			if !strings.Contains(q.sql, " FROM `prometheus`.`samples") && !strings.Contains(q.sql, "from `prometheus`.`samples") {
+				t.Errorf("mode %d: the table is not quoted: %s", b.mode(), q.sql)
+			}
+			if strings.Contains(q.sql, " prometheus.samples") {
+				t.Errorf("mode %d: a table is not quoted: %s", b.mode(), q.sql)
+			}
+		}
+	}
+}
+
+// newRowsTestReader returns a reader of backend reading the rows returned by fakeClick for the sqls
+func newRowsTestReader(t *testing.T, cfg *ReaderCfg, backend readBackend, rows func(query string) ([]string, [][]driver.Value)) *clickReader {
+
+	click, fc := newFakeClick(t)
+	fc.rows = rows
+
+	if b, ok := backend.(*clickBackend3); ok {
+		b.click = click
+	}
+
+	r := &clickReader{cfg: cfg, click: click, backend: backend, tag: "reader"}
+	r.planner, _ = newQueryPlanner(cfg)
+	r.limits     = newQueryLimits(cfg)
+
+	return r
+}
+
+// checkSamples checks the samples of the series of tags, the staleness markers are compared by their bits
+func checkSamples(t *testing.T, res *readResult, want map[string][]remote.Sample) {
+
+	if len(res.series) != len(want) {
+		t.Errorf("%d series read, want %d", len(res.series), len(want))
+	}
+	for key, samples := range want {
+		ts, ok := res.series[key]
+		if !ok {
+			t.Errorf("series %q not read", key)
+			continue
+		}
+		if len(ts.Samples) != len(samples) {
+			t.Errorf("series %q has %d samples, want %d", key, len(ts.Samples), len(samples))
+			continue
+		}
+		for i, s := range ts.Samples {
+			if w := samples[i]; s.TimestampMs != w.TimestampMs || math.Float64bits(s.Value) != math.Float64bits(w.Value) {
+				t.Errorf("series %q sample %d is %v@%d (stale: %v), want %v@%d (stale: %v)", key, i, s.Value, s.TimestampMs, isStaleNaN(s.Value), w.Value, w.TimestampMs, isStaleNaN(w.Value))
+			}
+		}
+	}
+}
+
+func TestDecoder1KeepsStaleness(t *testing.T) {
+
+	tags := []string{"__name__=up", "job=api"}
+
+	for _, c := range []struct {
+		downsample string
+		columns    []string
+		rows       [][]driver.Value
+		want       []remote.Sample
+	}{
+		// a step is stale if its last sample is a marker, the value is downsampled from the real ones
+		{"last", []string{"CNT", "t", "name", "tags", "value", "stale"}, [][]driver.Value{
+			{int64(2), int64(0)     , "up", tags, float64(1), uint8(0)},
+			{int64(2), int64(60000) , "up", tags, float64(2), uint8(1)},
+			{int64(1), int64(120000), "up", tags, float64(0), uint8(1)},
+			{int64(1), int64(180000), "up", tags, staleNaN  , uint8(1)},
+			{int64(1), int64(240000), "up", tags, float64(5), uint8(0)},
+		}, []remote.Sample{{Value: 1, TimestampMs: 0}, {Value: staleNaN, TimestampMs: 60000}, {Value: staleNaN, TimestampMs: 120000}, {Value: staleNaN, TimestampMs: 180000}, {Value: 5, TimestampMs: 240000}}},
+		// the marker of a counter is at the last sample of the step
+		{"counter", []string{"CNT", "t", "name", "tags", "cts", "cvals", "stale", "tlast"}, [][]driver.Value{
+			{int64(2), int64(0)    , "up", tags, []int64{1000, 5000}, []float64{10, 30}, uint8(0), int64(5000)},
+			{int64(2), int64(60000), "up", tags, []int64{61000}     , []float64{40}    , uint8(1), int64(62000)},
+			{int64(1), int64(120000), "up", tags, []int64{}         , []float64{}      , uint8(1), int64(121000)},
+		}, []remote.Sample{{Value: 10, TimestampMs: 1000}, {Value: 30, TimestampMs: 5000}, {Value: 40, TimestampMs: 61000}, {Value: staleNaN, TimestampMs: 62000}, {Value: staleNaN, TimestampMs: 121000}}},
+	} {
+		cfg := newTestReaderCfg()
+		cfg.MinStep = 60
+
+		c := c
+		r := newRowsTestReader(t, cfg, &clickBackend1{}, func(query string) ([]string, [][]driver.Value) {
+			return c.columns, c.rows
+		})
+
+		ds, _ := parseDownsample(c.downsample, 0.75)
+		plan, _ := r.planner.plan(newTestQuery(0, 10, "__name__=up"), "prometheus", "samples", ds)
+
+		res, err := r.readPlan(context.Background(), plan)
+		if err != nil {
+			t.Fatalf("%s: read failed: %s", c.downsample, err)
+		}
+		checkSamples(t, res, map[string][]remote.Sample{strings.Join(tags, "\xff"): c.want})
+	}
+}
+
+func TestRenderStaleness(t *testing.T) {
+
+	if sqlIsStale != "reinterpretAsUInt64(val) = 9218868437227405314" || sqlLastStale != "argMax(" + sqlIsStale + ", ts)" {
+		t.Fatalf("sqlIsStale = %s, sqlLastStale = %s", sqlIsStale, sqlLastStale)
+	}
+	if !isStaleNaN(staleNaN) || isStaleNaN(math.NaN()) || !math.IsNaN(staleNaN) {
+		t.Errorf("staleNaN is not the marker of prometheus")
+	}
+	if !isStaleNaN(sampleValue(1, 1)) || sampleValue(1, 0) != 1 {
+		t.Errorf("sampleValue does not return the marker for the stale")
+	}
+
+	p, _ := newQueryPlanner(newTestReaderCfg())
+
+	for _, c := range []struct {
+		backend readBackend
+		step    int64
+		stale   string		// the stale column of the sql of samples
+	}{
+		{&clickBackend1{}, 60, sqlLastStale},
+		{&clickBackend2{}, 60, sqlIsStale},
+		{&clickBackend3{click: &click{name: "test"}}, 60, sqlLastStale},
+		{&clickBackend3{click: &click{name: "test"}}, 0 , sqlIsStale},
+	} {
+		for _, ds := range []string{"last", "counter"} {
+			d, _ := parseDownsample(ds, 0.75)
+			plan, _ := p.plan(newTestQuery(0, 60, "__name__=up"), "prometheus", "samples", d)
+			plan.step = c.step
+
+			sqls := c.backend.render(plan, c.backend.newDecoder(plan))
+			q := sqls[len(sqls) - 1]
+			q.genSql()
+
+			if !strings.Contains(q.sql, ", " + c.stale + " as stale") {
+				t.Errorf("mode %d, step %d, %s: the stale column is not %s: %s", c.backend.mode(), c.step, ds, c.stale, q.sql)
+			}
+			if c.stale == sqlIsStale && strings.Contains(q.sql, "argMax(") {
+				t.Errorf("mode %d, step %d, %s: the raw samples are aggregated: %s", c.backend.mode(), c.step, ds, q.sql)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package modules
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+var (
+	resolveCacheSize      = prometheus.NewGauge     (prometheus.GaugeOpts  {Name: "read_fingerprint_cache_size"           , Help: "Number of matcher sets in the fingerprint cache of reader."})
+	resolveCacheHits      = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "read_fingerprint_cache_hits_total"     , Help: "Total number of queries whose fingerprints are found in the fingerprint cache of reader."}, []string{"server", "db", "table"})
+	resolveCacheMisses    = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "read_fingerprint_cache_misses_total"   , Help: "Total number of queries whose fingerprints are not found in the fingerprint cache of reader."}, []string{"server", "db", "table"})
+	resolveCacheEvictions = prometheus.NewCounter   (prometheus.CounterOpts{Name: "read_fingerprint_cache_evictions_total", Help: "Total number of entries evicted from the fingerprint cache of reader because it's full."})
+)
+
+func init() {
+	prometheus.MustRegister(resolveCacheSize)
+	prometheus.MustRegister(resolveCacheHits)
+	prometheus.MustRegister(resolveCacheMisses)
+	prometheus.MustRegister(resolveCacheEvictions)
+}
+
+// resolveCache is the global fingerprint cache of reader, nil if not enabled
+var resolveCache *seriesResolveCache
+
+// resolvedSeries is the fingerprints (and their labels) matched by a matcher set in a date range,
+// it's shared by the queries, do not modify it
+type resolvedSeries struct {
+	labels map[uint64][]*remote.LabelPair
+	tags   map[uint64]string				// the tags joined with '\xff', the key of series
+}
+
+type resolveEntry struct {
+	key      string
+	table    string				// db.table
+	first    int32				// the dates of the range, like 20200501
+	last     int32
+	created  time.Time
+	series   *resolvedSeries
+}
+
+// seriesResolveCache caches the fingerprints resolved from <table>_metrics by the matchers and dates of queries in mode 3,
+// so the dashboards refreshing the same selectors will not scan <table>_metrics every time.
+// an entry expires in ttl, and it's invalidated when the writer in the same process writes new fingerprints in its dates,
+// the writers in other processes can not be seen, so the new series written by them may be missed in ttl
+type seriesResolveCache struct {
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List					// entries in the order of last use
+	touched   map[string]map[int32]time.Time	// db.table -> date -> the last time new fingerprints written
+	cleared   map[string]time.Time				// db.table -> the last time all its entries are dropped
+	ttl       time.Duration
+	maxSize   int
+	maxSeries int
+}
+
+func newSeriesResolveCache(cfg *ResolveCacheCfg) *seriesResolveCache {
+	return &seriesResolveCache{
+		entries  : map[string]*list.Element{},
+		lru      : list.New(),
+		touched  : map[string]map[int32]time.Time{},
+		cleared  : map[string]time.Time{},
+		ttl      : time.Second * time.Duration(cfg.Ttl),
+		maxSize  : cfg.MaxSize,
+		maxSeries: cfg.MaxSeries,
+	}
+}
+
+// dateNum returns the date like 20200501
+func dateNum(t time.Time) int32 {
+	y, m, d := t.Date()
+	return int32(y * 10000 + int(m) * 100 + d)
+}
+
+// resolveKey returns the key of the matchers of query in the dates of plan, the order of matchers does not matter
+func resolveKey(plan *queryPlan) string {
+	return strings.Join([]string{plan.db, plan.table, plan.sStartDate, plan.sEndDate, sortedMatchersString(plan.query.Matchers)}, "\xff")
+}
+
+// get returns the series resolved for plan, nil if not found or expired
+func (c *seriesResolveCache) get(plan *queryPlan) *resolvedSeries {
+
+	if c == nil {
+		return nil
+	}
+
+	key := resolveKey(plan)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, exist := c.entries[key]
+	if !exist {
+		return nil
+	}
+
+	entry := e.Value.(*resolveEntry)
+	if time.Now().Sub(entry.created) > c.ttl || c.isTouched(entry) {
+		c.drop(e)
+		return nil
+	}
+	c.lru.MoveToBack(e)
+
+	return entry.series
+}
+
+// put caches the series resolved for plan, the resolving started at since,
+// it's not cached if new fingerprints written in its dates or the table is cleared after since
+func (c *seriesResolveCache) put(plan *queryPlan, since time.Time, series *resolvedSeries) {
+
+	if c == nil || c.maxSeries > 0 && len(series.labels) > c.maxSeries {
+		return
+	}
+
+	entry := &resolveEntry{
+		key    : resolveKey(plan),
+		table  : plan.db + "." + plan.table,
+		first  : dateNum(metricDate(time.Unix(plan.start, 0))),
+		last   : dateNum(metricDate(time.Unix(plan.end  , 0))),
+		created: since,
+		series : series,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, exist := c.cleared[entry.table]; exist && !t.Before(since) {
+		return
+	}
+	if c.isTouched(entry) {
+		return
+	}
+	if e, exist := c.entries[entry.key]; exist {
+		c.drop(e)
+	}
+	for c.maxSize > 0 && c.lru.Len() >= c.maxSize {
+		c.drop(c.lru.Front())
+		resolveCacheEvictions.Inc()
+	}
+
+	c.entries[entry.key] = c.lru.PushBack(entry)
+	resolveCacheSize.Inc()
+}
+
+// isTouched returns whether new fingerprints are written in the dates of entry after it's created
+func (c *seriesResolveCache) isTouched(entry *resolveEntry) bool {
+	for date, t := range c.touched[entry.table] {
+		if date >= entry.first && date <= entry.last && !t.Before(entry.created) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *seriesResolveCache) drop(e *list.Element) {
+	delete(c.entries, e.Value.(*resolveEntry).key)
+	c.lru.Remove(e)
+	resolveCacheSize.Dec()
+}
+
+// invalidate is called by writer when new fingerprints of the dates are written to db.table
+func (c *seriesResolveCache) invalidate(db string, table string, dates []int32) {
+
+	if c == nil || len(dates) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	touched, exist := c.touched[db + "." + table]
+	if !exist {
+		touched = map[int32]time.Time{}
+		c.touched[db + "." + table] = touched
+	}
+	for _, date := range dates {
+		touched[date] = now
+	}
+
+	// the dates touched before ttl do not matter any more
+	for date, t := range touched {
+		if now.Sub(t) > c.ttl {
+			delete(touched, date)
+		}
+	}
+}
+
+// invalidateTable drops all the entries of db.table, like when series are deleted
+func (c *seriesResolveCache) invalidateTable(db string, table string) {
+
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cleared[db + "." + table] = time.Now()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*resolveEntry).table == db + "." + table {
+			c.drop(e)
+		}
+		e = next
+	}
+}
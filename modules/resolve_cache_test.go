@@ -0,0 +1,186 @@
+package modules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// newResolveTestPlan returns a plan of the matchers in [start, end] (in seconds) in utc
+func newResolveTestPlan(t *testing.T, table string, start int64, end int64, matchers ...string) *queryPlan {
+
+	cfg := newTestReaderCfg()
+	cfg.Utc = true
+
+	p, _ := newQueryPlanner(cfg)
+	query := newTestQuery(0, 0, matchers...)
+	query.StartTimestampMs = start * 1000
+	query.EndTimestampMs   = end   * 1000
+
+	plan, err := p.plan(query, "prometheus", table, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return plan
+}
+
+// newResolvedSeries returns the series of n fingerprints from 1
+func newResolvedSeries(n int) *resolvedSeries {
+
+	out := &resolvedSeries{labels: map[uint64][]*remote.LabelPair{}, tags: map[uint64]string{}}
+	for i := 1; i <= n; i++ {
+		out.labels[uint64(i)] = makeLabels([]string{"__name__=up"})
+		out.tags  [uint64(i)] = "__name__=up"
+	}
+
+	return out
+}
+
+func TestResolveCache(t *testing.T) {
+
+	utc := Cfg.Reader.Utc
+	defer func() { Cfg.Reader.Utc = utc }()
+	Cfg.Reader.Utc = true
+
+	// 2020-05-01 00:00:00 to 2020-05-02 12:00:00 in utc
+	const start, end = 1588291200, 1588291200 + 86400 + 43200
+
+	cases := []struct {
+		name       string
+		maxSeries  int
+		series     int
+		age        time.Duration		// how long before the resolving started
+		invalidate func(c *seriesResolveCache)
+		cached     bool
+	}{
+		{"cached"                       , 0, 3, 0, nil, true},
+		{"max series"                   , 2, 3, 0, nil, false},
+		{"under max series"             , 3, 3, 0, nil, true},
+		{"expired"                      , 0, 3, time.Minute * 2, nil, false},
+		{"new fingerprints in dates"    , 0, 3, 0, func(c *seriesResolveCache) { c.invalidate("prometheus", "samples", []int32{20200502}) }, false},
+		{"new fingerprints out of dates", 0, 3, 0, func(c *seriesResolveCache) { c.invalidate("prometheus", "samples", []int32{20200430, 20200503}) }, true},
+		{"new fingerprints of others"   , 0, 3, 0, func(c *seriesResolveCache) { c.invalidate("prometheus", "others", []int32{20200501}) }, true},
+		{"no dates"                     , 0, 3, 0, func(c *seriesResolveCache) { c.invalidate("prometheus", "samples", nil) }, true},
+		{"table cleared"                , 0, 3, 0, func(c *seriesResolveCache) { c.invalidateTable("prometheus", "samples") }, false},
+		{"other table cleared"          , 0, 3, 0, func(c *seriesResolveCache) { c.invalidateTable("prometheus", "others") }, true},
+	}
+
+	for _, c := range cases {
+		cache := newSeriesResolveCache(&ResolveCacheCfg{MaxSize: 10, Ttl: 60, MaxSeries: c.maxSeries})
+		plan  := newResolveTestPlan(t, "samples", start, end, "__name__=up", "job=api")
+
+		cache.put(plan, time.Now().Add(-c.age), newResolvedSeries(c.series))
+		if c.invalidate != nil {
+			c.invalidate(cache)
+		}
+
+		// the order of matchers does not matter
+		got := cache.get(newResolveTestPlan(t, "samples", start, end, "job=api", "__name__=up"))
+		if (got != nil) != c.cached {
+			t.Errorf("%s: cached %v, want %v", c.name, got != nil, c.cached)
+		}
+		if got != nil && len(got.labels) != c.series {
+			t.Errorf("%s: %d series cached, want %d", c.name, len(got.labels), c.series)
+		}
+	}
+}
+
+func TestResolveCachePutAfterInvalidated(t *testing.T) {
+
+	utc := Cfg.Reader.Utc
+	defer func() { Cfg.Reader.Utc = utc }()
+	Cfg.Reader.Utc = true
+
+	plan := newResolveTestPlan(t, "samples", 1588291200, 1588291200 + 3600, "__name__=up")
+
+	// the fingerprints resolved before the writer wrote new ones in the dates may miss them
+	for _, invalidate := range []func(c *seriesResolveCache){
+		func(c *seriesResolveCache) { c.invalidate("prometheus", "samples", []int32{20200501}) },
+		func(c *seriesResolveCache) { c.invalidateTable("prometheus", "samples") },
+	} {
+		cache := newSeriesResolveCache(&ResolveCacheCfg{MaxSize: 10, Ttl: 60})
+
+		since := time.Now()
+		invalidate(cache)
+		cache.put(plan, since, newResolvedSeries(1))
+		if cache.get(plan) != nil {
+			t.Errorf("the series resolved before invalidated are cached")
+		}
+
+		cache.put(plan, time.Now().Add(time.Millisecond), newResolvedSeries(1))
+		if cache.get(plan) == nil {
+			t.Errorf("the series resolved after invalidated are not cached")
+		}
+	}
+}
+
+func TestResolveCacheEvictsAndInvalidatesTable(t *testing.T) {
+
+	utc := Cfg.Reader.Utc
+	defer func() { Cfg.Reader.Utc = utc }()
+	Cfg.Reader.Utc = true
+
+	cache := newSeriesResolveCache(&ResolveCacheCfg{MaxSize: 2, Ttl: 60})
+
+	a := newResolveTestPlan(t, "samples", 1588291200, 1588291200 + 3600, "__name__=a")
+	b := newResolveTestPlan(t, "samples", 1588291200, 1588291200 + 3600, "__name__=b")
+	o := newResolveTestPlan(t, "others" , 1588291200, 1588291200 + 3600, "__name__=a")
+
+	cache.put(a, time.Now(), newResolvedSeries(1))
+	cache.put(b, time.Now(), newResolvedSeries(1))
+	cache.get(a)
+	cache.put(o, time.Now(), newResolvedSeries(1))
+
+	// b is the least recently used
+	if cache.get(a) == nil || cache.get(b) != nil || cache.get(o) == nil {
+		t.Fatalf("the least recently used is not evicted")
+	}
+
+	cache.invalidateTable("prometheus", "samples")
+	if cache.get(a) != nil || cache.get(o) == nil || cache.lru.Len() != 1 {
+		t.Errorf("invalidateTable drops %d entries, want the one of the table", 2 - cache.lru.Len())
+	}
+
+	// the cache not enabled
+	var none *seriesResolveCache
+	none.put(a, time.Now(), newResolvedSeries(1))
+	none.invalidate("prometheus", "samples", []int32{20200501})
+	none.invalidateTable("prometheus", "samples")
+	if none.get(a) != nil {
+		t.Errorf("get of nil cache returns series")
+	}
+}
+
+func TestResolveCacheInvalidatedByWriter(t *testing.T) {
+
+	utc := Cfg.Reader.Utc
+	defer func() { Cfg.Reader.Utc = utc }()
+	Cfg.Reader.Utc = true
+
+	cache := resolveCache
+	defer func() { resolveCache = cache }()
+	resolveCache = newSeriesResolveCache(&ResolveCacheCfg{MaxSize: 10, Ttl: 60})
+
+	co, _ := newFakeClickOutput(t)
+	sh := co.shards[0]
+
+	now   := time.Now()
+	today := newResolveTestPlan(t, "samples", now.Unix() - 60, now.Unix(), "__name__=up")
+	past  := newResolveTestPlan(t, "samples", now.Unix() - 3 * 86400, now.Unix() - 2 * 86400, "__name__=up")
+
+	resolveCache.put(today, time.Now(), newResolvedSeries(1))
+	resolveCache.put(past , time.Now(), newResolvedSeries(1))
+
+	// a new series today
+	handleSeries(sh, now, "__name__=up", "job=api")
+	sh.flush()
+
+	if resolveCache.get(today) != nil {
+		t.Errorf("the fingerprints of today are cached after the writer wrote a new one")
+	}
+	if resolveCache.get(past) == nil {
+		t.Errorf("the fingerprints of the past days are dropped by the writer")
+	}
+}
@@ -0,0 +1,284 @@
+package modules
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+var (
+	resultsCacheSamples   = prometheus.NewGauge     (prometheus.GaugeOpts  {Name: "read_results_cache_samples"          , Help: "Number of samples in the results cache of reader."})
+	resultsCacheHits      = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "read_results_cache_hits_total"       , Help: "Total number of intervals of queries found in the results cache of reader."}, []string{"server", "db", "table"})
+	resultsCacheMisses    = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "read_results_cache_misses_total"     , Help: "Total number of intervals of queries not found in the results cache of reader."}, []string{"server", "db", "table"})
+	resultsCacheEvictions = prometheus.NewCounter   (prometheus.CounterOpts{Name: "read_results_cache_evictions_total"  , Help: "Total number of intervals evicted from the results cache of reader because it's full."})
+)
+
+func init() {
+	prometheus.MustRegister(resultsCacheSamples)
+	prometheus.MustRegister(resultsCacheHits)
+	prometheus.MustRegister(resultsCacheMisses)
+	prometheus.MustRegister(resultsCacheEvictions)
+}
+
+// resultsCache is the global results cache of reader, nil if not enabled
+var resultsCache *queryResultsCache
+
+type resultsEntry struct {
+	key      string
+	table    string				// db.table
+	last     int64				// the end of interval, in seconds
+	created  time.Time
+	res      *readResult		// shared by the queries, do not modify it
+	size     int64
+}
+
+// queryResultsCache caches the results of the past intervals of queries, a query is split to the intervals aligned to
+// the days (in the zone of reader) and to its step, the intervals ended before max freshness are read from cache,
+// and the recent tail is always read from clickhouse, so the dashboards refreshing a long range only read the tail.
+// an entry expires in ttl, and the entries of a table are dropped when the writer in the same process writes samples
+// into their intervals (delayed or imported) or series are deleted
+type queryResultsCache struct {
+	mu           sync.Mutex
+	entries      map[string]*list.Element
+	lru          *list.List				// entries in the order of last use
+	touched      map[string]time.Time	// db.table -> the last time its entries are invalidated
+	size         int64					// num of samples cached
+	ttl          time.Duration
+	maxSize      int64
+	maxFreshness int64					// in seconds
+}
+
+func newQueryResultsCache(cfg *ResultsCacheCfg) *queryResultsCache {
+	return &queryResultsCache{
+		entries     : map[string]*list.Element{},
+		lru         : list.New(),
+		touched     : map[string]time.Time{},
+		ttl         : time.Second * time.Duration(cfg.Ttl),
+		maxSize     : cfg.MaxSize,
+		maxFreshness: int64(cfg.MaxFreshness),
+	}
+}
+
+// resultsKey returns the key prefix of the intervals of plan, the start of interval is appended to it
+func resultsKey(plan *queryPlan) string {
+	return strings.Join([]string{plan.db, plan.table, strconv.FormatInt(plan.step, 10), plan.downsample.String(), sortedMatchersString(plan.query.Matchers), ""}, "\xff")
+}
+
+// alignStep returns t (in seconds) aligned down to step, the samples in a step are never split by the aligned times
+func alignStep(t int64, step int64) int64 {
+	if step <= 0 {
+		return t
+	}
+
+	return t - t % step
+}
+
+// get returns the result of the interval of key, nil if not found or expired
+func (c *queryResultsCache) get(key string) *readResult {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, exist := c.entries[key]
+	if !exist {
+		return nil
+	}
+
+	entry := e.Value.(*resultsEntry)
+	if time.Now().Sub(entry.created) > c.ttl {
+		c.drop(e)
+		return nil
+	}
+	c.lru.MoveToBack(e)
+
+	return entry.res
+}
+
+// put caches the result of the interval of key ended at last, the reading started at since,
+// it's not cached if the table is invalidated after since
+func (c *queryResultsCache) put(key string, plan *queryPlan, last int64, since time.Time, res *readResult) {
+
+	size := res.samples + int64(len(res.series))
+	if size > c.maxSize {
+		return
+	}
+
+	entry := &resultsEntry{
+		key    : key,
+		table  : plan.db + "." + plan.table,
+		last   : last,
+		created: since,
+		res    : res,
+		size   : size,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, exist := c.touched[entry.table]; exist && !t.Before(since) {
+		return
+	}
+	if e, exist := c.entries[key]; exist {
+		c.drop(e)
+	}
+	for c.lru.Len() > 0 && c.size + size > c.maxSize {
+		c.drop(c.lru.Front())
+		resultsCacheEvictions.Inc()
+	}
+
+	c.entries[key] = c.lru.PushBack(entry)
+	c.size += size
+	resultsCacheSamples.Add(float64(size))
+}
+
+func (c *queryResultsCache) drop(e *list.Element) {
+	entry := e.Value.(*resultsEntry)
+	delete(c.entries, entry.key)
+	c.lru.Remove(e)
+	c.size -= entry.size
+	resultsCacheSamples.Sub(float64(entry.size))
+}
+
+// invalidateSince is called by writer when the samples since t are written to db.table,
+// only the ones older than max freshness may change the cached intervals
+func (c *queryResultsCache) invalidateSince(db string, table string, t time.Time) {
+
+	if c == nil || t.Unix() >= time.Now().Unix() - c.maxFreshness {
+		return
+	}
+
+	c.invalidate(db + "." + table, t.Unix())
+}
+
+// invalidateTable drops all the entries of db.table, like when series are deleted
+func (c *queryResultsCache) invalidateTable(db string, table string) {
+
+	if c == nil {
+		return
+	}
+
+	c.invalidate(db + "." + table, 0)
+}
+
+// invalidate drops the entries of table ended at or after since
+func (c *queryResultsCache) invalidate(table string, since int64) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.touched[table] = time.Now()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*resultsEntry); entry.table == table && entry.last >= since {
+			c.drop(e)
+		}
+		e = next
+	}
+}
+
+// trim returns a copy of r with the samples in [startMs, endMs], the series without samples are dropped
+func (r *readResult) trim(startMs int64, endMs int64) *readResult {
+
+	out := newReadResult()
+	for key, ts := range r.series {
+		var samples []*remote.Sample
+		for _, s := range ts.Samples {
+			if s.TimestampMs >= startMs && s.TimestampMs <= endMs {
+				samples = append(samples, s)
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+
+		out.series[key] = &remote.TimeSeries{Labels: ts.Labels, Samples: samples}
+		out.samples += int64(len(samples))
+	}
+
+	return out
+}
+
+// intervalOf returns the interval [first, next) containing t (in seconds), aligned to the days in the zone of reader and to step
+func (r *clickReader) intervalOf(t int64, step int64) (int64, int64) {
+
+	loc := time.Local
+	if r.cfg.Utc {
+		loc = time.UTC
+	}
+
+	y, m, d := time.Unix(t, 0).In(loc).Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, loc)
+
+	first := alignStep(day.Unix(), step)
+	next  := alignStep(day.AddDate(0, 0, 1).Unix(), step)
+	if t >= next {
+		// the samples of the last step of the day are in the next interval
+		first = next
+		next  = alignStep(day.AddDate(0, 0, 2).Unix(), step)
+	}
+
+	return first, next
+}
+
+// readCached reads plan by the intervals, the past ones are read from resultsCache and cached if missed,
+// the tail in max freshness is read directly
+func (r *clickReader) readCached(ctx context.Context, plan *queryPlan) (*readResult, error) {
+
+	// the raw samples and the steps longer than a day are not split
+	if resultsCache == nil || plan.step <= 0 || plan.step > 86400 {
+		return r.readPlan(ctx, plan)
+	}
+
+	fresh  := time.Now().Unix() - resultsCache.maxFreshness
+	prefix := resultsKey(plan)
+
+	res := newReadResult()
+	for from := plan.start; from <= plan.end; {
+		first, next := r.intervalOf(from, plan.step)
+
+		// the interval may still be written, read the left directly
+		if next - 1 >= fresh {
+			cur, err := r.readPlan(ctx, r.planner.rangeOf(plan, from, plan.end))
+			if err != nil {
+				return nil, err
+			}
+			res.merge(cur)
+			break
+		}
+
+		key := prefix + strconv.FormatInt(first, 10)
+
+		var rows int64
+		cur := resultsCache.get(key)
+		if cur != nil {
+			resultsCacheHits.WithLabelValues(r.click.name, plan.db, plan.table).Inc()
+		} else {
+			resultsCacheMisses.WithLabelValues(r.click.name, plan.db, plan.table).Inc()
+
+			// the whole interval is read, so it can be reused by the queries starting in it
+			since := time.Now()
+			var err error
+			if cur, err = r.readPlan(ctx, r.planner.rangeOf(plan, first, next - 1)); err != nil {
+				return nil, err
+			}
+			resultsCache.put(key, plan, next - 1, since, cur)
+			rows = cur.rows
+		}
+
+		// the samples are copied, so the cached ones will not be changed by merging
+		part := cur.trim(alignStep(from, plan.step) * 1000, plan.end * 1000)
+		part.rows = rows
+		res.merge(part)
+
+		from = next
+	}
+
+	return res, nil
+}
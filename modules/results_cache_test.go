@@ -0,0 +1,258 @@
+package modules
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func TestIntervalOf(t *testing.T) {
+
+	local := time.Local
+	defer func() { time.Local = local }()
+	time.Local = time.FixedZone("UTC+8", 8 * 3600)
+
+	// 2020-05-01 is 1588291200 in utc, 1588262400 in utc+8, 25200 (7h) does not divide a day
+	cases := []struct {
+		utc   bool
+		t     int64
+		step  int64
+		first int64
+		next  int64
+	}{
+		{true , 1588291200, 60   , 1588291200, 1588377600},
+		{true , 1588377599, 60   , 1588291200, 1588377600},
+		{true , 1588294800, 25200, 1588280400, 1588356000},
+		// the last step of a day is in the interval of the next day
+		{true , 1588370000, 25200, 1588356000, 1588456800},
+		{true , 1588291199, 25200, 1588280400, 1588356000},
+		{true , 1588280399, 25200, 1588204800, 1588280400},
+		// the days of the zone of reader
+		{false, 1588291200, 60   , 1588262400, 1588348800},
+		{false, 1588262399, 60   , 1588176000, 1588262400},
+		{false, 1588291200, 25200, 1588255200, 1588330800},
+	}
+
+	for _, c := range cases {
+		r := &clickReader{cfg: &ReaderCfg{Utc: c.utc}}
+
+		first, next := r.intervalOf(c.t, c.step)
+		if first != c.first || next != c.next {
+			t.Errorf("intervalOf(utc: %v, %d, %d) = [%d, %d), want [%d, %d)", c.utc, c.t, c.step, first, next, c.first, c.next)
+		}
+		if c.t < first || c.t >= next || first % c.step != 0 || next % c.step != 0 {
+			t.Errorf("intervalOf(utc: %v, %d, %d) = [%d, %d) does not contain it or is not aligned", c.utc, c.t, c.step, first, next)
+		}
+	}
+}
+
+var sqlTimeRange = regexp.MustCompile(`ts >= '([^']+)' AND ts <= '([^']+)'`)
+
+// sqlRangeOf returns the range of ts of a sql of mode 1 in utc
+func sqlRangeOf(t *testing.T, query string) [2]int64 {
+
+	m := sqlTimeRange.FindStringSubmatch(query)
+	if m == nil {
+		t.Fatalf("no range of ts in sql: %s", query)
+	}
+
+	var out [2]int64
+	for i := range out {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", m[i + 1], time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[i] = tm.Unix()
+	}
+
+	return out
+}
+
+// newCachedTestReader returns a reader of mode 1 in utc, the rows of a series up with a sample at every minute
+// are returned for the sqls, the value is the time in seconds
+func newCachedTestReader(t *testing.T) (*clickReader, *fakeClick) {
+
+	cfg := newTestReaderCfg()
+	cfg.Utc     = true
+	cfg.MinStep = 60
+
+	click, fc := newFakeClick(t)
+	fc.rows = func(query string) ([]string, [][]driver.Value) {
+		rg := sqlRangeOf(t, query)
+
+		var values [][]driver.Value
+		for ts := rg[0] + (60 - rg[0] % 60) % 60; ts <= rg[1]; ts += 60 {
+			values = append(values, []driver.Value{int64(1), ts * 1000, "up", []string{"__name__=up", "job=api"}, float64(ts), uint8(0)})
+		}
+
+		return []string{"CNT", "t", "name", "tags", "value", "stale"}, values
+	}
+
+	r := &clickReader{cfg: cfg, click: click, backend: &clickBackend1{}, tag: "reader"}
+	r.planner, _ = newQueryPlanner(cfg)
+	r.limits     = newQueryLimits(cfg)
+
+	return r, fc
+}
+
+// checkMinutes checks res has the series up with a sample at every minute in [start, end]
+func checkMinutes(t *testing.T, res *readResult, start int64, end int64) {
+
+	if len(res.series) != 1 {
+		t.Fatalf("%d series read, want 1", len(res.series))
+	}
+	for _, ts := range res.series {
+		if int64(len(ts.Samples)) != (end - start) / 60 + 1 {
+			t.Errorf("%d samples read, want %d", len(ts.Samples), (end - start) / 60 + 1)
+		}
+		for i, s := range ts.Samples {
+			if want := start + int64(i) * 60; s.TimestampMs != want * 1000 || s.Value != float64(want) {
+				t.Fatalf("sample %d is %v@%d, want %d@%d", i, s.Value, s.TimestampMs, want, want * 1000)
+			}
+		}
+	}
+	if res.samples != (end - start) / 60 + 1 {
+		t.Errorf("res.samples = %d, want %d", res.samples, (end - start) / 60 + 1)
+	}
+}
+
+func TestReadCached(t *testing.T) {
+
+	now  := time.Now()
+	y, m, d := now.UTC().AddDate(0, 0, -5).Date()
+	base := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix()
+
+	// the first day is read from its middle, the third day is in max freshness
+	start := base + 12 * 3600 + 30
+	end   := base + 2 * 86400 + 6 * 3600
+
+	cache := resultsCache
+	defer func() { resultsCache = cache }()
+	resultsCache = newQueryResultsCache(&ResultsCacheCfg{MaxSize: 1000000, Ttl: 3600, MaxFreshness: int(now.Unix() - (base + 2 * 86400 + 3600))})
+
+	r, fc := newCachedTestReader(t)
+
+	read := func(name string, ranges ...[2]int64) {
+		plan, err := r.planner.plan(&remote.Query{StartTimestampMs: start * 1000, EndTimestampMs: end * 1000, Matchers: []*remote.LabelMatcher{{Name: "__name__", Value: "up"}}}, "prometheus", "samples", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.step != 60 {
+			t.Fatalf("the step is %d, want 60", plan.step)
+		}
+
+		res, err := r.readCached(context.Background(), plan)
+		if err != nil {
+			t.Fatalf("%s: readCached failed: %s", name, err)
+		}
+
+		// the samples before the aligned start are trimmed, and the ones of the intervals are not duplicated
+		checkMinutes(t, res, base + 12 * 3600, end)
+
+		queries := fc.takeQueries()
+		if len(queries) != len(ranges) {
+			t.Fatalf("%s: %d sqls run, want %d", name, len(queries), len(ranges))
+		}
+		for i, q := range queries {
+			if got := sqlRangeOf(t, q); got != ranges[i] {
+				t.Errorf("%s: sql %d reads %v, want %v", name, i, got, ranges[i])
+			}
+		}
+	}
+
+	day1 := [2]int64{base, base + 86400 - 1}
+	day2 := [2]int64{base + 86400, base + 2 * 86400 - 1}
+	tail := [2]int64{base + 2 * 86400, end}
+
+	// the whole past days are read and cached, the tail is read directly
+	read("first read", day1, day2, tail)
+	read("cached", tail)
+
+	// the samples written into the second day drop it, not the first one
+	resultsCache.invalidateSince("prometheus", "samples", time.Unix(base + 86400 + 100, 0))
+	read("invalidated", day2, tail)
+
+	// the samples in max freshness never change the cached days
+	resultsCache.invalidateSince("prometheus", "samples", time.Unix(base + 2 * 86400 + 7200, 0))
+	resultsCache.invalidateSince("prometheus", "others" , time.Unix(base, 0))
+	read("fresh", tail)
+
+	resultsCache.invalidateTable("prometheus", "samples")
+	read("table invalidated", day1, day2, tail)
+}
+
+func TestReadCachedOfRawSamples(t *testing.T) {
+
+	cache := resultsCache
+	defer func() { resultsCache = cache }()
+	resultsCache = newQueryResultsCache(&ResultsCacheCfg{MaxSize: 1000000, Ttl: 3600, MaxFreshness: 600})
+
+	r, fc := newCachedTestReader(t)
+
+	plan, _ := r.planner.plan(newTestQuery(0, 3 * 1440, "__name__=up"), "prometheus", "samples", nil)
+	plan.step = 0
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.readCached(context.Background(), plan); err != nil {
+			t.Fatal(err)
+		}
+		if queries := fc.takeQueries(); len(queries) != 1 || sqlRangeOf(t, queries[0]) != [2]int64{0, 3 * 86400} {
+			t.Errorf("the raw samples are read by %d sqls %v, want one of the whole range", len(queries), queries)
+		}
+	}
+}
+
+func TestResultsCachePutAfterInvalidated(t *testing.T) {
+
+	c := newQueryResultsCache(&ResultsCacheCfg{MaxSize: 100, Ttl: 3600, MaxFreshness: 600})
+	plan := &queryPlan{db: "prometheus", table: "samples"}
+
+	res := newReadResult()
+	res.samples = 10
+
+	// the interval read before the writer invalidated it may miss the samples written
+	since := time.Now()
+	c.invalidate("prometheus.samples", 0)
+	c.put("a", plan, 100, since, res)
+	if c.get("a") != nil {
+		t.Errorf("the result read before invalidated is cached")
+	}
+
+	c.put("b", plan, 100, time.Now().Add(time.Millisecond), res)
+	if c.get("b") == nil {
+		t.Errorf("the result read after invalidated is not cached")
+	}
+
+	// too large, or evicting the least recently used
+	big := newReadResult()
+	big.samples = 101
+	c.put("c", plan, 100, time.Now().Add(time.Millisecond), big)
+	if c.get("c") != nil {
+		t.Errorf("the result larger than max size is cached")
+	}
+
+	c.put("d", plan, 100, time.Now().Add(time.Millisecond), &readResult{samples: 95})
+	if c.get("b") != nil || c.get("d") == nil || c.size != 95 {
+		t.Errorf("the least recently used is not evicted, size: %d", c.size)
+	}
+}
+
+func TestReadResultTrim(t *testing.T) {
+
+	res := newReadResult()
+	res.series["a"] = &remote.TimeSeries{Samples: []*remote.Sample{{TimestampMs: 1000}, {TimestampMs: 2000}, {TimestampMs: 3000}}}
+	res.series["b"] = &remote.TimeSeries{Samples: []*remote.Sample{{TimestampMs: 5000}}}
+	res.samples = 4
+
+	out := res.trim(2000, 3000)
+	if len(out.series) != 1 || len(out.series["a"].Samples) != 2 || out.samples != 2 {
+		t.Errorf("trim(2000, 3000) returns %d series and %d samples, want the 2 samples of a", len(out.series), out.samples)
+	}
+	if len(res.series["a"].Samples) != 3 || res.samples != 4 {
+		t.Errorf("the result trimmed is changed")
+	}
+}
@@ -2,6 +2,7 @@ package modules
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"io/ioutil"
@@ -16,6 +17,7 @@ import (
 	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/storage/remote"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type ptcServer struct {
@@ -45,44 +47,124 @@ func (s *ptcServer)init(){
 	s.mux.HandleFunc("/read", s.handlerForPathRead)
 	s.mux.HandleFunc("/write", s.handlerForPathWrite)
 	s.mux.Handle("/metrics", promhttp.Handler())
+	s.mux.HandleFunc("/status", Engine.status.handlerForPage)
+	s.mux.HandleFunc("/api/v1/status", Engine.status.handlerForApi)
+
+	if Engine.explorer != nil {
+		s.mux.HandleFunc("/cardinality", Engine.explorer.handlerForPage)
+		s.mux.HandleFunc("/api/v1/cardinality", Engine.explorer.handlerForApi)
+	}
+
+	if Engine.importer != nil {
+		s.mux.HandleFunc("/api/v1/import", Engine.importer.handlerForImport)
+	}
+
+	if Engine.deleter != nil {
+		s.mux.HandleFunc("/api/v1/admin/delete_series", Engine.deleter.handlerForDeleteSeries)
+		s.mux.HandleFunc("/api/v1/admin/mutations", Engine.deleter.handlerForMutations)
+	}
+
+	if s.cfg.EnableAdminApi {
+		s.mux.HandleFunc("/api/v1/admin/outputs", Engine.writer.Outputs().handlerForOutputs)
+	}
+}
+
+// respondJSON writes data in the same envelope as the http api of prometheus
+func respondJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	b, err := json.Marshal(map[string]interface{}{"status": "success", "data": data})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(b)
+}
+
+func respondError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	b, _ := json.Marshal(map[string]interface{}{"status": "error", "error": err.Error()})
+	w.Write(b)
 }
 
 func (s *ptcServer)handlerForPathRead(w http.ResponseWriter, r *http.Request){
 
 	slog.Debugf("%s: %s from %s @ %s", s.tag, r.RequestURI, r.Header.Get("User-Agent"), r.RemoteAddr)
 
+	ctx, span := startServerSpan(r, "read")
+	defer span.End()
+	ctx = withCaller(ctx, r.UserAgent() + "@" + r.RemoteAddr)
+
+	// the queries are canceled when prometheus gives up or the timeout reached
+	ctx, cancel := context.WithTimeout(ctx, serverTimeout())
+	defer cancel()
+
 	if Engine.reader.IsHealthy() == false{
 		slog.Errorf("%s: %s from %s @ %s, reject because reader is not healthy", s.tag, r.RequestURI, r.Header.Get("User-Agent"), r.RemoteAddr)
+		span.SetStatus(codes.Error, "reader is not healthy")
 		http.Error(w, "reader is not healthy", http.StatusInternalServerError)
 		return
 	}
 
-	compressed, err := ioutil.ReadAll(r.Body)
+	var (
+		compressed []byte
+		reqBuf     []byte
+		req        remote.ReadRequest
+		resp       *remote.ReadResponse
+	)
+
+	err := traceStep(ctx, "read body", func() (err error) {
+		compressed, err = ioutil.ReadAll(r.Body)
+		return
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	reqBuf, err := snappy.Decode(nil, compressed)
+	err = traceStep(ctx, "snappy decode", func() (err error) {
+		reqBuf, err = snappy.Decode(nil, compressed)
+		return
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var req remote.ReadRequest
-	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+	err = traceStep(ctx, "proto unmarshal", func() error {
+		return proto.Unmarshal(reqBuf, &req)
+	})
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var resp *remote.ReadResponse
-	resp, err = Engine.reader.HandlePromReadReq(&req, r)
+	resp, err = Engine.reader.HandlePromReadReq(ctx, &req, r)
 	if err != nil {
+		failSpan(span, err)
+		if _, ok := err.(*queryLimitError); ok {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if _, ok := err.(*queryError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	data, err := proto.Marshal(resp)
+	err = traceStep(ctx, "encode response", func() error {
+		data, err := proto.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		compressed = snappy.Encode(nil, data)
+		return nil
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -91,7 +173,6 @@ func (s *ptcServer)handlerForPathRead(w http.ResponseWriter, r *http.Request){
 	w.Header().Set("Content-Type", "application/x-protobuf")
 	w.Header().Set("Content-Encoding", "snappy")
 
-	compressed = snappy.Encode(nil, data)
 	if _, err := w.Write(compressed); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -102,26 +183,45 @@ func (s *ptcServer)handlerForPathWrite(w http.ResponseWriter, r *http.Request){
 
 	slog.Debugf("%s: %s from %s @ %s", s.tag, r.RequestURI, r.Header.Get("User-Agent"), r.RemoteAddr)
 
+	ctx, span := startServerSpan(r, "write")
+	defer span.End()
+	r = r.WithContext(ctx)
+
     if Engine.writer.IsHealthy() == false{
     	slog.Errorf("%s: %s from %s @ %s, reject because writer is not healthy", s.tag, r.RequestURI, r.Header.Get("User-Agent"), r.RemoteAddr)
+		span.SetStatus(codes.Error, "writer is not healthy")
 		http.Error(w, "writer is not healthy", http.StatusInternalServerError)
 		return
 	}
 
-	compressed, err := ioutil.ReadAll(r.Body)
+	var (
+		compressed []byte
+		reqBuf     []byte
+		req        remote.WriteRequest
+	)
+
+	err := traceStep(ctx, "read body", func() (err error) {
+		compressed, err = ioutil.ReadAll(r.Body)
+		return
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	reqBuf, err := snappy.Decode(nil, compressed)
+	err = traceStep(ctx, "snappy decode", func() (err error) {
+		reqBuf, err = snappy.Decode(nil, compressed)
+		return
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var req remote.WriteRequest
-	if err := proto.Unmarshal(reqBuf, &req); err != nil {
+	err = traceStep(ctx, "proto unmarshal", func() error {
+		return proto.Unmarshal(reqBuf, &req)
+	})
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -137,6 +237,7 @@ func (s *ptcServer)Start(){
 	server := &http.Server{
 		Addr:         s.cfg.Addr,
 		Handler:      s.mux,
+		ReadHeaderTimeout: serverTimeout(),
 	}
 
 	s.wg.Add(1)
@@ -170,6 +271,8 @@ func (s *ptcServer)listenSignal(ctx context.Context, httpSrv *http.Server) {
 		case <-time.After(10 * time.Second):
 			slog.Info("writer shutdown timed out, samples will be lost..")
 		}
+
+		Engine.tracing.Stop()
 	}
 
 	s.wg.Done()
@@ -0,0 +1,311 @@
+package modules
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/remote"
+	"gopkg.in/yaml.v2"
+)
+
+const slowQueriesKept = 64
+
+type slowQuery struct {
+	Time    time.Time `json:"time"`
+	Tag     string    `json:"tag"`
+	Query   string    `json:"query"`		// the matchers of remote query, like {__name__="up",job="node"}
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Rows    int64     `json:"rows"`
+	Cost    string    `json:"cost"`
+	Sql     string    `json:"sql"`
+	QueryId string    `json:"query_id"`	// the query_ids in clickhouse, separated by ',' if more than one sql
+	Caller  string    `json:"caller"`
+}
+
+// slowQueryLog keeps the recent queries cost more than threshold in a ring, and writes them to the slow log
+type slowQueryLog struct {
+	mu        sync.Mutex
+	ring      []slowQuery
+	next      int
+	threshold time.Duration
+}
+
+var slowQueries = &slowQueryLog{ring: make([]slowQuery, 0, slowQueriesKept), threshold: time.Second}
+
+// record records the query if it's slow, sqls are the sqls run for the query, rows is the num of rows returned from clickhouse
+func (l *slowQueryLog) record(tag string, query *remote.Query, sqls []*sqlQuery, rows int64, cost time.Duration) {
+
+	if cost < l.threshold {
+		return
+	}
+
+	var stmts, ids []string
+	for _, q := range sqls {
+		stmts = append(stmts, q.sql)
+		ids   = append(ids, q.queryId)
+	}
+
+	sq := slowQuery{
+		Time   : time.Now(),
+		Tag    : tag,
+		Query  : matchersString(query.Matchers),
+		Start  : time.Unix(query.StartTimestampMs / 1000, 0),
+		End    : time.Unix(query.EndTimestampMs / 1000, 0),
+		Rows   : rows,
+		Cost   : cost.String(),
+		Sql    : strings.Join(stmts, ";\n"),
+		QueryId: strings.Join(ids, ","),
+	}
+	if len(sqls) > 0 {
+		sq.Caller = callerOf(sqls[0].ctx)
+	}
+
+	slowLog.Infow("slow query", "tag", sq.Tag, "query_id", sq.QueryId, "caller", sq.Caller, "matchers", sq.Query,
+		"start", sq.Start, "end", sq.End, "rows", sq.Rows, "cost", cost.Seconds(), "sql", sq.Sql)
+
+	l.mu.Lock()
+	if len(l.ring) < slowQueriesKept {
+		l.ring = append(l.ring, sq)
+	} else {
+		l.ring[l.next] = sq
+	}
+	l.next = (l.next + 1) % slowQueriesKept
+	l.mu.Unlock()
+}
+
+// Recent returns the slow queries kept, the latest first
+func (l *slowQueryLog) Recent() []slowQuery {
+
+	l.mu.Lock()
+	out := make([]slowQuery, len(l.ring))
+	copy(out, l.ring)
+	l.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+
+	return out
+}
+
+// matchersString returns the matchers in format like {__name__="up",job=~"node.*"}
+func matchersString(matchers []*remote.LabelMatcher) string {
+
+	var pairs []string
+	for _, m := range matchers {
+		op := "="
+		switch m.Type {
+			case remote.MatchType_NOT_EQUAL     : op = "!="
+			case remote.MatchType_REGEX_MATCH   : op = "=~"
+			case remote.MatchType_REGEX_NO_MATCH: op = "!~"
+		}
+		pairs = append(pairs, m.Name + op + `"` + escapeLabelValue(m.Value) + `"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sortedMatchersString returns the matchers like matchersString but sorted, so the same matchers in different order are equal
+func sortedMatchersString(matchers []*remote.LabelMatcher) string {
+
+	sorted := make([]*remote.LabelMatcher, len(matchers))
+	copy(sorted, matchers)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		if sorted[i].Type != sorted[j].Type {
+			return sorted[i].Type < sorted[j].Type
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+
+	return matchersString(sorted)
+}
+
+var dsnPasswordRegex = regexp.MustCompile(`password=[^&]*`)
+
+func redactDsn(dsn string) string {
+	return dsnPasswordRegex.ReplaceAllString(dsn, "password=<redacted>")
+}
+
+// redactedConfig returns the resolved config with passwords redacted, in the names of yaml
+func redactedConfig() interface{} {
+
+	cfg := Cfg
+	cfg.Servers = map[string]ClickCfg{}
+	for name, server := range Cfg.Servers {
+		if server.Passwd != "" {
+			server.Passwd = "<redacted>"
+		}
+		server.Dsn = redactDsn(server.Dsn)
+		cfg.Servers[name] = server
+	}
+
+	// convert to map by yaml, so the keys are the same as the config file
+	var out interface{}
+	if b, err := yaml.Marshal(&cfg); err == nil {
+		yaml.Unmarshal(b, &out)
+	}
+
+	return stringKeys(out)
+}
+
+// stringKeys converts map[interface{}]interface{} decoded by yaml to map[string]interface{}, so it can be encoded by json
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			out[fmt.Sprint(key)] = stringKeys(val)
+		}
+		return out
+	case []interface{}:
+		for i, val := range v {
+			v[i] = stringKeys(val)
+		}
+	}
+
+	return v
+}
+
+type clickStatus struct {
+	Name      string `json:"name"`
+	Dsn       string `json:"dsn"`
+	Used      bool   `json:"used"`
+	Healthy   bool   `json:"healthy"`
+	LastError string `json:"last_error"`
+}
+
+type statusData struct {
+	StartTime   time.Time      `json:"start_time"`
+	Uptime      string         `json:"uptime"`
+	Mode        int            `json:"mode"`
+	Clickhouses []clickStatus  `json:"clickhouses"`
+	Outputs     []outputStatus `json:"outputs"`
+	SlowQueries []slowQuery    `json:"slow_queries"`
+	Config      interface{}    `json:"config"`
+	ConfigYaml  string         `json:"-"`
+}
+
+// statusPage shows the state of the adapter in /status and /api/v1/status
+type statusPage struct {
+	tag       string
+	startTime time.Time
+	page      *template.Template
+}
+
+func (sp *statusPage) init() {
+	sp.tag       = "status"
+	sp.startTime = time.Now()
+	sp.page      = template.Must(template.New("status").Parse(statusPageTemplate))
+
+	if Cfg.Reader.SlowQuery <= 0 {
+		Cfg.Reader.SlowQuery = 1
+	}
+	slowQueries.threshold = time.Duration(Cfg.Reader.SlowQuery * float64(time.Second))
+}
+
+func (sp *statusPage) collect() *statusData {
+
+	out := new(statusData)
+
+	out.StartTime = sp.startTime
+	out.Uptime    = time.Now().Sub(sp.startTime).Truncate(time.Second).String()
+	out.Mode      = Cfg.Reader.Mode
+
+	var names []string
+	for name := range Engine.clicks.clicks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c := Engine.clicks.clicks[name]
+
+		cs := clickStatus{
+			Name   : name,
+			Dsn    : redactDsn(c.dsn),
+			Used   : c.IsUsed(),
+			Healthy: c.IsHealthy(),
+		}
+		if err := c.ConnErr(); err != nil {
+			cs.LastError = err.Error()
+		}
+
+		out.Clickhouses = append(out.Clickhouses, cs)
+	}
+
+	out.Outputs     = Engine.writer.Outputs().Statuses()
+	out.SlowQueries = slowQueries.Recent()
+	out.Config      = redactedConfig()
+
+	if b, err := yaml.Marshal(out.Config); err == nil {
+		out.ConfigYaml = string(b)
+	}
+
+	return out
+}
+
+func (sp *statusPage) handlerForApi(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, sp.collect())
+}
+
+func (sp *statusPage) handlerForPage(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := sp.page.Execute(w, sp.collect()); err != nil {
+		slog.Errorf("%s: render page failed: %s", sp.tag, err)
+	}
+}
+
+const statusPageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>prom_to_click status</title>
+<style>
+body  { font-family: sans-serif; margin: 20px; }
+table { border-collapse: collapse; margin-bottom: 20px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; font-size: 13px; }
+th    { background: #eee; }
+.bad  { color: #c00; }
+.good { color: #080; }
+pre   { background: #f6f6f6; padding: 8px; }
+</style>
+</head>
+<body>
+<h2>prom_to_click</h2>
+<p>mode: {{.Mode}}, started at {{.StartTime.Format "2006-01-02 15:04:05"}}, uptime: {{.Uptime}}</p>
+
+<h3>clickhouse servers</h3>
+<table>
+<tr><th>name</th><th>dsn</th><th>used</th><th>health</th><th>last error</th></tr>
+{{range .Clickhouses}}<tr><td>{{.Name}}</td><td>{{.Dsn}}</td><td>{{.Used}}</td><td>{{if .Healthy}}<span class="good">healthy</span>{{else}}<span class="bad">unhealthy</span>{{end}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+
+<h3>writer outputs</h3>
+<table>
+<tr><th>db.table</th><th>workers</th><th>queue</th><th>fill</th><th>pending</th><th>batch</th><th>last commit</th><th>fingerprint cache</th><th>received</th><th>last used</th></tr>
+{{range .Outputs}}<tr><td>{{.Db}}.{{.Table}}</td><td>{{.Shards}}</td><td>{{.Queue}}/{{.Capacity}}</td><td>{{printf "%.1f%%" .Fill}}</td><td>{{.Pending}}</td><td>{{.Batch}}</td><td>{{.LastCommitAge}}</td><td>{{.FingerprintCacheSize}}</td><td>{{.TotalRecv}}</td><td>{{.LastUse.Format "2006-01-02 15:04:05"}}</td></tr>
+{{else}}<tr><td colspan="10">no active outputs</td></tr>
+{{end}}</table>
+
+<h3>recent slow queries</h3>
+<table>
+<tr><th>time</th><th>source</th><th>caller</th><th>query</th><th>range</th><th>rows</th><th>cost</th><th>query_id</th></tr>
+{{range .SlowQueries}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Tag}}</td><td>{{.Caller}}</td><td title="{{.Sql}}">{{.Query}}</td><td>{{.Start.Format "2006-01-02 15:04:05"}} ~ {{.End.Format "2006-01-02 15:04:05"}}</td><td>{{.Rows}}</td><td>{{.Cost}}</td><td>{{.QueryId}}</td></tr>
+{{else}}<tr><td colspan="8">no slow queries</td></tr>
+{{end}}</table>
+
+<h3>config</h3>
+<pre>{{.ConfigYaml}}</pre>
+</body>
+</html>
+`
@@ -0,0 +1,146 @@
+package modules
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of adapter, it's a noop one until the tracing is enabled in config,
+// the spans created before are noop too
+var tracer = otel.Tracer("github.com/ziyht/prom_to_click")
+
+// ptcTracing exports the spans of /read and /write to an otlp collector, and propagates the trace headers
+// (w3c traceparent and baggage) from the incoming requests, so the spans can join the traces of callers like grafana
+type ptcTracing struct {
+	tag      string
+	cfg      *TracingCfg
+	provider *sdktrace.TracerProvider
+}
+
+func (t *ptcTracing) init() {
+
+	t.tag = "tracing"
+	t.cfg = &Cfg.Tracing
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if t.cfg.Endpoint == "" {
+		return
+	}
+	if t.cfg.ServiceName == "" {
+		t.cfg.ServiceName = "prom_to_click"
+	}
+	if t.cfg.SampleRatio <= 0 || t.cfg.SampleRatio > 1 {
+		t.cfg.SampleRatio = 1
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(t.cfg.Endpoint)}
+	if t.cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if t.cfg.UrlPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(t.cfg.UrlPath))
+	}
+
+	// the exporter connects lazily, so it will not fail here if the collector is down
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		slog.Fatalf("%s: create otlp exporter failed: %s", t.tag, err)
+	}
+
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(t.cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", t.cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(t.provider)
+
+	slog.Infof("%s: exporting spans to %s, sample ratio: %g", t.tag, t.cfg.Endpoint, t.cfg.SampleRatio)
+}
+
+// Stop flushes the spans not exported yet
+func (t *ptcTracing) Stop() {
+	if t.provider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if err := t.provider.Shutdown(ctx); err != nil {
+		slog.Errorf("%s: shutdown failed: %s", t.tag, err)
+	}
+}
+
+// startServerSpan starts the span of an incoming request, as a child of the span in its trace headers if any
+func startServerSpan(r *http.Request, name string) (context.Context, trace.Span) {
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.RequestURI()),
+			attribute.String("http.user_agent", r.UserAgent()),
+			attribute.String("net.peer.addr", r.RemoteAddr),
+		),
+	)
+}
+
+// traceStep runs fn in a child span of ctx
+func traceStep(ctx context.Context, name string, fn func() error) error {
+
+	_, span := tracer.Start(ctx, name)
+
+	err := fn()
+	endSpan(span, err)
+
+	return err
+}
+
+// startClickSpan starts the span of a sql sent to clickhouse, end it after the rows are read
+func startClickSpan(ctx context.Context, name string, c *click, db string, sql string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "clickhouse"),
+			attribute.String("db.name", db),
+			attribute.String("db.statement", sql),
+			attribute.String("peer.service", c.name),
+		),
+	)
+}
+
+// endSpan ends the span, and marks it failed if err is not nil
+func endSpan(span trace.Span, err error) {
+	failSpan(span, err)
+	span.End()
+}
+
+// failSpan marks the span failed if err is not nil
+func failSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// traceContext returns ctx, or a background one if it's nil
+func traceContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+
+	return ctx
+}
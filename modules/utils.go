@@ -1,9 +1,21 @@
 package modules
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/prometheus/prometheus/storage/remote"
+	"math"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func makeLabels(tags []string) []*remote.LabelPair {
@@ -27,12 +39,69 @@ func makeLabels(tags []string) []*remote.LabelPair {
 	return pairs
 }
 
+// parseSelector parses a series selector like 'up{job="node"}' to the matchers used in remote read
+func parseSelector(selector string) ([]*remote.LabelMatcher, error) {
+
+	matchers, err := promql.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*remote.LabelMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		lm := &remote.LabelMatcher{
+			Name : string(m.Name),
+			Value: string(m.Value),
+		}
+
+		switch m.Type {
+			case metric.Equal       : lm.Type = remote.MatchType_EQUAL
+			case metric.NotEqual    : lm.Type = remote.MatchType_NOT_EQUAL
+			case metric.RegexMatch  : lm.Type = remote.MatchType_REGEX_MATCH
+			case metric.RegexNoMatch: lm.Type = remote.MatchType_REGEX_NO_MATCH
+		}
+
+		out = append(out, lm)
+	}
+
+	return out, nil
+}
+
+// parseTime parses a time in unix seconds(float supported) or rfc3339 format, like the http api of prometheus
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, ns := math.Modf(t)
+		return time.Unix(int64(sec), int64(ns * float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse '%s' to a valid timestamp", s)
+}
+
+// formatTime formats t to the DateTime and Date format of clickhouse, in utc or the local zone (of clickhouse too),
+// not the zone t is parsed in
+func formatTime(t time.Time, utc bool) (string, string) {
+	if utc {
+		t = t.UTC()
+	} else {
+		t = t.Local()
+	}
+
+	return t.Format("2006-01-02 15:04:05"), t.Format("2006-01-02")
+}
+
 type sqlQuery struct{
 	// input
 	query       *remote.Query
+	ctx         context.Context		// the context of request, for tracing
 
 	// -- middle
 	tag         string
+	queryId     string			// the query_id sent to clickhouse, can be found in system.query_log
+	db          string
+	table       string
 	iStart      int64
 	iEnd        int64
 	sStartDate  string
@@ -47,23 +116,77 @@ type sqlQuery struct{
 	from        string
 	orderBy     string
 	groupBy     string
+	settings    []string		// the settings sent with sql, like max_execution_time = 30
 }
 
-var queryCounter int64
+var queryCounter int64		// atomic, the queries are rendered at the same time
 func newSqlQuery(query *remote.Query) *sqlQuery{
 
-	queryCounter++
+	n := atomic.AddInt64(&queryCounter, 1)
 
 	out := new(sqlQuery)
 
-	out.tag   = fmt.Sprintf("query%d", queryCounter)
-	out.query = query
+	out.tag     = fmt.Sprintf("query%d", n)
+	out.query   = query
+	out.queryId = newQueryId()
 
 	return out
 }
 
+// newQueryId returns a random uuid, like the query_id generated by clickhouse
+func newQueryId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6] & 0x0f | 0x40
+	b[8] = b[8] & 0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+type callerKey struct{}
+
+// withCaller returns a context with the caller of query, like the user agent and address of request,
+// it's written to log_comment of the queries
+func withCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func callerOf(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// context returns the context to run the sql, with the query_id set
+func (q *sqlQuery) context() context.Context {
+	return clickhouse.WithQueryID(traceContext(q.ctx), q.queryId)
+}
+
+// logComment returns the log_comment setting of the sql, in json with the tag, matchers and caller
+func (q *sqlQuery) logComment() string {
+
+	comment := map[string]string{
+		"app"   : "prom_to_click",
+		"tag"   : q.tag,
+		"caller": callerOf(q.ctx),
+	}
+	if q.query != nil {
+		comment["matchers"] = matchersString(q.query.Matchers)
+	}
+
+	b, _ := json.Marshal(comment)
+
+	return string(b)
+}
+
 func (q *sqlQuery)genSql(){
 
+	_, span := tracer.Start(traceContext(q.ctx), "genSql")
+	defer span.End()
+
 	q.sql = fmt.Sprintf("SELECT %s FROM %s WHERE %s",
 		strings.Join(q.rows, ", "),
 		q.from,
@@ -77,5 +200,15 @@ func (q *sqlQuery)genSql(){
 	if q.orderBy != "" {
 		q.sql += " ORDER BY " + q.orderBy
 	}
+
+	settings := q.settings
+	if Cfg.Reader.LogComment {
+		settings = append(settings[:len(settings):len(settings)], "log_comment = " + sqlString(q.logComment()))
+	}
+	if len(settings) > 0 {
+		q.sql += " SETTINGS " + strings.Join(settings, ", ")
+	}
+
+	span.SetAttributes(attribute.String("db.statement", q.sql))
 }
 
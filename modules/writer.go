@@ -1,6 +1,7 @@
 package modules
 
 import (
+	"context"
 	"fmt"
 	"github.com/ClickHouse/clickhouse-go"
 	"github.com/prometheus/common/model"
@@ -9,9 +10,12 @@ import (
 	"regexp"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type promSample struct {
@@ -26,13 +30,12 @@ type clickOutput struct {
 	cw                  *clickWriter
 	db           		string
 	table        		string
-	writeCounter       	prometheus.Counter
-	writeFailedCounter 	prometheus.Counter
-	test     			prometheus.Counter
-	timings  			prometheus.Histogram
+	metrics             *writeMetrics
 	totalRecv			uint64
 	totalWrite          uint64
 	inputs   			chan *promSample
+	pending             int64			// atomic, num of samples in batch, for status
+	lastCommit          int64			// atomic, unix nano of last commit, for status
 }
 
 func NewClickOutput(cw *clickWriter, db string, table string) (out *clickOutput) {
@@ -44,6 +47,8 @@ func NewClickOutput(cw *clickWriter, db string, table string) (out *clickOutput)
 	out.db    = db
 	out.table = table
 
+	out.metrics = newWriteMetrics(cw.click.name, db, table)
+
 	out.inputs = make(chan *promSample, cw.cfg.Buffer)
 
 	return out
@@ -55,17 +60,32 @@ func (co *clickOutput) HandleError(err error) error {
 
 	if compile.Match([]byte(err.Error())) {
 		return co.cw.TryCreateDatabaseTable(co)
-	} else {
-		return err
 	}
 
-	return nil
+	return err
 }
 
 func (co *clickOutput)Stop(){
 	close(co.inputs)
 }
 
+func (co *clickOutput) Status() outputStatus {
+	out := outputStatus{
+		Tag      : co.tag,
+		Queue    : len(co.inputs),
+		Capacity : cap(co.inputs),
+		Shards   : 1,
+		Pending  : int(atomic.LoadInt64(&co.pending)),
+		Batch    : co.cw.cfg.Batch,
+		TotalRecv: atomic.LoadUint64(&co.totalRecv),
+	}
+	if t := atomic.LoadInt64(&co.lastCommit); t > 0 {
+		out.LastCommit = time.Unix(0, t)
+	}
+
+	return out
+}
+
 func (co *clickOutput) Start() {
 
 	w := co.cw
@@ -73,40 +93,35 @@ func (co *clickOutput) Start() {
 	wait := w.cfg.Wait
 
 	sigSample := new(promSample)
-	// wake up wirter fo every 1 seconds
-	go func() {
-
-		for {
-			time.Sleep(time.Second)
-			select {
-			case co.inputs <- sigSample:
-			default:
-			}
-		}
 
-	}()
-
-	var insertSQL = `INSERT INTO %s.%s (date, name, tags, val, ts) VALUES (?, ?, ?, ?, ?)`
+	var insertSQL = `INSERT INTO %s (date, name, tags, val, ts) VALUES (?, ?, ?, ?, ?)`
 
+	w.wg.Add(1)
 	go func() {
-		w.wg.Add(1)
 		slog.Infof("%s: started", co.tag)
 
-		sql    := fmt.Sprintf(insertSQL, co.db, co.table)
+		sql    := fmt.Sprintf(insertSQL, sqlTable(co.db, co.table))
 		chanOK := true
 
 		var reqs []*promSample
 
-		for chanOK {
-			w.test.Add(1)
+		// wake up writer fo every 1 seconds, we can not send sigSample to inputs in another goroutine,
+		// it may panic when inputs is closed by Stop()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
 
+		for chanOK {
 			// get next batch of requests
 			tstart := time.Now()
 			for i := 0; i < w.cfg.Batch; i++ {
 				var req *promSample
 
 				// get request and also check if channel is closed
-				req, chanOK = <-co.inputs
+				select {
+				case req, chanOK = <-co.inputs:
+				case <-ticker.C:
+					req = sigSample
+				}
 
 				if !chanOK {
 					slog.Infof("%s: stopping...", co.tag)
@@ -125,18 +140,24 @@ func (co *clickOutput) Start() {
 
 			// ensure we have something to send..
 			nmetrics := len(reqs)
+			atomic.StoreInt64(&co.pending, int64(nmetrics))
 			if nmetrics < 1 {
 				continue
 			}
 
 			start := time.Now()
 
+			// the batches are mixed from many requests, so the inserts are traced as their own spans
+			_, span := startClickSpan(context.Background(), "clickhouse insert", w.click, co.db, sql)
+			span.SetAttributes(attribute.Int("db.rows", nmetrics))
+
 			// post them to db all at once
-			tx, err := w.click.db.Begin()
+			tx, err := w.click.Begin(context.Background())
 			if err != nil {
 				slog.Errorf("%s: begin transaction: %s", co.tag, err.Error())
-				w.writeFailedCounter.Add(1.0)
+				co.metrics.failed.Add(float64(nmetrics))
 				w.click.TryConnect()		// if connect failed, the health status will be set to false, and reject receive new samples
+				endSpan(span, err)
 				continue
 			}
 
@@ -150,13 +171,15 @@ func (co *clickOutput) Start() {
 					slog.Errorf("%s: prepare statement: %s", co.tag, err.Error())
 					slog.Errorf("%s: auto create table failed: %s", co.tag, err2.Error())
 
+					endSpan(span, err2)
 					continue
 				} else {
 
-					tx, err = w.click.db.Begin()
+					tx, err = w.click.Begin(context.Background())
 					if err != nil {
 						slog.Errorf("%s: begin transaction: %s", co.tag, err.Error())
-						w.writeFailedCounter.Add(1.0)
+						co.metrics.failed.Add(float64(nmetrics))
+						endSpan(span, err)
 						continue
 					}
 
@@ -165,6 +188,7 @@ func (co *clickOutput) Start() {
 						tx.Commit()
 
 						slog.Errorf("%s: prepare statement: %s", co.tag, err.Error())
+						endSpan(span, err)
 						continue
 					}
 				}
@@ -179,29 +203,46 @@ func (co *clickOutput) Start() {
 
 				if err != nil {
 					slog.Errorf("%s: statement exec: %s", co.tag, err.Error())
-					w.writeFailedCounter.Add(1.0)
+					co.metrics.dropped(dropExecFailed, 1)
 				}
 			}
 
 			// commit and record metrics
-			if err = tx.Commit(); err != nil {
+			err = tx.Commit()
+			endSpan(span, err)
+			if err != nil {
 				slog.Errorf("%s: commit failed: %s", co.tag, err.Error())
-				w.writeFailedCounter.Add(1.0)
+				co.metrics.failed.Add(float64(nmetrics))
 
 				w.click.TryConnect()
 
 			} else {
+				// the samples delayed change the results cached by reader
+				oldest := reqs[0].ts
+				for _, req := range reqs {
+					if req.ts.Before(oldest) {
+						oldest = req.ts
+					}
+				}
+				resultsCache.invalidateSince(co.db, co.table, oldest)
+
 				reqs = []*promSample{}				// write ok, clear reqs
+				atomic.StoreInt64(&co.pending, 0)
+				atomic.StoreInt64(&co.lastCommit, time.Now().UnixNano())
 
-				w.totalWrite += uint64(nmetrics)
+				total := atomic.AddUint64(&w.totalWrite, uint64(nmetrics))
 
-				slog.Infof("%s: write %d samples, total: %d, cost: %s", co.tag, nmetrics, w.totalWrite, time.Now().Sub(start).String())
+				slog.Infof("%s: write %d samples, total: %d, cost: %s", co.tag, nmetrics, total, time.Now().Sub(start).String())
 
-				w.writeCounter.Add(float64(nmetrics))
-				w.timings.Observe(float64(time.Since(tstart)))
+				co.metrics.written.Add(float64(nmetrics))
+				co.metrics.batch("samples", nmetrics, time.Now().Sub(start))
 			}
 		}
 
+		if len(reqs) > 0 {
+			slog.Errorf("%s: %d samples dropped because writer is stopped", co.tag, len(reqs))
+			co.metrics.dropped(dropStopped, len(reqs))
+		}
 		slog.Infof("%s: stopped", co.tag)
 
 		w.wg.Done()
@@ -214,13 +255,9 @@ type clickWriter struct {
 	//inputs   			chan *promSample
 	wg       			sync.WaitGroup
 	click    			*click
-	writeCounter       	prometheus.Counter
-	writeFailedCounter 	prometheus.Counter
-	test     			prometheus.Counter
-	timings  			prometheus.Histogram
 	totalRecv			uint64
 	totalWrite          uint64
-	outputs             map[string]*clickOutput
+	outputs             *outputRegistry
 }
 
 func (w *clickWriter)init(){
@@ -243,16 +280,10 @@ func (w *clickWriter)init(){
 		slog.Fatalf("%s: clickhouse '%s' set in writer can not be found", w.tag, w.cfg.Clickhouse)
 	}
 
-	w.writeCounter       = prometheus.NewCounter( prometheus.CounterOpts{ Name: "write_samples_total"       , Help: "Total number of processed samples sent to remote storage."})
-	w.writeFailedCounter = prometheus.NewCounter( prometheus.CounterOpts{ Name: "write_failed_samples_total", Help: "Total number of processed samples which failed on send to remote storage."})
-	w.test               = prometheus.NewCounter( prometheus.CounterOpts{ Name: "prometheus_remote_storage_sent_batch_duration_seconds_bucket_test", Help: "Test metric to ensure backfilled metrics are readable via prometheus.",})
-	w.timings            = prometheus.NewHistogram( prometheus.HistogramOpts{Name: "write_batch_duration_seconds", Help: "Duration of sample batch send calls to the remote storage.", Buckets: prometheus.DefBuckets})
-	prometheus.MustRegister(w.writeCounter)
-	prometheus.MustRegister(w.writeFailedCounter)
-	prometheus.MustRegister(w.test)
-	prometheus.MustRegister(w.timings)
-
-	w.outputs = map[string]*clickOutput{}
+	w.outputs = newOutputRegistry(w.tag, idleTimeout(w.cfg), func(db string, table string) writerOutput {
+		return NewClickOutput(w, db, table)
+	})
+	prometheus.MustRegister(newOutputsCollector(w.click.name, w.outputs))
 }
 
 func (w *clickWriter) Start() {
@@ -269,18 +300,16 @@ func (w *clickWriter) HandleError(err error, co *clickOutput) error {
 
 	if compile.Match([]byte(err.Error())) {
 		return w.TryCreateDatabaseTable(co)
-	} else {
-		return err
 	}
 
-	return nil
+	return err
 }
 
 func (w *clickWriter) TryCreateDatabaseTable(co *clickOutput) error{
 
-	creatDBSql    := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", co.db)
+	creatDBSql    := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", co.db)
 	creatTableSql := fmt.Sprintf(`
-			CREATE TABLE IF NOT EXISTS %s.%s
+			CREATE TABLE IF NOT EXISTS %s
 				(
 					  date Date DEFAULT toDate(0),
 					  name String,
@@ -293,16 +322,16 @@ func (w *clickWriter) TryCreateDatabaseTable(co *clickOutput) error{
 				   PARTITION BY toYYYYMM(date)
 				   ORDER BY (name, tags, ts)
 				   SETTINGS index_granularity=8192
-				;`, co.db, co.table)
+				;`, sqlTable(co.db, co.table))
 	{
-		_, err := w.click.Exec(creatDBSql)
+		_, err := w.click.Exec(context.Background(), creatDBSql)
 		if err != nil{
 			return err
 		}
 	}
 
 	{
-		_, err := w.click.Exec(creatTableSql)
+		_, err := w.click.Exec(context.Background(), creatTableSql)
 		if err != nil{
 			return err
 		}
@@ -311,7 +340,8 @@ func (w *clickWriter) TryCreateDatabaseTable(co *clickOutput) error{
 	return nil
 }
 
-func (w *clickWriter)getClickOutput(r *http.Request) (*clickOutput, error){
+// getDbTable returns the db.table set in request, or the default ones in config
+func (w *clickWriter)getDbTable(r *http.Request) (string, string){
 	r.ParseForm()
 
 	dbName := w.click.cfg.Database
@@ -330,31 +360,37 @@ func (w *clickWriter)getClickOutput(r *http.Request) (*clickOutput, error){
 		}
 	}
 
-	if dbName == "" || tbName == "" {
-		return nil, fmt.Errorf("invald dbName '%s' or tbName '%s'", dbName, tbName)
-	}
+	return dbName, tbName
+}
 
-	coName := dbName + "." + tbName
-	co, ok := w.outputs[coName]
-	if !ok {
-		co = NewClickOutput(w, dbName, tbName)
-		co.Start()
+// getClickOutput returns the output of db.table set in request, call release when the output is not used
+func (w *clickWriter)getClickOutput(r *http.Request) (*clickOutput, func(), error){
+	dbName, tbName := w.getDbTable(r)
 
-		w.outputs[coName] = co
+	output, release, err := w.outputs.Acquire(dbName, tbName)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return co, nil
+	return output.(*clickOutput), release, nil
 }
 
 func (w *clickWriter)HandlePromWriteReq(req *remote.WriteRequest, r *http.Request) (*remote.ReadResponse, error){
 
 	curRecvs := 0
 
-	co, err := w.getClickOutput(r)
+	co, release, err := w.getClickOutput(r)
 	if err != nil{
 		slog.Errorf("%s: get clickOutput failed: %s", w.tag, err)
+
+		dbName, tbName := w.getDbTable(r)
+		writeDroppedSamples.WithLabelValues(w.click.name, dbName, tbName, dropNoOutput).Add(float64(countSamples(req)))
 		return nil, nil
 	}
+	defer release()
+
+	_, span := tracer.Start(r.Context(), "enqueue", trace.WithAttributes(attribute.String("db.name", co.db), attribute.String("db.table", co.table)))
+	defer span.End()
 
 	for _, series := range req.Timeseries {
 		curRecvs += len(series.Samples)
@@ -386,11 +422,13 @@ func (w *clickWriter)HandlePromWriteReq(req *remote.WriteRequest, r *http.Reques
 		}
 	}
 
-	w.totalRecv  += uint64(curRecvs)
-	co.totalRecv += uint64(curRecvs)
+	atomic.AddUint64(&w.totalRecv, uint64(curRecvs))
+	total := atomic.AddUint64(&co.totalRecv, uint64(curRecvs))
 
 	Engine.server.recvCounter.Add(float64(curRecvs))
-	slog.Infof("%s: received %d samples, total: %d", co.tag, curRecvs, co.totalRecv)
+	co.metrics.received.Add(float64(curRecvs))
+	span.SetAttributes(attribute.Int("samples", curRecvs))
+	slog.Infof("%s: received %d samples, total: %d", co.tag, curRecvs, total)
 
 	return nil, nil
 }
@@ -398,10 +436,11 @@ func (w *clickWriter)HandlePromWriteReq(req *remote.WriteRequest, r *http.Reques
 
 
 func (w *clickWriter) Stop() {
+	w.outputs.Stop()
+}
 
-	for _, co := range w.outputs {
-		co.Stop()
-	}
+func (w *clickWriter) Outputs() *outputRegistry {
+	return w.outputs
 }
 
 func (w *clickWriter) Wait() {
@@ -1,20 +1,23 @@
 package modules
 
 import (
+	"context"
 	"fmt"
-	"github.com/ClickHouse/clickhouse-go"
-	"github.com/emirpasic/gods/utils"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/remote"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	rbt "github.com/emirpasic/gods/trees/redblacktree"
-
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type promSample3 struct {
@@ -22,119 +25,70 @@ type promSample3 struct {
 	tags        []string
 	val         float64
 	ts          time.Time
+	date        time.Time		// the date of metric, only for metrics
 	fingerprint uint64
 	isSample    bool
 }
 
-type fingerprintCheckpoint struct {
-	firstDiscovery time.Time
-	//lastDiscovery  time.Time
-	fingerprint    uint64
-}
-
-type fingerprintCache struct {
-	fingerprints map[uint64]*fingerprintCheckpoint
-	timelines    *rbt.Tree
-	holdTime     time.Duration
-}
-
-func newFingerprintCache(holdSecond int) *fingerprintCache {
-	out := new(fingerprintCache)
-
-	if holdSecond < 0 {
-		holdSecond = 0
-	}
-
-	out.fingerprints = map[uint64]*fingerprintCheckpoint{}
-	out.timelines    = rbt.NewWith(utils.TimeComparator)
-	out.holdTime     = time.Second * time.Duration(holdSecond)
-
-	return out
-}
-
-// return true if is a new one
-func (fc *fingerprintCache) cache(fingerprint uint64) bool {
-
-	newOne := false
-
-	now := time.Now()
-
-	fcp, exist := fc.fingerprints[fingerprint]
-	if ! exist {
-		fcp = &fingerprintCheckpoint{now, fingerprint}
-
-		fc.fingerprints[fingerprint] = fcp
-		fc.timelines.Put(fcp.firstDiscovery, fcp)
-
-		newOne = true
-	} else {
-
-	}
-
-	return newOne
-}
-
-func (fc *fingerprintCache)Shrink() int {
-
-	now := time.Now()
-	var removes []*fingerprintCheckpoint
-
-	iter := fc.timelines.Iterator()
-	for iter.Next() {
-
-		fcp := iter.Value().(*fingerprintCheckpoint)
-
-		// remove cache created by prev day
-		if now.Day() != fcp.firstDiscovery.Day() {
-			removes = append(removes, fcp)
-			continue
-		}
-
-		// remove cache exceed deadline
-		if now.Sub(fcp.firstDiscovery) > fc.holdTime {
-			removes = append(removes, fcp)
-		} else {
-			break
-		}
-	}
-
-	for _, fcp := range removes {
-		delete(fc.fingerprints, fcp.fingerprint)
-		fc.timelines.Remove(fcp.firstDiscovery)
-	}
-
-	return len(removes)
-}
-
 type clickOutput3 struct {
 	tag          		string
 	cw                  *clickWriter3
 	db           		string
+	table               string
 	tableMetrics     	string
 	tableSamples        string
-	writeCounter       	prometheus.Counter
-	writeFailedCounter 	prometheus.Counter
-	test     			prometheus.Counter
-	timings  			prometheus.Histogram
+	tableLabels         string			// the index of labels, empty if not enabled
+	insertMetricsSql    string
+	insertSamplesSql    string
+	insertLabelsSql     string
+	metrics             *writeMetrics
 	totalRecv			uint64
 	totalWrite          uint64
-	inputs   			chan *promSample3
-	fingerprints        *fingerprintCache
-	fingerprintsMu      sync.Mutex
+	shards              []*clickShard3
+	running             int32			// num of running shards
+	warmUpCancel        context.CancelFunc	// stops the warm-up of fingerprint cache, nil if not warming up
+	warmUpDone          chan struct{}
 }
 
+// the warm-up of fingerprint cache runs with the writes, it's given up after the timeout,
+// the entries are sent to shards in batches
+const (
+	fingerprintWarmUpTimeout = time.Minute
+	fingerprintWarmUpBatch   = 4096
+)
+
 func NewClickOutput3(cw *clickWriter3, db string, table string) (out *clickOutput3) {
 
 	out = new(clickOutput3)
 
 	out.cw           = cw
 	out.db           = db
+	out.table        = table
 	out.tableMetrics = table + "_metrics"
 	out.tableSamples = table + "_samples"
 	out.tag          = cw.tag + "->" + cw.click.tag + "/" + db + ".[" + out.tableMetrics + "," + out.tableSamples + "]"
 
-	out.inputs       = make(chan *promSample3, cw.cfg.Buffer)
-	out.fingerprints = newFingerprintCache(60 * 60 * 24)
+	out.insertMetricsSql = fmt.Sprintf(`INSERT INTO %s (date, name, tags, fingerprint) VALUES (?, ?, ?, ?)`, sqlTable(db, out.tableMetrics))
+	out.insertSamplesSql = fmt.Sprintf(`INSERT INTO %s (fingerprint, ts, val) VALUES (?, ?, ?)`, sqlTable(db, out.tableSamples))
+
+	if cw.cfg.LabelIndex {
+		out.tableLabels     = table + "_labels"
+		out.insertLabelsSql = fmt.Sprintf(`INSERT INTO %s (date, label, value, fingerprint) VALUES (?, ?, ?, ?)`, sqlTable(db, out.tableLabels))
+	}
+
+	out.metrics = newWriteMetrics(cw.click.name, db, table)
+
+	// the buffer and the cache are split to shards
+	nshards := cw.cfg.Shards
+	buffer  := cw.cfg.Buffer / nshards + 1
+	maxSize := cw.cfg.FingerprintCache.MaxSize / nshards + 1
+	metrics := newFingerprintCacheMetrics(cw.click.name, db, table)
+	owners  := newFingerprintOwners()
+
+	for i := 0; i < nshards; i++ {
+		cache := newFingerprintCache(cw.cfg.FingerprintCache.HoldTime, maxSize, metrics, owners)
+		out.shards = append(out.shards, newClickShard3(out, i, buffer, cache))
+	}
 
 	return out
 }
@@ -145,241 +99,190 @@ func (co *clickOutput3) HandleError(err error) error {
 
 	if compile.Match([]byte(err.Error())) {
 		return co.cw.TryCreateDatabaseTable(co)
-	} else {
-		return err
 	}
 
-	return nil
+	return err
 }
 
-func (co *clickOutput3)Stop(){
-	close(co.inputs)
+// owners returns the owners of fingerprints shared by the shards
+func (co *clickOutput3) owners() *fingerprintOwners {
+	return co.shards[0].fingerprints.owners
 }
 
-func (co *clickOutput3) Start() {
+// shardOf returns the shard to handle the series with the fingerprint (not the salted one)
+func (co *clickOutput3) shardOf(fingerprint uint64) *clickShard3 {
+	return co.shards[fingerprint % uint64(len(co.shards))]
+}
 
-	w := co.cw
+func (co *clickOutput3) Status() outputStatus {
 
-	wait := w.cfg.Wait
+	out := outputStatus{
+		Tag      : co.tag,
+		Shards   : len(co.shards),
+		Batch    : co.cw.cfg.Batch,
+		TotalRecv: atomic.LoadUint64(&co.totalRecv),
+	}
 
-	sigSample := new(promSample3)
+	var lastCommit int64
+	for _, sh := range co.shards {
+		out.Queue    += len(sh.inputs)
+		out.Capacity += cap(sh.inputs)
+		out.Pending  += int(atomic.LoadInt64(&sh.pending))
+		if t := atomic.LoadInt64(&sh.lastCommit); t > lastCommit {
+			lastCommit = t
+		}
+	}
+	if lastCommit > 0 {
+		out.LastCommit = time.Unix(0, lastCommit)
+	}
+	if len(co.shards) > 0 {
+		out.FingerprintCacheSize = int(atomic.LoadInt64(&co.shards[0].fingerprints.metrics.entries))
+	}
 
-	// wake up writer fo every 1 seconds
-	go func() {
+	return out
+}
 
-		for {
-			time.Sleep(time.Second)
-			select {
-			case co.inputs <- sigSample:
-			default:
-			}
-		}
+func (co *clickOutput3) Start() {
 
-	}()
+	atomic.StoreInt32(&co.running, int32(len(co.shards)))
 
-	var insertMetricSQL = `INSERT INTO %s.%s (name, tags, fingerprint) VALUES (?, ?, ?)`
-	var insertSampleSQL = `INSERT INTO %s.%s (fingerprint, ts, val) VALUES (?, ?, ?)`
+	for _, sh := range co.shards {
+		sh.start()
+	}
 
-	go func() {
-		w.wg.Add(1)
-		slog.Infof("%s: started", co.tag)
+	if co.cw.cfg.FingerprintCache.WarmUp {
+		ctx, cancel := context.WithTimeout(context.Background(), fingerprintWarmUpTimeout)
+		co.warmUpCancel = cancel
+		co.warmUpDone   = make(chan struct{})
+		go func() {
+			defer close(co.warmUpDone)
+			defer cancel()
+			co.warmUpFingerprints(ctx)
+		}()
+	}
+}
 
-		sql1    := fmt.Sprintf(insertMetricSQL, co.db, co.tableMetrics)
-		sql2    := fmt.Sprintf(insertSampleSQL, co.db, co.tableSamples)
-		chanOK := true
+// Stop stops all the shards, the shards will flush their batches before exit
+func (co *clickOutput3)Stop(){
 
-		var metrics []*promSample3
-		var samples []*promSample3
+	// the warm-up sends to the inputs of shards, so it's stopped first
+	if co.warmUpCancel != nil {
+		co.warmUpCancel()
+		<-co.warmUpDone
+	}
 
-		for chanOK {
-			w.test.Add(1)
+	for _, sh := range co.shards {
+		close(sh.inputs)
+	}
+}
 
-			// get next batch of requests
-			tstart := time.Now()
-			for i := 0; i < w.cfg.Batch; i++ {
-				var req *promSample3
+// shardStopped is called by every shard when it exits, the caches are saved after all the shards exited,
+// then they are reset, so the cache size of a stopped output (like reaped on idle timeout) is not reported anymore
+func (co *clickOutput3) shardStopped() {
+	if atomic.AddInt32(&co.running, -1) == 0 {
+		co.saveFingerprints()
+		for _, sh := range co.shards {
+			sh.fingerprints.Reset()
+		}
+	}
+}
 
-				// get request and also check if channel is closed
-				req, chanOK = <-co.inputs
+func (co *clickOutput3) snapshotPath() string {
+	return filepath.Join(co.cw.cfg.FingerprintCache.SnapshotDir, co.db + "." + co.tableMetrics + ".fpc")
+}
 
-				if !chanOK {
-					slog.Infof("%s: stopping...", co.tag)
-					break
-				}
+// loadFingerprints fills the fingerprint caches from the local snapshot before start,
+// so a restarted writer will not write all the metrics of today again, see warmUpFingerprints for a new one
+func (co *clickOutput3) loadFingerprints() {
 
-				// we need to filter out sigSample
-				if req != sigSample{
-					if ! req.isSample {
-						metrics = append(metrics, req)
-					} else {
-						samples = append(samples, req)
-					}
-				}
+	cfg := &co.cw.cfg.FingerprintCache
 
-				if wait > 0 && time.Now().Sub(tstart) > time.Second * time.Duration(wait) {
-					break
-				}
+	if cfg.SnapshotDir != "" {
+		cnt, err := loadFingerprintSnapshot(co.snapshotPath(), time.Second * time.Duration(cfg.HoldTime), func(key fingerprintKey, check uint64, lastUse time.Time) {
+			switch {
+			case check == 0:
+				// the owner is unknown, saved by the old versions, it'll be written again
+			case key.date == 0:
+				co.owners().pin(key.fingerprint, check)
+			default:
+				co.shardOf(key.fingerprint).fingerprints.put(key, check, lastUse)
 			}
+		})
+		if err != nil && !os.IsNotExist(err) {
+			slog.Warnf("%s: load fingerprint snapshot from %s failed: %s", co.tag, co.snapshotPath(), err)
+		} else if err == nil {
+			slog.Infof("%s: loaded %d fingerprints from snapshot %s", co.tag, cnt, co.snapshotPath())
+		}
+	}
+}
 
-			// ensure we have something to send..
-			nmetrics := len(metrics)
-			nsamples := len(samples)
-			if (nmetrics + nsamples) < 1 {
-				continue
-			}
+// warmUpFingerprints fills the fingerprint caches from clickhouse, so a newly added writer will not write all the metrics
+// of today again, it runs with the writes, the entries are put in the shard goroutines, the ones already cached are
+// kept, the series written before their entries are put may be written again, it's ok as ReplacingMergeTree merges them
+func (co *clickOutput3) warmUpFingerprints(ctx context.Context) {
 
-			// do for samples
-			if nsamples > 0 {
-				start := time.Now()
-
-				// post them to db all at once
-				tx, err := w.click.db.Begin()
-				if err != nil {
-					slog.Errorf("%s: begin transaction: %s", co.tag, err.Error())
-					w.writeFailedCounter.Add(1.0)
-					w.click.TryConnect()		// if connect failed, the health status will be set to false, and reject receive new samples
-					continue
-				}
-
-				// build statements
-				smt, err := tx.Prepare(sql2)
-				if err != nil {
-					tx.Commit()
-
-					err2 := co.HandleError(err)		// create database and table here
-					if err2 != nil {
-						slog.Errorf("%s: prepare statement: %s", co.tag, err.Error())
-						slog.Errorf("%s: auto create table failed: %s", co.tag, err2.Error())
-
-						continue
-					} else {
-
-						tx, err = w.click.db.Begin()
-						if err != nil {
-							slog.Errorf("%s: begin transaction: %s", co.tag, err.Error())
-							w.writeFailedCounter.Add(1.0)
-							continue
-						}
-
-						smt, err = tx.Prepare(sql2)
-						if err != nil {
-							tx.Commit()
-
-							slog.Errorf("%s: prepare statement: %s", co.tag, err.Error())
-							continue
-						}
-					}
-				}
-
-				for _, sp := range samples {
-					// ensure tags are inserted in the same order each time
-					// possibly/probably impacts indexing?
-
-					_, err = smt.Exec(sp.fingerprint, sp.ts, sp.val)
-
-					if err != nil {
-						slog.Errorf("%s: statement exec: %s", co.tag, err.Error())
-						w.writeFailedCounter.Add(1.0)
-					}
-				}
-
-				// commit and record metrics
-				if err = tx.Commit(); err != nil {
-					slog.Errorf("%s: commit failed: %s", co.tag, err.Error())
-					w.writeFailedCounter.Add(1.0)
-
-					w.click.TryConnect()
-
-				} else {
-					samples = []*promSample3{}				// write ok, clear reqs
-
-					w.totalWrite += uint64(nsamples)
-
-					slog.Infof("%s: write %d samples, total: %d, cost: %s", co.tag, nsamples, w.totalWrite, time.Now().Sub(start).String())
-
-					w.writeCounter.Add(float64(nmetrics))
-					w.timings.Observe(float64(time.Since(tstart)))
-				}
-			}
+	now     := time.Now()
+	pending := map[*clickShard3][]func(){}
+
+	// the put of entries fails only if ctx is done, then the query fails too
+	send := func(sh *clickShard3) bool {
+		puts := pending[sh]
+		delete(pending, sh)
+
+		select {
+		case sh.inputs <- &shardInput3{call: func() { for _, put := range puts { put() } }}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
-			// do for metrics
-			if nmetrics > 0 {
-				start := time.Now()
-
-				// post them to db all at once
-				tx, err := w.click.db.Begin()
-				if err != nil {
-					slog.Errorf("%s: begin transaction: %s", co.tag, err.Error())
-					w.writeFailedCounter.Add(1.0)
-					w.click.TryConnect()		// if connect failed, the health status will be set to false, and reject receive new samples
-					continue
-				}
-
-				// build statements
-				smt, err := tx.Prepare(sql1)
-				if err != nil {
-					tx.Commit()
-
-					err2 := co.HandleError(err)		// create database and table here
-					if err2 != nil {
-						slog.Errorf("%s: prepare statement: %s", co.tag, err.Error())
-						slog.Errorf("%s: auto create table failed: %s", co.tag, err2.Error())
-
-						continue
-					} else {
-
-						tx, err = w.click.db.Begin()
-						if err != nil {
-							slog.Errorf("%s: begin transaction: %s", co.tag, err.Error())
-							w.writeFailedCounter.Add(1.0)
-							continue
-						}
-
-						smt, err = tx.Prepare(sql1)
-						if err != nil {
-							tx.Commit()
-
-							slog.Errorf("%s: prepare statement: %s", co.tag, err.Error())
-							continue
-						}
-					}
-				}
-
-				for _, mt := range metrics {
-					// ensure tags are inserted in the same order each time
-					// possibly/probably impacts indexing?
-
-					_, err = smt.Exec(mt.name, clickhouse.Array(mt.tags), mt.fingerprint)
-
-					if err != nil {
-						slog.Errorf("%s: statement exec: %s", co.tag, err.Error())
-						w.writeFailedCounter.Add(1.0)
-					}
-				}
-
-				// commit and record metrics
-				if err = tx.Commit(); err != nil {
-					slog.Errorf("%s: commit failed: %s", co.tag, err.Error())
-					w.writeFailedCounter.Add(1.0)
-
-					w.click.TryConnect()
-
-				} else {
-					metrics = []*promSample3{}				// write ok, clear reqs
-
-					// w.totalWrite += uint64(nmetrics)     // ...
-
-					slog.Infof("%s: write %d metrics, total: %d, cost: %s", co.tag, nmetrics, w.totalWrite, time.Now().Sub(start).String())
-
-					w.timings.Observe(float64(time.Since(tstart)))
-				}
+	// the samples of yesterday may still come after restart
+	cnt, err := warmUpFingerprints(ctx, co.cw.click, co.db, co.tableMetrics, now.AddDate(0, 0, -1), co.cw.cfg.FingerprintCache.MaxSize, func(key fingerprintKey, fingerprint uint64, check uint64) {
+		// cached in the shard of the series, and the salted ones are pinned, so they are kept after evicted
+		sh := co.shardOf(fingerprint)
+		pending[sh] = append(pending[sh], func() {
+			sh.fingerprints.put(key, check, now)
+			if fingerprint != key.fingerprint {
+				co.owners().pin(key.fingerprint, check)
 			}
+		})
+		if len(pending[sh]) >= fingerprintWarmUpBatch {
+			send(sh)
 		}
+	})
+	for sh := range pending {
+		if !send(sh) {
+			break
+		}
+	}
+
+	if err != nil {
+		slog.Warnf("%s: warm up fingerprint cache failed: %s", co.tag, err)
+	} else {
+		slog.Infof("%s: warmed up fingerprint cache with %d fingerprints in %s", co.tag, cnt, time.Now().Sub(now).String())
+	}
+}
+
+// saveFingerprints writes the fingerprint caches to the local snapshot, it's called when all the shards exited
+func (co *clickOutput3) saveFingerprints() {
+
+	if co.cw.cfg.FingerprintCache.SnapshotDir == "" {
+		return
+	}
+
+	var caches []*fingerprintCache
+	for _, sh := range co.shards {
+		caches = append(caches, sh.fingerprints)
+	}
 
-		slog.Infof("%s: stopped", co.tag)
+	cnt, err := saveFingerprintSnapshot(co.snapshotPath(), caches, co.owners())
+	if err != nil {
+		slog.Warnf("%s: save fingerprint snapshot to %s failed: %s", co.tag, co.snapshotPath(), err)
+		return
+	}
 
-		w.wg.Done()
-	}()
+	slog.Infof("%s: saved %d fingerprints to snapshot %s", co.tag, cnt, co.snapshotPath())
 }
 
 type clickWriter3 struct {
@@ -388,13 +291,9 @@ type clickWriter3 struct {
 	//inputs   			chan *promSample
 	wg       			sync.WaitGroup
 	click    			*click
-	writeCounter       	prometheus.Counter
-	writeFailedCounter 	prometheus.Counter
-	test     			prometheus.Counter
-	timings  			prometheus.Histogram
 	totalRecv			uint64
 	totalWrite          uint64
-	outputs             map[string]*clickOutput3
+	outputs             *outputRegistry
 }
 
 func (w *clickWriter3)init(){
@@ -411,22 +310,27 @@ func (w *clickWriter3)init(){
 	if w.cfg.Wait < 1 {
 		w.cfg.Wait = -1
 	}
+	if w.cfg.Shards < 1 {
+		w.cfg.Shards = runtime.NumCPU()
+	}
+	if w.cfg.FingerprintCache.MaxSize < 1 {
+		w.cfg.FingerprintCache.MaxSize = 1000000
+	}
+	if w.cfg.FingerprintCache.HoldTime < 1 {
+		w.cfg.FingerprintCache.HoldTime = 60 * 60 * 24
+	}
 
 	w.click = Engine.clicks.GetServer(w.cfg.Clickhouse)
 	if w.click == nil{
 		slog.Fatalf("%s: clickhouse '%s' set in writer can not be found", w.tag, w.cfg.Clickhouse)
 	}
 
-	w.writeCounter       = prometheus.NewCounter( prometheus.CounterOpts{ Name: "write_samples_total"       , Help: "Total number of processed samples sent to remote storage."})
-	w.writeFailedCounter = prometheus.NewCounter( prometheus.CounterOpts{ Name: "write_failed_samples_total", Help: "Total number of processed samples which failed on send to remote storage."})
-	w.test               = prometheus.NewCounter( prometheus.CounterOpts{ Name: "prometheus_remote_storage_sent_batch_duration_seconds_bucket_test", Help: "Test metric to ensure backfilled metrics are readable via prometheus.",})
-	w.timings            = prometheus.NewHistogram( prometheus.HistogramOpts{Name: "write_batch_duration_seconds", Help: "Duration of sample batch send calls to the remote storage.", Buckets: prometheus.DefBuckets})
-	prometheus.MustRegister(w.writeCounter)
-	prometheus.MustRegister(w.writeFailedCounter)
-	prometheus.MustRegister(w.test)
-	prometheus.MustRegister(w.timings)
-
-	w.outputs = map[string]*clickOutput3{}
+	w.outputs = newOutputRegistry(w.tag, idleTimeout(w.cfg), func(db string, table string) writerOutput {
+		co := NewClickOutput3(w, db, table)
+		co.loadFingerprints()
+		return co
+	})
+	prometheus.MustRegister(newOutputsCollector(w.click.name, w.outputs))
 }
 
 func (w *clickWriter3) Start() {
@@ -451,10 +355,10 @@ func (w *clickWriter3) HandleError(err error, co *clickOutput3) error {
 func (w *clickWriter3) TryCreateDatabaseTable(co *clickOutput3) error{
 
 
-	creatDBSql     := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", co.db)
+	creatDBSql     := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", co.db)
 
 	creatTableSql1 := fmt.Sprintf(`
-        CREATE TABLE IF NOT EXISTS %s.%s (
+        CREATE TABLE IF NOT EXISTS %s (
 			date        Date      DEFAULT toDate(now()),
             name        String,
             tags        Array(String),
@@ -462,33 +366,51 @@ func (w *clickWriter3) TryCreateDatabaseTable(co *clickOutput3) error{
 		)
 		ENGINE = ReplacingMergeTree
 			PARTITION BY toYYYYMM(date)
-			ORDER BY (date, name, tags, fingerprint)`, co.db, co.tableMetrics)
+			ORDER BY (date, name, tags, fingerprint)`, sqlTable(co.db, co.tableMetrics))
 
-	creatTableSql2 := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.%s (
+	creatTableSql2 := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
 			fingerprint  UInt64,
 			ts           DateTime,
 			val          Float64
 		)
 		ENGINE = MergeTree
 			PARTITION BY toYYYYMM(ts)
-			ORDER BY (fingerprint, ts)`, co.db, co.tableSamples)
+			ORDER BY (fingerprint, ts)`, sqlTable(co.db, co.tableSamples))
+
+	// the postings of labels, a fingerprint is written here with its metric of every date
+	creatTableSql3 := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			date         Date,
+			label        String,
+			value        String,
+			fingerprint  UInt64
+		)
+		ENGINE = ReplacingMergeTree
+			PARTITION BY toYYYYMM(date)
+			ORDER BY (label, value, date, fingerprint)`, sqlTable(co.db, co.tableLabels))
 
 	{
-		_, err := w.click.Exec(creatDBSql)
+		_, err := w.click.Exec(context.Background(), creatDBSql)
 		if err != nil{
 			return err
 		}
 	}
 
 	{
-		_, err := w.click.Exec(creatTableSql1)
+		_, err := w.click.Exec(context.Background(), creatTableSql1)
 		if err != nil{
 			return err
 		}
 	}
 
 	{
-		_, err := w.click.Exec(creatTableSql2)
+		_, err := w.click.Exec(context.Background(), creatTableSql2)
+		if err != nil{
+			return err
+		}
+	}
+
+	if co.tableLabels != "" {
+		_, err := w.click.Exec(context.Background(), creatTableSql3)
 		if err != nil{
 			return err
 		}
@@ -497,11 +419,9 @@ func (w *clickWriter3) TryCreateDatabaseTable(co *clickOutput3) error{
 	return nil
 }
 
-func (w *clickWriter3)getClickOutput(r *http.Request) (*clickOutput3, error){
-	err := r.ParseForm()
-	if err != nil {
-		return nil, err
-	}
+// getDbTable returns the db.table set in request, or the default ones in config
+func (w *clickWriter3)getDbTable(r *http.Request) (string, string){
+	r.ParseForm()
 
 	dbName := w.click.cfg.Database
 	tbName := w.click.cfg.Table
@@ -519,114 +439,130 @@ func (w *clickWriter3)getClickOutput(r *http.Request) (*clickOutput3, error){
 		}
 	}
 
-	if dbName == "" || tbName == "" {
-		return nil, fmt.Errorf("invald dbName '%s' or tbName '%s'", dbName, tbName)
+	return dbName, tbName
+}
+
+// getClickOutput returns the output of db.table set in request, call release when the output is not used
+func (w *clickWriter3)getClickOutput(r *http.Request) (*clickOutput3, func(), error){
+	dbName, tbName := w.getDbTable(r)
+
+	return w.getClickOutputByName(dbName, tbName)
+}
+
+// getClickOutputByName returns the output of db.table, call release when the output is not used
+func (w *clickWriter3)getClickOutputByName(dbName string, tbName string) (*clickOutput3, func(), error){
+
+	output, release, err := w.outputs.Acquire(dbName, tbName)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	coName := dbName + "." + tbName
-	co, ok := w.outputs[coName]
-	if !ok {
-		co = NewClickOutput3(w, dbName, tbName)
-		co.Start()
+	return output.(*clickOutput3), release, nil
+}
 
-		w.outputs[coName] = co
+// metricDate returns the time used for the date column of <table>_metrics, it should be in the same zone as the reader
+func metricDate(t time.Time) time.Time {
+	if Cfg.Reader.Utc {
+		return t.UTC()
 	}
 
-	return co, nil
+	return t.Local()
+}
+
+// parseSeries converts the labels of a series to the name, tags and fingerprint stored in clickhouse,
+// note: the labels will be sorted by name
+func parseSeries(labels []*remote.LabelPair) (name string, tags []string, fingerprint uint64) {
+
+	for _, label := range labels {
+		if model.LabelName(label.Name) == model.MetricNameLabel {
+			name = label.Value
+		}
+		// store tags in <key>=<value> format
+		// allows for has(tags, "key=val") searches
+		// probably impossible/difficult to do regex searches on tags
+		t := fmt.Sprintf("%s=%s", label.Name, label.Value)
+		tags = append(tags, t)
+	}
+
+	// calculate fingerprints
+	// we do not cache fingerprint now, because we need to update the date of metric in clickhouse
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	fingerprint = Fingerprint(labels)
+
+	sort.Strings(tags)
+
+	return
 }
 
 func (w *clickWriter3)HandlePromWriteReq(req *remote.WriteRequest, r *http.Request) (*remote.ReadResponse, error){
 
 	curRecvs := 0
 
-	co, err := w.getClickOutput(r)
+	co, release, err := w.getClickOutput(r)
 	if err != nil{
 		slog.Errorf("%s: get clickOutput failed: %s", w.tag, err)
+
+		dbName, tbName := w.getDbTable(r)
+		writeDroppedSamples.WithLabelValues(w.click.name, dbName, tbName, dropNoOutput).Add(float64(countSamples(req)))
 		return nil, nil
 	}
+	defer release()
 
-	fingerprints := make(map[uint64]*promSample3, len(req.Timeseries))
+	_, span := tracer.Start(r.Context(), "enqueue", trace.WithAttributes(attribute.String("db.name", co.db), attribute.String("db.table", co.metrics.table)))
+	defer span.End()
 
 	for _, series := range req.Timeseries {
 		curRecvs += len(series.Samples)
 
-		var (
-			name string
-			tags []string
-		)
+		name, tags, fingerprint := parseSeries(series.Labels)
 
-		for _, label := range series.Labels {
-			if model.LabelName(label.Name) == model.MetricNameLabel {
-				name = label.Value
-			}
-			// store tags in <key>=<value> format
-			// allows for has(tags, "key=val") searches
-			// probably impossible/difficult to do regex searches on tags
-			t := fmt.Sprintf("%s=%s", label.Name, label.Value)
-			tags = append(tags, t)
+		co.shardOf(fingerprint).inputs <- &shardInput3{
+			labels     : series.Labels,
+			name       : name,
+			tags       : tags,
+			fingerprint: fingerprint,
+			samples    : series.Samples,
 		}
+	}
 
-		// calculate fingerprints
-		// we do not cache fingerprint now, because we need to update the date of metric in clickhouse
-		labels := series.Labels
-		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
-		fingerprint := Fingerprint(labels)
-
-		sort.Strings(tags)
+	atomic.AddUint64(&w.totalRecv, uint64(curRecvs))
+	total := atomic.AddUint64(&co.totalRecv, uint64(curRecvs))
 
-		for _, sample := range series.Samples {
-			sp := new(promSample3)
-			sp.name        = name
-			sp.ts          = time.Unix(sample.TimestampMs/1000, sample.TimestampMs % 1000)
-			sp.val         = sample.Value
-			sp.tags        = tags
-			sp.fingerprint = fingerprint
-			sp.isSample    = true
+	Engine.server.recvCounter.Add(float64(curRecvs))
+	co.metrics.received.Add(float64(curRecvs))
+	span.SetAttributes(attribute.Int("samples", curRecvs))
+	slog.Infof("%s: received %d samples, total: %d", co.tag, curRecvs, total)
 
-			co.inputs <- sp
-		}
+	return nil, nil
+}
 
-		{
-			sp := new(promSample3)
-			sp.name        = name
-			sp.tags        = tags
-            sp.fingerprint = fingerprint
+// forgetFingerprints removes fingerprints from cache, so they will be written to <table>_metrics again when received
+func (w *clickWriter3) forgetFingerprints(db string, table string, fingerprints []uint64) {
 
-			fingerprints[fingerprint] = sp		// here set tags, we do not convert to json
-		}
+	output, release := w.outputs.Lookup(db, table)
+	if output == nil {
+		return
 	}
+	defer release()
 
-	{
-		// send new metrics
-		co.fingerprintsMu.Lock()
-		for _, sp := range fingerprints{
-			if co.fingerprints.cache(sp.fingerprint) {
-				co.inputs <- sp
-			}
-		}
-
-		removed := co.fingerprints.Shrink()
-		if removed > 0 {
-			slog.Debugf("%s: removed %d timeout fingerprint from cache", co.tag, removed)
-		}
+	co := output.(*clickOutput3)
 
-		co.fingerprintsMu.Unlock()
+	// the salted fingerprints may be in any shard
+	for _, sh := range co.shards {
+		sh.call(func() {
+			for _, fp := range fingerprints {
+				sh.fingerprints.remove(fp)
+			}
+		})
 	}
-
-	w.totalRecv  += uint64(curRecvs)
-	co.totalRecv += uint64(curRecvs)
-
-	Engine.server.recvCounter.Add(float64(curRecvs))
-	slog.Infof("%s: received %d samples, total: %d", co.tag, curRecvs, co.totalRecv)
-
-	return nil, nil
 }
 
 func (w *clickWriter3) Stop() {
+	w.outputs.Stop()
+}
 
-	for _, co := range w.outputs {
-		co.Stop()
-	}
+func (w *clickWriter3) Outputs() *outputRegistry {
+	return w.outputs
 }
 
 func (w *clickWriter3) Wait() {
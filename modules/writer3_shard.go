@@ -0,0 +1,417 @@
+package modules
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/prometheus/prometheus/storage/remote"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// shardInput3 is an item sent to a shard, only one of series(labels, ...), rows and call is set
+type shardInput3 struct {
+	labels      []*remote.LabelPair		// sorted by name, see parseSeries
+	name        string
+	tags        []string
+	fingerprint uint64
+	samples     []*remote.Sample
+	rows        []*promSample3			// samples and metrics resolved already, like the ones from importer
+	call        func()					// runs in the shard goroutine, to access the fingerprint cache
+}
+
+// clickShard3 is a worker of clickOutput3, the series are dispatched to shards by fingerprint, so a series always goes
+// to the same shard, every shard has its own inputs, batches and fingerprint cache, and flushes its batches by itself,
+// the cache is only accessed in the shard goroutine, so no lock is needed, others need to access it by call()
+type clickShard3 struct {
+	tag          string
+	co           *clickOutput3
+	inputs       chan *shardInput3
+	fingerprints *fingerprintCache
+	collided     map[uint64]bool		// checks of the series stored under a salted fingerprint
+	metrics      []*promSample3
+	samples      []*promSample3
+	labels       []*promSample3			// the metrics whose labels are not written to the index yet
+	pending      int64				// atomic, num of rows in batches, for status
+	lastCommit   int64				// atomic, unix nano of last commit, for status
+}
+
+func newClickShard3(co *clickOutput3, id int, buffer int, cache *fingerprintCache) *clickShard3 {
+	out := new(clickShard3)
+
+	out.tag          = fmt.Sprintf("%s#%d", co.tag, id)
+	out.co           = co
+	out.inputs       = make(chan *shardInput3, buffer)
+	out.fingerprints = cache
+	out.collided     = map[uint64]bool{}
+
+	return out
+}
+
+// call runs fn in the shard goroutine and waits for it done
+func (sh *clickShard3) call(fn func()) {
+	done := make(chan struct{})
+	sh.inputs <- &shardInput3{call: func() { fn(); close(done) }}
+	<-done
+}
+
+func (sh *clickShard3) start() {
+
+	w := sh.co.cw
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		slog.Infof("%s: started", sh.tag)
+
+		// wake up for every 1 seconds to check the wait time and shrink the cache
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		tstart := time.Now()
+		for {
+			select {
+			case in, ok := <-sh.inputs:
+				if !ok {
+					slog.Infof("%s: stopping...", sh.tag)
+					sh.flush()
+					if n := len(sh.samples); n > 0 {
+						slog.Errorf("%s: %d samples dropped because writer is stopped", sh.tag, n)
+						sh.co.metrics.dropped(dropStopped, n)
+					}
+					if n := len(sh.metrics) + len(sh.labels); n > 0 {
+						slog.Errorf("%s: %d metrics and %d labels dropped because writer is stopped", sh.tag, len(sh.metrics), len(sh.labels))
+						sh.dropRows("metrics", sh.metrics, dropStopped)
+						sh.dropRows("labels" , sh.labels , dropStopped)
+						sh.metrics = nil
+						sh.labels  = nil
+					}
+					slog.Infof("%s: stopped", sh.tag)
+					sh.co.shardStopped()
+					return
+				}
+				sh.handle(in)
+
+			case <-ticker.C:
+				removed := sh.fingerprints.Shrink()
+				if removed > 0 {
+					slog.Debugf("%s: removed %d timeout fingerprint from cache", sh.tag, removed)
+				}
+			}
+
+			n := len(sh.samples) + len(sh.metrics) + len(sh.labels)
+			if n == 0 {
+				tstart = time.Now()
+				continue
+			}
+			if n >= w.cfg.Batch || w.cfg.Wait > 0 && time.Now().Sub(tstart) > time.Second * time.Duration(w.cfg.Wait) {
+				sh.flush()
+				tstart = time.Now()
+			}
+			atomic.StoreInt64(&sh.pending, int64(len(sh.samples) + len(sh.metrics) + len(sh.labels)))
+		}
+	}()
+}
+
+func (sh *clickShard3) handle(in *shardInput3) {
+
+	if in.call != nil {
+		in.call()
+		return
+	}
+
+	if in.rows != nil {
+		for _, row := range in.rows {
+			if row.isSample {
+				sh.samples = append(sh.samples, row)
+			} else {
+				sh.addMetric(row)
+			}
+		}
+		return
+	}
+
+	fingerprint, check := sh.resolveFingerprint(in.labels, in.fingerprint)
+
+	var lastDate fingerprintKey
+
+	for _, sample := range in.samples {
+		sp := new(promSample3)
+		sp.name        = in.name
+		sp.ts          = time.Unix(sample.TimestampMs/1000, (sample.TimestampMs % 1000) * int64(time.Millisecond))
+		sp.val         = sample.Value
+		sp.tags        = in.tags
+		sp.fingerprint = fingerprint
+		sp.isSample    = true
+
+		sh.samples = append(sh.samples, sp)
+
+		// a metric for every date of samples, the samples of a series are usually in the same date
+		date := metricDate(sp.ts)
+		key  := newFingerprintKey(fingerprint, date)
+		if key != lastDate {
+			lastDate = key
+
+			if sh.fingerprints.cache(fingerprint, check, date) {
+				mt := new(promSample3)
+				mt.name        = in.name
+				mt.tags        = in.tags		// here set tags, we do not convert to json
+				mt.fingerprint = fingerprint
+				mt.date        = date
+
+				sh.addMetric(mt)
+			}
+		}
+	}
+
+	// claimed but no samples cached
+	sh.fingerprints.release(fingerprint)
+}
+
+// addMetric adds a metric (a new fingerprint of a date) to batch, and its labels to the index if enabled
+func (sh *clickShard3) addMetric(mt *promSample3) {
+	sh.metrics = append(sh.metrics, mt)
+	if sh.co.tableLabels != "" {
+		sh.labels = append(sh.labels, mt)
+	}
+}
+
+// dropRows drops the rows of kind (metrics or labels) not written, the entries of them are removed from the cache,
+// or they are saved to the snapshot as written, and the series will not be written again after restarted
+func (sh *clickShard3) dropRows(kind string, rows []*promSample3, reason string) {
+	for _, mt := range rows {
+		sh.fingerprints.forget(newFingerprintKey(mt.fingerprint, mt.date))
+	}
+	sh.co.metrics.droppedRows(kind, reason, len(rows))
+}
+
+// resolveFingerprint returns the id to store the series in clickhouse, it's the fingerprint unless the fingerprint
+// is already used by another series in cache, then a salted one is used, so the two series will not be merged when read
+func (sh *clickShard3) resolveFingerprint(labels []*remote.LabelPair, fingerprint uint64) (uint64, uint64) {
+
+	check := SeriesCheck(labels)
+
+	owners := sh.fingerprints.owners
+
+	id, collided := disambiguate(fingerprint, check, owners.ownerOf, func(id uint64) bool { return owners.claim(id, check) })
+	if collided && !sh.collided[check] {
+		sh.collided[check] = true
+		sh.fingerprints.metrics.collisions.Inc()
+		slog.Warnf("%s: fingerprint %d collided, series %v will be stored as %d", sh.tag, fingerprint, labels, id)
+
+		// both of the series keep their ids, even if they are evicted from cache
+		if c, exist := owners.ownerOf(fingerprint); exist {
+			owners.pin(fingerprint, c)
+		}
+		owners.pin(id, check)
+	}
+
+	return id, check
+}
+
+// flush writes the samples, the labels and then the metrics, so a fingerprint can be read once its metric is written,
+// the rows are kept to retry in next flush if failed, except the labels, the metrics are written even if the labels
+// failed, or the series can not be read at all, the labels are retried alone then
+func (sh *clickShard3) flush() {
+
+	w  := sh.co.cw
+	co := sh.co
+
+	if len(sh.samples) > 0 {
+		start := time.Now()
+
+		samples, dropped, err := sh.writeRows(co.insertSamplesSql, sh.samples, func(smt *sql.Stmt, sp *promSample3) error {
+			_, err := smt.Exec(sp.fingerprint, sp.ts, sp.val)
+			return err
+		})
+		if len(dropped) > 0 {
+			co.metrics.dropped(dropExecFailed, len(dropped))
+		}
+		sh.samples = samples
+		if err != nil {
+			slog.Errorf("%s: %s", sh.tag, err)
+			co.metrics.failed.Add(float64(len(samples)))
+			return
+		}
+
+		if nsamples := len(samples); nsamples > 0 {
+			// the samples delayed or imported change the results cached by reader
+			oldest := samples[0].ts
+			for _, sp := range samples {
+				if sp.ts.Before(oldest) {
+					oldest = sp.ts
+				}
+			}
+			resultsCache.invalidateSince(co.db, co.table, oldest)
+
+			atomic.StoreInt64(&sh.lastCommit, time.Now().UnixNano())
+
+			total := atomic.AddUint64(&w.totalWrite, uint64(nsamples))
+
+			slog.Infof("%s: write %d samples, total: %d, cost: %s", sh.tag, nsamples, total, time.Now().Sub(start).String())
+
+			co.metrics.written.Add(float64(nsamples))
+			co.metrics.batch("samples", nsamples, time.Now().Sub(start))
+		}
+		sh.samples = nil				// write ok, clear reqs
+	}
+
+	if len(sh.labels) > 0 {
+		start := time.Now()
+
+		n := map[*promSample3]int{}		// the labels written of metrics, the rows rolled back are written again
+		labels, dropped, err := sh.writeRows(co.insertLabelsSql, sh.labels, func(smt *sql.Stmt, mt *promSample3) error {
+			n[mt] = 0
+			for _, tag := range mt.tags {
+				kv := strings.SplitN(tag, "=", 2)
+				if len(kv) != 2 || kv[1] == "" {
+					continue		// the same as missing, see makeLabels
+				}
+				if _, err := smt.Exec(mt.date, kv[0], kv[1], mt.fingerprint); err != nil {
+					return err
+				}
+				n[mt]++
+			}
+			return nil
+		})
+		if len(dropped) > 0 {
+			sh.dropRows("labels", dropped, dropExecFailed)
+		}
+		sh.labels = labels
+		if err != nil {
+			slog.Errorf("%s: %s", sh.tag, err)
+			co.metrics.failed.Add(float64(len(labels)))
+		} else {
+			sh.labels = nil				// write ok, clear reqs
+			atomic.StoreInt64(&sh.lastCommit, time.Now().UnixNano())
+
+			nlabels := 0
+			for _, mt := range labels {
+				nlabels += n[mt]
+			}
+			slog.Infof("%s: write %d labels of %d metrics, cost: %s", sh.tag, nlabels, len(labels), time.Now().Sub(start).String())
+
+			co.metrics.batch("labels", nlabels, time.Now().Sub(start))
+		}
+	}
+
+	if len(sh.metrics) > 0 {
+		start := time.Now()
+
+		metrics, dropped, err := sh.writeRows(co.insertMetricsSql, sh.metrics, func(smt *sql.Stmt, mt *promSample3) error {
+			_, err := smt.Exec(mt.date, mt.name, clickhouse.Array(mt.tags), mt.fingerprint)
+			return err
+		})
+		if len(dropped) > 0 {
+			sh.dropRows("metrics", dropped, dropExecFailed)
+		}
+		sh.metrics = metrics
+		if err != nil {
+			slog.Errorf("%s: %s", sh.tag, err)
+			co.metrics.failed.Add(float64(len(metrics)))
+			return
+		}
+
+		if nmetrics := len(metrics); nmetrics > 0 {
+			// the fingerprints resolved by reader in these dates are out of date
+			// and the new series are readable from now, the results cached since their samples are out of date too
+			var dates []int32
+			seen   := map[int32]bool{}
+			oldest := metrics[0].date
+			for _, mt := range metrics {
+				if date := dateNum(mt.date); !seen[date] {
+					seen[date] = true
+					dates = append(dates, date)
+				}
+				if mt.date.Before(oldest) {
+					oldest = mt.date
+				}
+			}
+			resolveCache.invalidate(co.db, co.table, dates)
+			resultsCache.invalidateSince(co.db, co.table, oldest)
+
+			atomic.StoreInt64(&sh.lastCommit, time.Now().UnixNano())
+
+			slog.Infof("%s: write %d metrics, cost: %s", sh.tag, nmetrics, time.Now().Sub(start).String())
+
+			co.metrics.batch("metrics", nmetrics, time.Now().Sub(start))
+		}
+		sh.metrics = nil				// write ok, clear reqs
+	}
+}
+
+// writeRows writes the rows in a transaction, the database and tables will be created if not exist,
+// a row failed to exec breaks the block of the transaction, so the transaction is rolled back and the rows are written
+// again without it, the rows left and dropped are returned, the ones left are kept to retry if err is not nil,
+// the batches are mixed from many requests, so the inserts are traced as their own spans
+func (sh *clickShard3) writeRows(query string, rows []*promSample3, exec func(smt *sql.Stmt, row *promSample3) error) (left []*promSample3, dropped []*promSample3, err error) {
+
+	_, span := startClickSpan(context.Background(), "clickhouse insert", sh.co.cw.click, sh.co.db, query)
+	span.SetAttributes(attribute.Int("db.rows", len(rows)))
+	defer func() { endSpan(span, err) }()
+
+	left = rows
+	for len(left) > 0 {
+		var bad int
+		if bad, err = sh.writeTx(query, left, exec); bad < 0 {
+			return left, dropped, err
+		}
+
+		slog.Errorf("%s: statement exec: %s, the row is dropped", sh.tag, err)
+		dropped = append(dropped, left[bad])
+		left    = append(left[:bad:bad], left[bad + 1:]...)		// copied, the rows of caller are not changed
+	}
+
+	return left, dropped, nil
+}
+
+// writeTx writes the rows in a transaction, it returns the index of the row failed to exec, or -1
+func (sh *clickShard3) writeTx(query string, rows []*promSample3, exec func(smt *sql.Stmt, row *promSample3) error) (int, error) {
+
+	w := sh.co.cw
+
+	tx, err := w.click.Begin(context.Background())
+	if err != nil {
+		w.click.TryConnect()		// if connect failed, the health status will be set to false, and reject receive new samples
+		return -1, fmt.Errorf("begin transaction: %s", err)
+	}
+
+	// build statements
+	smt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Commit()
+
+		err2 := sh.co.HandleError(err)		// create database and table here
+		if err2 != nil {
+			return -1, fmt.Errorf("prepare statement: %s, auto create table failed: %s", err, err2)
+		}
+
+		if tx, err = w.click.Begin(context.Background()); err != nil {
+			return -1, fmt.Errorf("begin transaction: %s", err)
+		}
+		if smt, err = tx.Prepare(query); err != nil {
+			tx.Commit()
+			return -1, fmt.Errorf("prepare statement: %s", err)
+		}
+	}
+
+	for i, row := range rows {
+		if err = exec(smt, row); err != nil {
+			tx.Rollback()
+			return i, err
+		}
+	}
+
+	// commit and record metrics
+	if err = tx.Commit(); err != nil {
+		w.click.TryConnect()
+		return -1, fmt.Errorf("commit failed: %s", err)
+	}
+
+	return -1, nil
+}
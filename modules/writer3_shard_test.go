@@ -0,0 +1,135 @@
+package modules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// newFakeClickOutput returns an output of one shard writing to a fakeClick, with the index of labels
+func newFakeClickOutput(t *testing.T) (*clickOutput3, *fakeClick) {
+
+	click, fc := newFakeClick(t)
+
+	co := newTestOutput(1)
+	co.cw.click.db     = click.db
+	co.cw.click.health = 1
+	co.tableLabels     = "samples_labels"
+	co.insertLabelsSql = "INSERT INTO " + sqlTable("prometheus", "samples_labels") + " (date, label, value, fingerprint) VALUES (?, ?, ?, ?)"
+
+	return co, fc
+}
+
+// handleSeries handles a sample of the series of tags at ts
+func handleSeries(sh *clickShard3, ts time.Time, tags ...string) uint64 {
+
+	labels := makeLabels(tags)
+	name, tags, fingerprint := parseSeries(labels)
+
+	sh.handle(&shardInput3{labels: labels, name: name, tags: tags, fingerprint: fingerprint, samples: []*remote.Sample{{Value: 1, TimestampMs: ts.UnixNano() / 1e6}}})
+
+	return fingerprint
+}
+
+func TestShardFlushDropsRowsFailedToExec(t *testing.T) {
+
+	co, fc := newFakeClickOutput(t)
+	sh := co.shards[0]
+
+	now := time.Now()
+	handleSeries(sh, now, "__name__=up", "job=api")
+	fc.badFingerprint = handleSeries(sh, now, "__name__=up", "job=web")
+	handleSeries(sh, now, "__name__=up", "job=db")
+
+	droppedSamples := writeDroppedSamples.WithLabelValues("test", "prometheus", "samples", dropExecFailed)
+	droppedMetrics := writeDroppedRows   .WithLabelValues("test", "prometheus", "samples", "metrics", dropExecFailed)
+	samplesBefore  := testutil.ToFloat64(droppedSamples)
+	metricsBefore  := testutil.ToFloat64(droppedMetrics)
+
+	sh.flush()
+
+	// the other rows of the batches are written, not the rolled back ones
+	if n := len(fc.committed["prometheus.samples_samples"]); n != 2 {
+		t.Errorf("%d samples committed, want 2", n)
+	}
+	if n := len(fc.committed["prometheus.samples_metrics"]); n != 2 {
+		t.Errorf("%d metrics committed, want 2", n)
+	}
+	if n := len(fc.committed["prometheus.samples_labels"]); n != 4 {
+		t.Errorf("%d labels committed, want 4", n)
+	}
+	if len(sh.samples) + len(sh.metrics) + len(sh.labels) != 0 {
+		t.Errorf("%d samples, %d metrics and %d labels left after flushed, want 0", len(sh.samples), len(sh.metrics), len(sh.labels))
+	}
+	if got := testutil.ToFloat64(droppedSamples) - samplesBefore; got != 1 {
+		t.Errorf("%g samples counted as dropped, want 1", got)
+	}
+	if got := testutil.ToFloat64(droppedMetrics) - metricsBefore; got != 1 {
+		t.Errorf("%g metrics counted as dropped, want 1", got)
+	}
+
+	// the dropped metric is not cached as written
+	if sh.fingerprints.Len() != 2 {
+		t.Errorf("%d entries cached, want 2", sh.fingerprints.Len())
+	}
+}
+
+func TestShardFlushMetricsWithoutLabels(t *testing.T) {
+
+	co, fc := newFakeClickOutput(t)
+	sh := co.shards[0]
+
+	now := time.Now()
+	handleSeries(sh, now, "__name__=up", "job=api")
+
+	fc.failCommit = "_labels"
+	sh.flush()
+
+	// the series can be read, and the labels are retried alone
+	if n := len(fc.committed["prometheus.samples_metrics"]); n != 1 {
+		t.Errorf("%d metrics committed while labels failed, want 1", n)
+	}
+	if len(sh.metrics) != 0 || len(sh.labels) != 1 {
+		t.Fatalf("%d metrics and %d labels left, want 0 and 1", len(sh.metrics), len(sh.labels))
+	}
+
+	fc.failCommit = ""
+	sh.flush()
+
+	if n := len(fc.committed["prometheus.samples_labels"]); n != 2 {
+		t.Errorf("%d labels committed after retried, want 2", n)
+	}
+	if n := len(fc.committed["prometheus.samples_metrics"]); n != 1 {
+		t.Errorf("%d metrics committed after retried, want 1", n)
+	}
+	if len(sh.labels) != 0 {
+		t.Errorf("%d labels left after retried, want 0", len(sh.labels))
+	}
+}
+
+func TestShardFlushKeepsRowsFailedToCommit(t *testing.T) {
+
+	co, fc := newFakeClickOutput(t)
+	sh := co.shards[0]
+
+	handleSeries(sh, time.Now(), "__name__=up", "job=api")
+
+	fc.failCommit = "_samples"
+	sh.flush()
+
+	if len(sh.samples) != 1 || len(sh.metrics) != 1 {
+		t.Fatalf("%d samples and %d metrics kept, want 1 and 1", len(sh.samples), len(sh.metrics))
+	}
+	if n := len(fc.committed["prometheus.samples_metrics"]); n != 0 {
+		t.Errorf("%d metrics committed before their samples, want 0", n)
+	}
+
+	fc.failCommit = ""
+	sh.flush()
+
+	if len(fc.committed["prometheus.samples_samples"]) != 1 || len(fc.committed["prometheus.samples_metrics"]) != 1 {
+		t.Errorf("%d samples and %d metrics committed after retried, want 1 and 1", len(fc.committed["prometheus.samples_samples"]), len(fc.committed["prometheus.samples_metrics"]))
+	}
+}
@@ -9,8 +9,17 @@ import (
 func main() {
 
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	modules.Init()
 
-	modules.Engine.StartServer()
-	modules.Engine.WaitServer()
+	switch modules.Command() {
+	case "import":
+		modules.Engine.RunImport()
+
+	case "export":
+		modules.Engine.RunExport()
+
+	default:
+		modules.Engine.StartServer()
+		modules.Engine.WaitServer()
+	}
 }